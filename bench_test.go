@@ -0,0 +1,176 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
+)
+
+// benchPayload is a representative transaction of the benchmarks.
+type benchPayload struct {
+	name        string
+	method      string
+	path        string
+	contentType string
+	body        []byte
+}
+
+var benchPayloads = []benchPayload{
+	{name: "small_get", method: "GET", path: "/search?q=coraza&page=2"},
+	{
+		name:        "form_post_10kb",
+		method:      "POST",
+		path:        "/comments",
+		contentType: "application/x-www-form-urlencoded",
+		body:        []byte("name=panda&comment=" + strings.Repeat("lorem+ipsum+dolor+sit+amet+", 10*1024/27)),
+	},
+	{
+		name:        "json_post_100kb",
+		method:      "POST",
+		path:        "/api/items",
+		contentType: "application/json",
+		// 100 items of 1KB, rather than thousands of small ones, the CRS evaluating each argument.
+		body: []byte(`{"items": [` + strings.TrimSuffix(strings.Repeat(`{"name": "item", "qty": 1, "description": "`+strings.Repeat("lorem ipsum dolor sit amet ", 1000/27)+`"},`, 100), ",") + `]}`),
+	},
+	{
+		name:        "sqli_post",
+		method:      "POST",
+		path:        "/login",
+		contentType: "application/x-www-form-urlencoded",
+		body:        []byte("user=admin&password=1'+or+'1'='1'+--"),
+	},
+}
+
+var benchResponseBody = []byte("<html><body>" + strings.Repeat("<p>Hello, yogi!</p>", 50) + "</body></html>")
+
+// benchPhases are the callbacks of a transaction, in order, the last one completing it.
+var benchPhases = []struct {
+	name string
+	run  func(host proxytest.HostEmulator, id uint32, p benchPayload)
+}{
+	{"request_headers", func(host proxytest.HostEmulator, id uint32, p benchPayload) {
+		headers := [][2]string{
+			{":method", p.method},
+			{":path", p.path},
+			{":authority", "localhost"},
+			{"user-agent", "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/112.0"},
+			{"accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			{"accept-language", "en-US,en;q=0.5"},
+		}
+		if len(p.body) > 0 {
+			headers = append(headers, [2]string{"content-type", p.contentType}, [2]string{"content-length", strconv.Itoa(len(p.body))})
+		}
+		host.CallOnRequestHeaders(id, headers, len(p.body) == 0)
+	}},
+	{"request_body", func(host proxytest.HostEmulator, id uint32, p benchPayload) {
+		if len(p.body) > 0 {
+			host.CallOnRequestBody(id, p.body, true)
+		}
+	}},
+	{"response_headers", func(host proxytest.HostEmulator, id uint32, p benchPayload) {
+		host.CallOnResponseHeaders(id, [][2]string{
+			{":status", "200"},
+			{"content-type", "text/html"},
+			{"content-length", strconv.Itoa(len(benchResponseBody))},
+		}, false)
+	}},
+	{"response_body", func(host proxytest.HostEmulator, id uint32, p benchPayload) {
+		host.CallOnResponseBody(id, benchResponseBody, true)
+	}},
+	{"done", func(host proxytest.HostEmulator, id uint32, p benchPayload) {
+		host.CompleteHttpContext(id)
+	}},
+}
+
+// runBenchPhases runs the phases of the transaction from the first one until, excluded, the last
+// one, returning false if the transaction was interrupted before.
+func runBenchPhases(host proxytest.HostEmulator, id uint32, p benchPayload, from, until int) bool {
+	for i := from; i < until; i++ {
+		if host.GetSentLocalResponse(id) != nil {
+			return false
+		}
+		benchPhases[i].run(host, id, p)
+	}
+	return host.GetSentLocalResponse(id) == nil
+}
+
+// newBenchHost starts the plugin with the CRS, discarding the logs.
+func newBenchHost(b *testing.B) (proxytest.HostEmulator, func()) {
+	b.Helper()
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	opt := proxytest.
+		NewEmulatorOption().
+		WithVMContext(wasmplugin.NewVMContext()).
+		WithPluginConfiguration([]byte(demoDirectives))
+	host, reset := proxytest.NewHostEmulator(opt)
+	require.Equal(b, types.OnPluginStartStatusOK, host.StartPlugin())
+	return host, func() {
+		reset()
+		log.SetOutput(w)
+	}
+}
+
+// BenchmarkPhases measures the cost of each callback of the transactions of representative
+// payloads with the CRS loaded. Phases the transaction doesn't reach, being interrupted, are
+// skipped, e.g. the response of sqli_post.
+func BenchmarkPhases(b *testing.B) {
+	host, reset := newBenchHost(b)
+	defer reset()
+
+	for _, p := range benchPayloads {
+		for i, phase := range benchPhases {
+			p, i := p, i
+			b.Run(fmt.Sprintf("%s/%s", p.name, phase.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					b.StopTimer()
+					id := host.InitializeHttpContext()
+					if !runBenchPhases(host, id, p, 0, i) && i < len(benchPhases)-1 {
+						host.CompleteHttpContext(id)
+						b.Skip("interrupted before the phase")
+					}
+					b.StartTimer()
+					benchPhases[i].run(host, id, p)
+					b.StopTimer()
+					runBenchPhases(host, id, p, i+1, len(benchPhases)-1)
+					if i < len(benchPhases)-1 {
+						host.CompleteHttpContext(id)
+					}
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkTransaction measures the cost of whole transactions of representative payloads with
+// the CRS loaded.
+func BenchmarkTransaction(b *testing.B) {
+	host, reset := newBenchHost(b)
+	defer reset()
+
+	for _, p := range benchPayloads {
+		p := p
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				id := host.InitializeHttpContext()
+				runBenchPhases(host, id, p, 0, len(benchPhases)-1)
+				host.CompleteHttpContext(id)
+			}
+		})
+	}
+}
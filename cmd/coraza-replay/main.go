@@ -0,0 +1,152 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// coraza-replay runs recorded HTTP traffic, HAR or JSONL files, through the filter and
+// prints the verdict of the WAF for each transaction. With -candidate, the traffic is run
+// through both configurations and the differences of their verdicts are reported.
+//
+//	coraza-replay -config plugin.json [-candidate candidate.json] [-json] [-v] traffic.har [traffic.jsonl...]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/replay"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/transformations"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path of the plugin configuration (required)")
+	candidatePath := flag.String("candidate", "", "path of a candidate plugin configuration to compare with")
+	jsonOutput := flag.Bool("json", false, "print results as JSON lines, or the diff as JSON")
+	verbose := flag.Bool("v", false, "print the logs of the filter to stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -config plugin.json [flags] traffic.har [traffic.jsonl...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(*configPath) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		// The host emulator writes the logs of the filter through the standard logger.
+		log.SetOutput(io.Discard)
+	}
+
+	// Registers the same operators and transformations as the filter.
+	operators.Register()
+	transformations.Register()
+
+	var err error
+	if len(*candidatePath) > 0 {
+		err = diffTraffic(*configPath, *candidatePath, flag.Args(), *jsonOutput, os.Stdout)
+	} else {
+		err = replayTraffic(*configPath, flag.Args(), *jsonOutput, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func replayTraffic(configPath string, paths []string, jsonOutput bool, out io.Writer) error {
+	txs, err := readTraffic(paths)
+	if err != nil {
+		return err
+	}
+	results, err := replayWith(configPath, txs)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for i, res := range results {
+		if jsonOutput {
+			if err := enc.Encode(res); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(out, "#%d\t%s %s\tstatus=%d interrupted=%s score=%d rules=%s\n",
+			i, res.Method, res.URI, res.Status, orNone(res.InterruptionPhase), res.AnomalyScore, joinRuleIDs(res.MatchedRules))
+	}
+	return nil
+}
+
+func diffTraffic(configPath, candidatePath string, paths []string, jsonOutput bool, out io.Writer) error {
+	txs, err := readTraffic(paths)
+	if err != nil {
+		return err
+	}
+	current, err := replayWith(configPath, txs)
+	if err != nil {
+		return err
+	}
+	candidate, err := replayWith(candidatePath, txs)
+	if err != nil {
+		return err
+	}
+
+	diff, err := replay.Compare(current, candidate)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	return diff.WriteText(out)
+}
+
+func readTraffic(paths []string) ([]replay.Transaction, error) {
+	var txs []replay.Transaction
+	for _, path := range paths {
+		t, err := replay.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		txs = append(txs, t...)
+	}
+	return txs, nil
+}
+
+func replayWith(configPath string, txs []replay.Transaction) ([]replay.Result, error) {
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	results, err := replay.Replay(config, txs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the filter with %s, run with -v for details: %v", configPath, err)
+	}
+	return results, nil
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "none"
+	}
+	return s
+}
+
+func joinRuleIDs(ids []int) string {
+	if len(ids) == 0 {
+		return "none"
+	}
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, strconv.Itoa(id))
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,413 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"gopkg.in/yaml.v3"
+)
+
+// ftwDirectives are the directives of ftw/envoy-config.yaml.
+const ftwDirectives = `{
+	"directives_map": {"default": ["Include @recommended-conf", "Include @ftw-conf", "Include @crs-setup-conf", "Include @owasp_crs/*.conf"]},
+	"default_directives": "default"
+}`
+
+var defaultFTWTestsDir = filepath.Join("build", "crs-tests")
+var defaultFTWConfig = filepath.Join("ftw", "ftw.yml")
+
+type ftwConfig struct {
+	TestOverride struct {
+		Ignore map[string]string `yaml:"ignore"`
+	} `yaml:"testoverride"`
+}
+
+type ftwTestFile struct {
+	Meta struct {
+		Enabled *bool  `yaml:"enabled"`
+		Name    string `yaml:"name"`
+	} `yaml:"meta"`
+	Tests []ftwTest `yaml:"tests"`
+}
+
+type ftwTest struct {
+	Title  string `yaml:"test_title"`
+	Stages []struct {
+		Stage ftwStage `yaml:"stage"`
+	} `yaml:"stages"`
+}
+
+type ftwStage struct {
+	Input  ftwInput  `yaml:"input"`
+	Output ftwOutput `yaml:"output"`
+}
+
+type ftwInput struct {
+	Method         string            `yaml:"method"`
+	URI            string            `yaml:"uri"`
+	Headers        map[string]string `yaml:"headers"`
+	Data           ftwData           `yaml:"data"`
+	RawRequest     string            `yaml:"raw_request"`
+	EncodedRequest string            `yaml:"encoded_request"`
+}
+
+type ftwOutput struct {
+	Status           ftwStatus `yaml:"status"`
+	LogContains      string    `yaml:"log_contains"`
+	NoLogContains    string    `yaml:"no_log_contains"`
+	ResponseContains string    `yaml:"response_contains"`
+	ExpectError      bool      `yaml:"expect_error"`
+}
+
+// ftwData is the request body, written either as a string or as a list of lines.
+type ftwData string
+
+func (d *ftwData) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var lines []string
+		if err := node.Decode(&lines); err != nil {
+			return err
+		}
+		*d = ftwData(strings.Join(lines, "\r\n"))
+		return nil
+	}
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	*d = ftwData(s)
+	return nil
+}
+
+// ftwStatus is the expected status, written either as a number or as a list of numbers.
+type ftwStatus []int
+
+func (s *ftwStatus) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var statuses []int
+		if err := node.Decode(&statuses); err != nil {
+			return err
+		}
+		*s = statuses
+		return nil
+	}
+	var status int
+	if err := node.Decode(&status); err != nil {
+		return err
+	}
+	*s = ftwStatus{status}
+	return nil
+}
+
+// TestFTW runs go-ftw test files against the filter running in the proxytest host emulator,
+// with a stub upstream echoing the request, instead of Envoy and httpbin. FTW_TESTS_DIR points
+// to the tests, by default the CRS regression tests downloaded by `mage ftwLocal`, FTW_INCLUDE
+// filters the tests by title and FTW_CONFIG sets the go-ftw configuration holding the ignore list.
+func TestFTW(t *testing.T) {
+	dir := os.Getenv("FTW_TESTS_DIR")
+	if dir == "" {
+		dir = defaultFTWTestsDir
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Skipf("FTW tests not found in %s, run `mage ftwLocal` or set FTW_TESTS_DIR", dir)
+	}
+
+	configPath := os.Getenv("FTW_CONFIG")
+	if configPath == "" {
+		configPath = defaultFTWConfig
+	}
+	ignored, err := loadFTWIgnoreList(configPath)
+	require.NoError(t, err)
+
+	var include *regexp.Regexp
+	if env := os.Getenv("FTW_INCLUDE"); env != "" {
+		include, err = regexp.Compile(env)
+		require.NoError(t, err)
+	}
+
+	runFTW(t, dir, ignored, include)
+}
+
+// TestFTWRunner runs the runner against the tests of testdata/ftw, which are kept offline.
+func TestFTWRunner(t *testing.T) {
+	runFTW(t, filepath.Join("testdata", "ftw"), map[string]string{"example-ignored": "Ignored by the test"}, nil)
+}
+
+func runFTW(t *testing.T, dir string, ignored map[string]string, include *regexp.Regexp) {
+	t.Helper()
+
+	files, err := loadFTWTests(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files, "no FTW tests found in %s", dir)
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(ftwDirectives))
+
+		// A single plugin is shared by all tests, so that the CRS is only compiled once.
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for _, f := range files {
+			if f.Meta.Enabled != nil && !*f.Meta.Enabled {
+				continue
+			}
+			for _, test := range f.Tests {
+				tt := test
+				if include != nil && !include.MatchString(tt.Title) {
+					continue
+				}
+
+				t.Run(tt.Title, func(t *testing.T) {
+					if reason, ok := ignored[tt.Title]; ok {
+						t.Skip(reason)
+					}
+					for i, s := range tt.Stages {
+						runFTWStage(t, host, i, s.Stage)
+					}
+				})
+			}
+		}
+	})
+}
+
+func runFTWStage(t *testing.T, host proxytest.HostEmulator, index int, stage ftwStage) {
+	t.Helper()
+
+	if stage.Output.ExpectError {
+		t.Skip("the emulator can't reject requests before the filter")
+	}
+	req, err := stage.Input.request()
+	if err != nil {
+		t.Skipf("unsupported request in stage %d: %v", index, err)
+	}
+
+	logs := newFTWLogs(host)
+	id := host.InitializeHttpContext()
+	status, body := sendFTWRequest(host, id, req)
+	host.CompleteHttpContext(id)
+	log := logs.since()
+
+	if len(stage.Output.Status) > 0 {
+		require.Contains(t, stage.Output.Status, status, "unexpected status in stage %d", index)
+	}
+	if stage.Output.LogContains != "" {
+		require.Regexp(t, stage.Output.LogContains, log, "log_contains not found in stage %d", index)
+	}
+	if stage.Output.NoLogContains != "" {
+		require.NotRegexp(t, stage.Output.NoLogContains, log, "no_log_contains found in stage %d", index)
+	}
+	if stage.Output.ResponseContains != "" {
+		require.Regexp(t, stage.Output.ResponseContains, body, "response_contains not found in stage %d", index)
+	}
+}
+
+// sendFTWRequest sends the request to the filter followed, unless the filter responded
+// locally, by a stub upstream response echoing the request. It returns the status and the
+// body of the response received by the client.
+func sendFTWRequest(host proxytest.HostEmulator, id uint32, req ftwRequest) (int, string) {
+	localResponse := func() (int, string, bool) {
+		if resp := host.GetSentLocalResponse(id); resp != nil {
+			return int(resp.StatusCode), string(resp.Data), true
+		}
+		return 0, "", false
+	}
+
+	host.CallOnRequestHeaders(id, req.headers, len(req.body) == 0)
+	if status, body, ok := localResponse(); ok {
+		return status, body
+	}
+	if len(req.body) > 0 {
+		host.CallOnRequestBody(id, req.body, true)
+		if status, body, ok := localResponse(); ok {
+			return status, body
+		}
+	}
+
+	echo, _ := json.Marshal(map[string]interface{}{
+		"method":  req.method,
+		"url":     req.uri,
+		"headers": req.headers,
+		"data":    string(req.body),
+	})
+	host.CallOnResponseHeaders(id, [][2]string{
+		{":status", "200"},
+		{"content-type", "application/json"},
+		{"content-length", strconv.Itoa(len(echo))},
+	}, false)
+	if status, body, ok := localResponse(); ok {
+		return status, body
+	}
+	host.CallOnResponseBody(id, echo, true)
+	if status, body, ok := localResponse(); ok {
+		return status, body
+	}
+	return http.StatusOK, string(echo)
+}
+
+type ftwRequest struct {
+	method  string
+	uri     string
+	headers [][2]string
+	body    []byte
+}
+
+// request converts the stage input to the headers and body sent by Envoy: the request line
+// and the Host header become pseudo-headers and header names are lowercased.
+func (in ftwInput) request() (ftwRequest, error) {
+	raw := in.RawRequest
+	if in.EncodedRequest != "" {
+		decoded, err := base64.StdEncoding.DecodeString(in.EncodedRequest)
+		if err != nil {
+			return ftwRequest{}, fmt.Errorf("invalid encoded request: %v", err)
+		}
+		raw = string(decoded)
+	}
+	if raw != "" {
+		return parseFTWRawRequest(raw)
+	}
+
+	req := ftwRequest{method: in.Method, uri: in.URI, body: []byte(in.Data)}
+	if req.method == "" {
+		req.method = http.MethodGet
+	}
+	if req.uri == "" {
+		req.uri = "/"
+	}
+
+	names := make([]string, 0, len(in.Headers))
+	for name := range in.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	authority := "localhost"
+	var headers [][2]string
+	hasContentLength := false
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		switch lower {
+		case "host":
+			authority = in.Headers[name]
+			continue
+		case "content-length":
+			hasContentLength = true
+		}
+		headers = append(headers, [2]string{lower, in.Headers[name]})
+	}
+	// go-ftw completes the headers with the length of the body.
+	if !hasContentLength && len(req.body) > 0 {
+		headers = append(headers, [2]string{"content-length", strconv.Itoa(len(req.body))})
+	}
+
+	req.headers = append([][2]string{
+		{":method", req.method},
+		{":path", req.uri},
+		{":authority", authority},
+	}, headers...)
+	return req, nil
+}
+
+func parseFTWRawRequest(raw string) (ftwRequest, error) {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return ftwRequest{}, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return ftwRequest{}, err
+	}
+
+	in := ftwInput{Method: r.Method, URI: r.RequestURI, Data: ftwData(body), Headers: map[string]string{"Host": r.Host}}
+	for name, values := range r.Header {
+		in.Headers[name] = strings.Join(values, ",")
+	}
+	return in.request()
+}
+
+// ftwLogs collects the logs written by the filter from its creation, as rules are logged
+// with the severity of the rule.
+type ftwLogs struct {
+	host  proxytest.HostEmulator
+	start []int
+}
+
+func (l ftwLogs) levels() [][]string {
+	return [][]string{l.host.GetInfoLogs(), l.host.GetWarnLogs(), l.host.GetErrorLogs(), l.host.GetCriticalLogs()}
+}
+
+func newFTWLogs(host proxytest.HostEmulator) ftwLogs {
+	l := ftwLogs{host: host}
+	for _, logs := range l.levels() {
+		l.start = append(l.start, len(logs))
+	}
+	return l
+}
+
+func (l ftwLogs) since() string {
+	var b bytes.Buffer
+	for i, logs := range l.levels() {
+		for _, log := range logs[l.start[i]:] {
+			b.WriteString(log)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func loadFTWIgnoreList(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config ftwConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("invalid FTW configuration %s: %v", path, err)
+	}
+	return config.TestOverride.Ignore, nil
+}
+
+func loadFTWTests(dir string) ([]ftwTestFile, error) {
+	var files []ftwTestFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var f ftwTestFile
+		if err := yaml.Unmarshal(content, &f); err != nil {
+			return fmt.Errorf("invalid FTW test file %s: %v", path, err)
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,160 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
+)
+
+// Flags of the endOfStream argument of FuzzLifecycle.
+const (
+	// fuzzEmptyRequestEOS ends the request body with a zero-length chunk, as Envoy can do.
+	fuzzEmptyRequestEOS = 1 << iota
+	// fuzzEmptyResponseEOS ends the response body with a zero-length chunk.
+	fuzzEmptyResponseEOS
+	// fuzzIgnoreInterruptions keeps calling the callbacks after an interruption, checking that
+	// the plugin doesn't handle it twice.
+	fuzzIgnoreInterruptions
+	// fuzzRequestHeadersEOS ends the stream with the request headers, sending the body anyway.
+	fuzzRequestHeadersEOS
+)
+
+// fuzzPluginConfiguration maps the authorities r0, r1... to the rules of the lifecycle tests.
+func fuzzPluginConfiguration() string {
+	var directives, authorities []string
+	for i, tt := range lifecycleTests {
+		rules := ""
+		if inlineRules := strings.TrimSpace(tt.inlineRules); inlineRules != "" {
+			rules = fmt.Sprintf(`"%s"`, inlineRules)
+		}
+		directives = append(directives, fmt.Sprintf(`"r%d": [%s]`, i, rules))
+		authorities = append(authorities, fmt.Sprintf(`"r%d": "r%d"`, i, i))
+	}
+	return fmt.Sprintf(`{"directives_map": {%s}, "default_directives": "r0", "per_authority_directives": {%s}}`,
+		strings.Join(directives, ", "), strings.Join(authorities, ", "))
+}
+
+// fuzzHeaders parses headers written one per line as name: value, pseudo-headers included.
+func fuzzHeaders(s string) [][2]string {
+	var headers [][2]string
+	for _, line := range strings.Split(s, "\n") {
+		// Skips the colon of pseudo-headers.
+		i := strings.Index(line[minInt(1, len(line)):], ":")
+		if i < 0 {
+			continue
+		}
+		i += minInt(1, len(line))
+		headers = append(headers, [2]string{strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])})
+	}
+	return headers
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fuzzChunks splits the body in chunks of the sizes of splits, zero-length chunks included, the
+// remaining of the body being the last chunk.
+func fuzzChunks(body, splits []byte) [][]byte {
+	var chunks [][]byte
+	for _, size := range splits {
+		n := minInt(int(size), len(body))
+		chunks = append(chunks, body[:n])
+		body = body[n:]
+	}
+	if len(body) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, body)
+	}
+	return chunks
+}
+
+// FuzzLifecycle runs transactions with random headers, bodies, chunk boundaries and end of
+// stream sequences through the rules of the lifecycle tests, checking that the plugin doesn't
+// panic, e.g. handling an interruption twice. Zero-length chunks and bodies not buffered by the
+// host exercise the bodyReadIndex == bodySize condition of OnHttpRequestBody.
+func FuzzLifecycle(f *testing.F) {
+	reqHdrs := ":path: /hello?name=panda\n:method: GET\nUser-Agent: gotest\nContent-Type: application/x-www-form-urlencoded\nContent-Length: 32"
+	reqBody := []byte(`animal=bear&food=honey&name=pooh`)
+	respHdrs := ":status: 200\nServer: gotest\nContent-Length: 12\nContent-Type: text/plain"
+	respBody := []byte(`Hello, yogi!`)
+	// The lifecycle tests stream bodies in chunks of 5.
+	fives := []byte{5, 5, 5, 5, 5, 5, 5}
+	for i := range lifecycleTests {
+		f.Add(uint8(i), reqHdrs, reqBody, fives, respHdrs, respBody, fives, uint8(0))
+		f.Add(uint8(i), reqHdrs, reqBody, []byte{0, 32, 0}, respHdrs, respBody, []byte{12, 0}, uint8(fuzzEmptyRequestEOS|fuzzEmptyResponseEOS|fuzzIgnoreInterruptions))
+	}
+	f.Add(uint8(0), "", []byte{}, []byte{}, "", []byte{}, []byte{}, uint8(fuzzRequestHeadersEOS))
+
+	opt := proxytest.
+		NewEmulatorOption().
+		WithVMContext(wasmplugin.NewVMContext()).
+		WithPluginConfiguration([]byte(fuzzPluginConfiguration()))
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+	require.Equal(f, types.OnPluginStartStatusOK, host.StartPlugin())
+
+	f.Fuzz(func(t *testing.T, rules uint8, reqHeaders string, reqBody, reqSplits []byte, respHeaders string, respBody, respSplits []byte, endOfStream uint8) {
+		id := host.InitializeHttpContext()
+		defer host.CompleteHttpContext(id)
+
+		authority := fmt.Sprintf("r%d", int(rules)%len(lifecycleTests))
+		headers := [][2]string{{":authority", authority}}
+		for _, h := range fuzzHeaders(reqHeaders) {
+			if h[0] != ":authority" {
+				headers = append(headers, h)
+			}
+		}
+
+		done := func() bool {
+			return endOfStream&fuzzIgnoreInterruptions == 0 && host.GetSentLocalResponse(id) != nil
+		}
+		sendBody := func(call func(uint32, []byte, bool) types.Action, body, splits []byte, emptyEOS bool) {
+			chunks := fuzzChunks(body, splits)
+			for i, chunk := range chunks {
+				eos := i == len(chunks)-1 && !emptyEOS
+				call(id, chunk, eos)
+				if done() {
+					return
+				}
+			}
+			if emptyEOS {
+				call(id, nil, true)
+			}
+		}
+
+		requestHeadersEOS := len(reqBody) == 0 || endOfStream&fuzzRequestHeadersEOS != 0
+		host.CallOnRequestHeaders(id, headers, requestHeadersEOS)
+		if done() {
+			return
+		}
+		if len(reqBody) > 0 {
+			sendBody(host.CallOnRequestBody, reqBody, reqSplits, endOfStream&fuzzEmptyRequestEOS != 0)
+			if done() {
+				return
+			}
+		}
+		host.CallOnResponseHeaders(id, fuzzHeaders(respHeaders), len(respBody) == 0)
+		if done() {
+			return
+		}
+		if len(respBody) > 0 {
+			sendBody(host.CallOnResponseBody, respBody, respSplits, endOfStream&fuzzEmptyResponseEOS != 0)
+		}
+
+		if resp := host.GetSentLocalResponse(id); resp != nil {
+			require.GreaterOrEqual(t, resp.StatusCode, uint32(400))
+		}
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// cidrMatchFromConfig matches addresses against the networks of the CIDR lists named
+// by its arguments, e.g. "@cidrMatchFromConfig internal partners".
+type cidrMatchFromConfig struct {
+	networks []*net.IPNet
+}
+
+var _ plugintypes.Operator = (*cidrMatchFromConfig)(nil)
+
+func newCIDRMatchFromConfig(options plugintypes.OperatorOptions) (plugintypes.Operator, error) {
+	names := strings.Fields(options.Arguments)
+	if len(names) == 0 {
+		return nil, errors.New("missing CIDR list name")
+	}
+
+	var networks []*net.IPNet
+	for _, name := range names {
+		list, ok := config.CIDRLists[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown CIDR list %q", name)
+		}
+		networks = append(networks, list...)
+	}
+	return &cidrMatchFromConfig{networks: networks}, nil
+}
+
+func (o *cidrMatchFromConfig) Evaluate(_ plugintypes.TransactionState, value string) bool {
+	ip := net.ParseIP(strings.Trim(value, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, network := range o.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
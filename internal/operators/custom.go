@@ -0,0 +1,64 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+)
+
+// Config configures the project specific operators. It is set from the plugin
+// configuration before directives are parsed, as operators read it when created.
+type Config struct {
+	// JWTKeys are the keys tokens are verified with by @jwtVerify, keyed by name.
+	JWTKeys map[string]JWTKey
+	// CIDRLists are the networks matched by @cidrMatchFromConfig, keyed by name.
+	CIDRLists map[string][]*net.IPNet
+	// GeoDatabase is the database @geoLookup looks addresses up in.
+	GeoDatabase *GeoDatabase
+}
+
+var config Config
+
+// Configure sets the configuration of the operators created afterwards.
+func Configure(c Config) {
+	config = c
+}
+
+// registerCustom registers the project specific operators, available in every build.
+func registerCustom() {
+	plugins.RegisterOperator("jwtVerify", newJWTVerify)
+	plugins.RegisterOperator("hostnameMatch", newHostnameMatch)
+	plugins.RegisterOperator("cidrMatchFromConfig", newCIDRMatchFromConfig)
+	plugins.RegisterOperator("geoLookup", newGeoLookup)
+}
+
+// ParseCIDRList parses a list of networks, single addresses are accepted as /32 or /128 networks.
+func ParseCIDRList(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,79 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"net"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostnameMatch(t *testing.T) {
+	op, err := newHostnameMatch(plugintypes.OperatorOptions{Arguments: "example.com *.example.org"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{host: "example.com", match: true},
+		{host: "EXAMPLE.com.", match: true},
+		{host: "example.com:8080", match: true},
+		{host: "www.example.com"},
+		{host: "www.example.org", match: true},
+		{host: "a.b.example.org:443", match: true},
+		{host: "example.org"},
+		{host: "badexample.org"},
+		{host: "[::1]:8080"},
+		{host: ""},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.match, op.Evaluate(nil, tt.host), tt.host)
+	}
+
+	for _, arguments := range []string{"", "*", "*.", "www.*.example.com"} {
+		_, err := newHostnameMatch(plugintypes.OperatorOptions{Arguments: arguments})
+		require.Error(t, err, arguments)
+	}
+}
+
+func TestCIDRMatchFromConfig(t *testing.T) {
+	internal, err := ParseCIDRList([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	require.NoError(t, err)
+	partners, err := ParseCIDRList([]string{"203.0.113.0/24"})
+	require.NoError(t, err)
+
+	Configure(Config{CIDRLists: map[string][]*net.IPNet{"internal": internal, "partners": partners}})
+	defer Configure(Config{})
+
+	op, err := newCIDRMatchFromConfig(plugintypes.OperatorOptions{Arguments: "internal partners"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip    string
+		match bool
+	}{
+		{ip: "10.1.2.3", match: true},
+		{ip: "192.168.1.1", match: true},
+		{ip: "192.168.1.2"},
+		{ip: "fd00::1", match: true},
+		{ip: "[fd00::1]", match: true},
+		{ip: "203.0.113.7", match: true},
+		{ip: "1.2.3.4"},
+		{ip: "not an ip"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.match, op.Evaluate(nil, tt.ip), tt.ip)
+	}
+
+	_, err = newCIDRMatchFromConfig(plugintypes.OperatorOptions{Arguments: "missing"})
+	require.Error(t, err)
+
+	_, err = ParseCIDRList([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
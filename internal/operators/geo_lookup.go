@@ -0,0 +1,224 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// GeoDatabase maps networks to their country, continent and ASN. It is parsed from a
+// CSV table with one network per line:
+//
+//	# network,country_code[,continent[,asn]]
+//	1.0.0.0/24,AU,OC,13335
+//	2.16.0.0-2.16.1.255,DE,EU
+//	2001:db8::/32,FR
+//
+// Networks are given as a CIDR, a single address or an inclusive range of addresses
+// and must not overlap.
+type GeoDatabase struct {
+	v4      []geoRange4
+	v6      []geoRange6
+	records []geoRecord
+}
+
+type geoRecord struct {
+	countryCode string
+	continent   string
+	asn         string
+}
+
+type geoRange4 struct {
+	start, end uint32
+	record     int
+}
+
+type geoRange6 struct {
+	start, end [net.IPv6len]byte
+	record     int
+}
+
+// ParseGeoDatabase parses a CSV GeoIP table, see GeoDatabase.
+func ParseGeoDatabase(data []byte) (*GeoDatabase, error) {
+	db := &GeoDatabase{}
+	records := map[geoRecord]int{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected 2 to 4 fields, got %d", n, len(fields))
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		start, end, err := parseGeoNetwork(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		record := geoRecord{countryCode: strings.ToUpper(fields[1])}
+		if len(fields) > 2 {
+			record.continent = strings.ToUpper(fields[2])
+		}
+		if len(fields) > 3 {
+			record.asn = strings.TrimPrefix(strings.ToUpper(fields[3]), "AS")
+		}
+		if len(record.countryCode) == 0 {
+			return nil, fmt.Errorf("line %d: empty country code", n)
+		}
+		id, ok := records[record]
+		if !ok {
+			id = len(db.records)
+			records[record] = id
+			db.records = append(db.records, record)
+		}
+
+		if start4, end4 := start.To4(), end.To4(); start4 != nil && end4 != nil {
+			db.v4 = append(db.v4, geoRange4{start: binary.BigEndian.Uint32(start4), end: binary.BigEndian.Uint32(end4), record: id})
+			continue
+		}
+		r := geoRange6{record: id}
+		copy(r.start[:], start.To16())
+		copy(r.end[:], end.To16())
+		db.v6 = append(db.v6, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.v4, func(i, j int) bool { return db.v4[i].start < db.v4[j].start })
+	for i := 1; i < len(db.v4); i++ {
+		if db.v4[i].start <= db.v4[i-1].end {
+			return nil, fmt.Errorf("overlapping networks starting at %s and %s", uint32ToIP(db.v4[i-1].start), uint32ToIP(db.v4[i].start))
+		}
+	}
+	sort.Slice(db.v6, func(i, j int) bool { return bytes.Compare(db.v6[i].start[:], db.v6[j].start[:]) < 0 })
+	for i := 1; i < len(db.v6); i++ {
+		if bytes.Compare(db.v6[i].start[:], db.v6[i-1].end[:]) <= 0 {
+			return nil, fmt.Errorf("overlapping networks starting at %s and %s", net.IP(db.v6[i-1].start[:]), net.IP(db.v6[i].start[:]))
+		}
+	}
+
+	return db, nil
+}
+
+// parseGeoNetwork returns the first and last addresses of a CIDR, an address or a range.
+func parseGeoNetwork(network string) (net.IP, net.IP, error) {
+	if from, to, ok := strings.Cut(network, "-"); ok {
+		start, end := net.ParseIP(strings.TrimSpace(from)), net.ParseIP(strings.TrimSpace(to))
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, nil, fmt.Errorf("invalid range %q", network)
+		}
+		return start, end, nil
+	}
+
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid address %q", network)
+		}
+		return ip, ip, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		end[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	return ipNet.IP, end, nil
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// Networks returns the number of networks of the database.
+func (db *GeoDatabase) Networks() int {
+	return len(db.v4) + len(db.v6)
+}
+
+func (db *GeoDatabase) lookup(ip net.IP) (geoRecord, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(db.v4), func(i int) bool { return db.v4[i].start > v }) - 1
+		if i < 0 || db.v4[i].end < v {
+			return geoRecord{}, false
+		}
+		return db.records[db.v4[i].record], true
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return geoRecord{}, false
+	}
+	i := sort.Search(len(db.v6), func(i int) bool { return bytes.Compare(db.v6[i].start[:], ip16) > 0 }) - 1
+	if i < 0 || bytes.Compare(db.v6[i].end[:], ip16) < 0 {
+		return geoRecord{}, false
+	}
+	return db.records[db.v6[i].record], true
+}
+
+// geoLookup replaces the Coraza operator, which always matches as it has no database.
+// It looks up the address in the configured GeoIP database and populates the GEO
+// collection with COUNTRY_CODE, and COUNTRY_CONTINENT and ASN when known. As in
+// ModSecurity, it matches when the address is found. Without a database it never
+// matches, warning once, instead of failing to load the rules.
+type geoLookup struct {
+	db          *GeoDatabase
+	noDBWarning sync.Once
+}
+
+var _ plugintypes.Operator = (*geoLookup)(nil)
+
+func newGeoLookup(plugintypes.OperatorOptions) (plugintypes.Operator, error) {
+	return &geoLookup{db: config.GeoDatabase}, nil
+}
+
+func (o *geoLookup) Evaluate(tx plugintypes.TransactionState, value string) bool {
+	if o.db == nil {
+		o.noDBWarning.Do(func() {
+			tx.DebugLogger().Warn().Msg("@geoLookup never matches, no GeoIP database is configured")
+		})
+		return false
+	}
+
+	ip := net.ParseIP(strings.Trim(value, "[]"))
+	if ip == nil {
+		return false
+	}
+	record, ok := o.db.lookup(ip)
+	if !ok {
+		return false
+	}
+
+	geo := tx.Variables().Geo()
+	geo.Set("COUNTRY_CODE", []string{record.countryCode})
+	if len(record.continent) > 0 {
+		geo.Set("COUNTRY_CONTINENT", []string{record.continent})
+	}
+	if len(record.asn) > 0 {
+		geo.Set("ASN", []string{record.asn})
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoDatabase(t *testing.T) {
+	db, err := ParseGeoDatabase([]byte(`
+# network,country_code,continent,asn
+1.0.0.0/24,au,OC,AS13335
+2.16.0.0-2.16.1.255,DE,EU
+8.8.8.8,US,NA,15169
+2001:db8::/32,FR
+`))
+	require.NoError(t, err)
+	require.Equal(t, 4, db.Networks())
+
+	tests := []struct {
+		ip     string
+		found  bool
+		record geoRecord
+	}{
+		{ip: "1.0.0.0", found: true, record: geoRecord{countryCode: "AU", continent: "OC", asn: "13335"}},
+		{ip: "1.0.0.255", found: true, record: geoRecord{countryCode: "AU", continent: "OC", asn: "13335"}},
+		{ip: "1.0.1.0"},
+		{ip: "2.16.1.7", found: true, record: geoRecord{countryCode: "DE", continent: "EU"}},
+		{ip: "8.8.8.8", found: true, record: geoRecord{countryCode: "US", continent: "NA", asn: "15169"}},
+		{ip: "8.8.8.9"},
+		{ip: "0.0.0.1"},
+		{ip: "2001:db8:1::1", found: true, record: geoRecord{countryCode: "FR"}},
+		{ip: "2001:db9::1"},
+		{ip: "::1"},
+	}
+
+	for _, tt := range tests {
+		record, found := db.lookup(net.ParseIP(tt.ip))
+		require.Equal(t, tt.found, found, tt.ip)
+		require.Equal(t, tt.record, record, tt.ip)
+	}
+}
+
+func TestParseGeoDatabaseErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing country":   "1.0.0.0/24",
+		"empty country":     "1.0.0.0/24,",
+		"too many fields":   "1.0.0.0/24,AU,OC,13335,extra",
+		"invalid network":   "1.0.0.0/33,AU",
+		"invalid address":   "1.0.0.256,AU",
+		"invalid range":     "1.0.0.9-1.0.0.1,AU",
+		"mixed range":       "1.0.0.1-::1,AU",
+		"overlapping":       "1.0.0.0/24,AU\n1.0.0.128/25,NZ",
+		"overlapping range": "2001:db8::/32,FR\n2001:db8::1-2001:db9::,DE",
+	}
+
+	for name, data := range tests {
+		_, err := ParseGeoDatabase([]byte(data))
+		require.Error(t, err, name)
+	}
+}
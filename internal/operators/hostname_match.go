@@ -0,0 +1,71 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// hostnameMatch matches hostnames against the space separated patterns of its arguments.
+// A pattern is either a hostname, matched exactly, or "*." followed by a domain, matching
+// its subdomains at any depth but not the domain itself. Matching ignores case, the port
+// and a trailing dot, so that the Host header or :authority can be matched directly.
+type hostnameMatch struct {
+	hosts    map[string]bool
+	suffixes []string
+}
+
+var _ plugintypes.Operator = (*hostnameMatch)(nil)
+
+func newHostnameMatch(options plugintypes.OperatorOptions) (plugintypes.Operator, error) {
+	patterns := strings.Fields(options.Arguments)
+	if len(patterns) == 0 {
+		return nil, errors.New("missing hostname patterns")
+	}
+
+	o := &hostnameMatch{hosts: map[string]bool{}}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		domain := strings.TrimPrefix(pattern, "*.")
+		if len(domain) == 0 || strings.Contains(domain, "*") {
+			return nil, fmt.Errorf("invalid hostname pattern %q", pattern)
+		}
+		if len(domain) < len(pattern) {
+			o.suffixes = append(o.suffixes, "."+domain)
+		} else {
+			o.hosts[domain] = true
+		}
+	}
+	return o, nil
+}
+
+func (o *hostnameMatch) Evaluate(_ plugintypes.TransactionState, value string) bool {
+	host := normalizeHostname(value)
+	if len(host) == 0 {
+		return false
+	}
+	if o.hosts[host] {
+		return true
+	}
+	for _, suffix := range o.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHostname lowercases the host, removing its port and trailing dot.
+func normalizeHostname(value string) string {
+	host := strings.TrimSpace(value)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
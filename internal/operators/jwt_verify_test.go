@@ -0,0 +1,114 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package operators
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func jwtSegment(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func signHS256(secret, header, payload string) string {
+	signed := jwtSegment(header) + "." + jwtSegment(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, header, payload string) string {
+	t.Helper()
+	signed := jwtSegment(header) + "." + jwtSegment(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+
+	hsKey, err := NewJWTKey("HS256", []byte("secret"))
+	require.NoError(t, err)
+	rsKey, err := NewJWTKey("RS256", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}))
+	require.NoError(t, err)
+	pkcs1Key, err := NewJWTKey("RS256", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)}))
+	require.NoError(t, err)
+
+	Configure(Config{JWTKeys: map[string]JWTKey{"hs": hsKey, "rs": rsKey, "pkcs1": pkcs1Key}})
+	defer Configure(Config{})
+
+	const (
+		hsHeader = `{"alg":"HS256","typ":"JWT"}`
+		rsHeader = `{"alg":"RS256","typ":"JWT"}`
+	)
+	now := time.Unix(1700000000, 0)
+
+	valid := strings.Split(signHS256("secret", hsHeader, `{"sub":"user"}`), ".")
+	tampered := valid[0] + "." + jwtSegment(`{"sub":"admin"}`) + "." + valid[2]
+
+	tests := []struct {
+		name  string
+		key   string
+		token string
+		match bool
+	}{
+		{name: "HS256", key: "hs", token: signHS256("secret", hsHeader, `{"sub":"user"}`), match: true},
+		{name: "HS256 bearer", key: "hs", token: "Bearer " + signHS256("secret", hsHeader, `{"sub":"user"}`), match: true},
+		{name: "HS256 wrong secret", key: "hs", token: signHS256("other", hsHeader, `{"sub":"user"}`)},
+		{name: "HS256 tampered payload", key: "hs", token: tampered},
+		{name: "RS256", key: "rs", token: signRS256(t, privateKey, rsHeader, `{"sub":"user"}`), match: true},
+		{name: "RS256 PKCS1 key", key: "pkcs1", token: signRS256(t, privateKey, rsHeader, `{"sub":"user"}`), match: true},
+		{name: "algorithm mismatch", key: "rs", token: signHS256("secret", hsHeader, `{"sub":"user"}`)},
+		{name: "none algorithm", key: "hs", token: jwtSegment(`{"alg":"none"}`) + "." + jwtSegment(`{"sub":"user"}`) + "."},
+		{name: "not expired", key: "hs", token: signHS256("secret", hsHeader, `{"exp":1700000001}`), match: true},
+		{name: "expired", key: "hs", token: signHS256("secret", hsHeader, `{"exp":1700000000}`)},
+		{name: "not valid yet", key: "hs", token: signHS256("secret", hsHeader, `{"nbf":1700000001}`)},
+		{name: "malformed", key: "hs", token: "not.a.token"},
+		{name: "empty", key: "hs", token: ""},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			op, err := newJWTVerify(plugintypes.OperatorOptions{Arguments: tt.key})
+			require.NoError(t, err)
+			op.(*jwtVerify).now = func() time.Time { return now }
+			require.Equal(t, tt.match, op.Evaluate(nil, tt.token))
+		})
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := newJWTVerify(plugintypes.OperatorOptions{Arguments: "missing"})
+		require.Error(t, err)
+	})
+}
+
+func TestNewJWTKey(t *testing.T) {
+	_, err := NewJWTKey("HS512", []byte("secret"))
+	require.Error(t, err)
+
+	_, err = NewJWTKey("HS256", nil)
+	require.Error(t, err)
+
+	_, err = NewJWTKey("RS256", []byte("not a key"))
+	require.Error(t, err)
+}
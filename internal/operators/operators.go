@@ -1,7 +1,7 @@
 // Copyright The OWASP Coraza contributors
 // SPDX-License-Identifier: Apache-2.0
 
-//go:build tinygo
+//go:build tinygo || wasilibs_native
 
 package operators
 
@@ -9,9 +9,13 @@ import (
 	wasilibs "github.com/corazawaf/coraza-wasilibs"
 )
 
+// Register registers the wasilibs implementations of the expensive operators, along
+// with the project specific operators. Go builds use them with the wasilibs_native tag,
+// running them through wazero, so that tests match the behavior of the filter.
 func Register() {
 	wasilibs.RegisterRX()
 	wasilibs.RegisterPM()
 	wasilibs.RegisterSQLi()
 	wasilibs.RegisterXSS()
+	registerCustom()
 }
@@ -1,9 +1,12 @@
 // Copyright The OWASP Coraza contributors
 // SPDX-License-Identifier: Apache-2.0
 
-//go:build !tinygo
+//go:build !tinygo && !wasilibs_native
 
 package operators
 
+// Register registers the project specific operators, the expensive operators keep
+// their Coraza implementations.
 func Register() {
+	registerCustom()
 }
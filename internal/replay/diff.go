@@ -0,0 +1,256 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diff compares the verdicts of two configurations, the current and the candidate one, for
+// the same transactions.
+type Diff struct {
+	Transactions int `json:"transactions"`
+	// NewlyBlocked are the transactions only interrupted with the candidate configuration.
+	NewlyBlocked []Change `json:"newly_blocked"`
+	// NewlyAllowed are the transactions only interrupted with the current configuration.
+	NewlyAllowed []Change `json:"newly_allowed"`
+	// ChangedInterruptions are the transactions interrupted with both configurations, in
+	// different phases or with different statuses.
+	ChangedInterruptions []Change `json:"changed_interruptions"`
+	// ChangedRules are the other transactions whose matched rules differ.
+	ChangedRules []Change `json:"changed_rules"`
+	// Rules aggregates the changes by rule ID, sorted by rule ID.
+	Rules []RuleChanges `json:"rules"`
+	// Paths aggregates the changes by path pattern, sorted by path pattern.
+	Paths []PathChanges `json:"paths"`
+}
+
+// Change is a transaction whose verdict differs between the configurations.
+type Change struct {
+	// Index is the position of the transaction in the replayed traffic, starting at 0.
+	Index     int    `json:"index"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Current   Result `json:"current"`
+	Candidate Result `json:"candidate"`
+	// AddedRules only matched with the candidate configuration.
+	AddedRules []int `json:"added_rules,omitempty"`
+	// RemovedRules only matched with the current configuration.
+	RemovedRules []int `json:"removed_rules,omitempty"`
+}
+
+// RuleChanges counts the transactions a rule started or stopped matching.
+type RuleChanges struct {
+	RuleID  int `json:"rule_id"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// PathChanges counts the changes of the transactions of a path pattern.
+type PathChanges struct {
+	Path                 string `json:"path"`
+	NewlyBlocked         int    `json:"newly_blocked"`
+	NewlyAllowed         int    `json:"newly_allowed"`
+	ChangedInterruptions int    `json:"changed_interruptions"`
+	ChangedRules         int    `json:"changed_rules"`
+}
+
+// Empty returns whether the configurations have the same verdicts.
+func (d Diff) Empty() bool {
+	return len(d.NewlyBlocked) == 0 && len(d.NewlyAllowed) == 0 && len(d.ChangedInterruptions) == 0 && len(d.ChangedRules) == 0
+}
+
+// Compare compares the results of the same transactions replayed with the current and the
+// candidate configurations.
+func Compare(current, candidate []Result) (Diff, error) {
+	if len(current) != len(candidate) {
+		return Diff{}, fmt.Errorf("different number of results: %d and %d", len(current), len(candidate))
+	}
+
+	d := Diff{Transactions: len(current)}
+	rules := map[int]*RuleChanges{}
+	paths := map[string]*PathChanges{}
+	for i := range current {
+		cur, cand := current[i], candidate[i]
+		added, removed := diffRuleIDs(cur.MatchedRules, cand.MatchedRules)
+		changedInterruption := cur.Interrupted() && cand.Interrupted() &&
+			(cur.InterruptionPhase != cand.InterruptionPhase || cur.Status != cand.Status)
+		if cur.Interrupted() == cand.Interrupted() && !changedInterruption && len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		c := Change{
+			Index:        i,
+			Method:       cur.Method,
+			URI:          cur.URI,
+			Current:      cur,
+			Candidate:    cand,
+			AddedRules:   added,
+			RemovedRules: removed,
+		}
+		pattern := pathPattern(cur.URI)
+		p, ok := paths[pattern]
+		if !ok {
+			p = &PathChanges{Path: pattern}
+			paths[pattern] = p
+		}
+		switch {
+		case !cur.Interrupted() && cand.Interrupted():
+			d.NewlyBlocked = append(d.NewlyBlocked, c)
+			p.NewlyBlocked++
+		case cur.Interrupted() && !cand.Interrupted():
+			d.NewlyAllowed = append(d.NewlyAllowed, c)
+			p.NewlyAllowed++
+		case changedInterruption:
+			d.ChangedInterruptions = append(d.ChangedInterruptions, c)
+			p.ChangedInterruptions++
+		default:
+			d.ChangedRules = append(d.ChangedRules, c)
+			p.ChangedRules++
+		}
+
+		for _, id := range added {
+			ruleChanges(rules, id).Added++
+		}
+		for _, id := range removed {
+			ruleChanges(rules, id).Removed++
+		}
+	}
+
+	for _, r := range rules {
+		d.Rules = append(d.Rules, *r)
+	}
+	sort.Slice(d.Rules, func(i, j int) bool { return d.Rules[i].RuleID < d.Rules[j].RuleID })
+	for _, p := range paths {
+		d.Paths = append(d.Paths, *p)
+	}
+	sort.Slice(d.Paths, func(i, j int) bool { return d.Paths[i].Path < d.Paths[j].Path })
+	return d, nil
+}
+
+func ruleChanges(rules map[int]*RuleChanges, id int) *RuleChanges {
+	r, ok := rules[id]
+	if !ok {
+		r = &RuleChanges{RuleID: id}
+		rules[id] = r
+	}
+	return r
+}
+
+// diffRuleIDs returns the IDs only in candidate and the ones only in current, both sorted.
+func diffRuleIDs(current, candidate []int) (added, removed []int) {
+	in := func(ids []int, id int) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, id := range candidate {
+		if !in(current, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range current {
+		if !in(candidate, id) {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+var (
+	uuidSegmentRegex   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegmentRegex    = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numberSegmentRegex = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// pathPattern returns the path of the URI without its query, replacing the segments that look
+// like identifiers so that requests to the same resource are aggregated, e.g.
+// /users/42/orders?page=2 becomes /users/{num}/orders.
+func pathPattern(uri string) string {
+	path := uri
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case numberSegmentRegex.MatchString(s):
+			segments[i] = "{num}"
+		case uuidSegmentRegex.MatchString(s):
+			segments[i] = "{uuid}"
+		case hexSegmentRegex.MatchString(s):
+			segments[i] = "{hex}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// WriteText writes a human-readable report of the diff.
+func (d Diff) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d transactions: %d newly blocked, %d newly allowed, %d with changed interruptions, %d with changed rules\n",
+		d.Transactions, len(d.NewlyBlocked), len(d.NewlyAllowed), len(d.ChangedInterruptions), len(d.ChangedRules))
+
+	sections := []struct {
+		title   string
+		changes []Change
+	}{
+		{"Newly blocked", d.NewlyBlocked},
+		{"Newly allowed", d.NewlyAllowed},
+		{"Changed interruptions", d.ChangedInterruptions},
+		{"Changed rules", d.ChangedRules},
+	}
+	for _, s := range sections {
+		if len(s.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", s.title)
+		for _, c := range s.changes {
+			fmt.Fprintf(&b, "  #%d %s %s status %d -> %d, score %d -> %d", c.Index, c.Method, c.URI,
+				c.Current.Status, c.Candidate.Status, c.Current.AnomalyScore, c.Candidate.AnomalyScore)
+			if c.Current.Interrupted() && c.Candidate.Interrupted() && c.Current.InterruptionPhase != c.Candidate.InterruptionPhase {
+				fmt.Fprintf(&b, ", phase %s -> %s", c.Current.InterruptionPhase, c.Candidate.InterruptionPhase)
+			}
+			if len(c.AddedRules) > 0 {
+				fmt.Fprintf(&b, ", added %s", joinInts(c.AddedRules))
+			}
+			if len(c.RemovedRules) > 0 {
+				fmt.Fprintf(&b, ", removed %s", joinInts(c.RemovedRules))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(d.Rules) > 0 {
+		b.WriteString("\nBy rule:\n")
+		for _, r := range d.Rules {
+			fmt.Fprintf(&b, "  %d\t+%d -%d\n", r.RuleID, r.Added, r.Removed)
+		}
+	}
+	if len(d.Paths) > 0 {
+		b.WriteString("\nBy path:\n")
+		for _, p := range d.Paths {
+			fmt.Fprintf(&b, "  %s\tnewly blocked %d, newly allowed %d, changed interruptions %d, changed rules %d\n",
+				p.Path, p.NewlyBlocked, p.NewlyAllowed, p.ChangedInterruptions, p.ChangedRules)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func joinInts(ids []int) string {
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, fmt.Sprint(id))
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,82 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	current := []Result{
+		{Method: "GET", URI: "/users/42?page=1", Status: 200},
+		{Method: "GET", URI: "/users/7", MatchedRules: []int{942100, 949110}, AnomalyScore: 5, InterruptionPhase: PhaseRequestHeaders, Status: 403},
+		{Method: "POST", URI: "/login", MatchedRules: []int{920350}, AnomalyScore: 3, Status: 200},
+		{Method: "GET", URI: "/", Status: 200},
+		{Method: "POST", URI: "/upload", MatchedRules: []int{200002}, InterruptionPhase: PhaseRequestHeaders, Status: 403},
+		{Method: "GET", URI: "/export", MatchedRules: []int{101}, InterruptionPhase: PhaseResponseBody, Status: 403},
+	}
+	candidate := []Result{
+		{Method: "GET", URI: "/users/42?page=1", MatchedRules: []int{100}, InterruptionPhase: PhaseRequestHeaders, Status: 403},
+		{Method: "GET", URI: "/users/7", Status: 200},
+		{Method: "POST", URI: "/login", MatchedRules: []int{920350, 920360}, AnomalyScore: 3, Status: 200},
+		{Method: "GET", URI: "/", Status: 200},
+		{Method: "POST", URI: "/upload", MatchedRules: []int{200002}, InterruptionPhase: PhaseRequestBody, Status: 403},
+		{Method: "GET", URI: "/export", MatchedRules: []int{101}, InterruptionPhase: PhaseResponseBody, Status: 406},
+	}
+
+	d, err := Compare(current, candidate)
+	require.NoError(t, err)
+	require.False(t, d.Empty())
+	require.Equal(t, 6, d.Transactions)
+	require.Equal(t, []Change{{Index: 0, Method: "GET", URI: "/users/42?page=1", Current: current[0], Candidate: candidate[0], AddedRules: []int{100}}}, d.NewlyBlocked)
+	require.Equal(t, []Change{{Index: 1, Method: "GET", URI: "/users/7", Current: current[1], Candidate: candidate[1], RemovedRules: []int{942100, 949110}}}, d.NewlyAllowed)
+	require.Equal(t, []Change{
+		{Index: 4, Method: "POST", URI: "/upload", Current: current[4], Candidate: candidate[4]},
+		{Index: 5, Method: "GET", URI: "/export", Current: current[5], Candidate: candidate[5]},
+	}, d.ChangedInterruptions)
+	require.Equal(t, []Change{{Index: 2, Method: "POST", URI: "/login", Current: current[2], Candidate: candidate[2], AddedRules: []int{920360}}}, d.ChangedRules)
+	require.Equal(t, []RuleChanges{
+		{RuleID: 100, Added: 1},
+		{RuleID: 920360, Added: 1},
+		{RuleID: 942100, Removed: 1},
+		{RuleID: 949110, Removed: 1},
+	}, d.Rules)
+	require.Equal(t, []PathChanges{
+		{Path: "/export", ChangedInterruptions: 1},
+		{Path: "/login", ChangedRules: 1},
+		{Path: "/upload", ChangedInterruptions: 1},
+		{Path: "/users/{num}", NewlyBlocked: 1, NewlyAllowed: 1},
+	}, d.Paths)
+
+	var b strings.Builder
+	require.NoError(t, d.WriteText(&b))
+	require.Contains(t, b.String(), "6 transactions: 1 newly blocked, 1 newly allowed, 2 with changed interruptions, 1 with changed rules\n")
+	require.Contains(t, b.String(), "  #0 GET /users/42?page=1 status 200 -> 403, score 0 -> 0, added 100\n")
+	require.Contains(t, b.String(), "  #4 POST /upload status 403 -> 403, score 0 -> 0, phase http_request_headers -> http_request_body\n")
+	require.Contains(t, b.String(), "  #5 GET /export status 403 -> 406, score 0 -> 0\n")
+	require.Contains(t, b.String(), "  /users/{num}\tnewly blocked 1, newly allowed 1, changed interruptions 0, changed rules 0\n")
+
+	d, err = Compare(current, current)
+	require.NoError(t, err)
+	require.True(t, d.Empty())
+
+	_, err = Compare(current, candidate[:1])
+	require.Error(t, err)
+}
+
+func TestPathPattern(t *testing.T) {
+	tests := map[string]string{
+		"/":                           "/",
+		"/users/42/orders?page=2":     "/users/{num}/orders",
+		"/files/0123456789abcdef0a#x": "/files/{hex}",
+		"/items/123e4567-e89b-12d3-a456-426614174000": "/items/{uuid}",
+		"/v2/search": "/v2/search",
+	}
+	for uri, expected := range tests {
+		require.Equal(t, expected, pathPattern(uri), uri)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package replay runs recorded HTTP traffic through the filter, in the proxytest host emulator,
+// reporting the verdict of the WAF for each transaction.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
+)
+
+// Interruption phases, named after the filter callback the transaction was interrupted in.
+const (
+	PhaseRequestHeaders  = "http_request_headers"
+	PhaseRequestBody     = "http_request_body"
+	PhaseResponseHeaders = "http_response_headers"
+	PhaseResponseBody    = "http_response_body"
+)
+
+// scoreRuleID is the ID of the rule appended to the directives to log the anomaly score. It
+// is above the ranges reserved to the CRS and to the ModSecurity rules.
+const scoreRuleID = 99999999
+
+var scoreRule = fmt.Sprintf(`SecAction "id:%d,phase:5,pass,log,severity:NOTICE,msg:'coraza-replay anomaly scores `+
+	`%%{tx.blocking_inbound_anomaly_score},%%{tx.inbound_anomaly_score},%%{tx.anomaly_score}'"`, scoreRuleID)
+
+var (
+	ruleIDRegex = regexp.MustCompile(`\[id "(\d+)"\]`)
+	// idActionRegex matches the id action of a rule in directives.
+	idActionRegex = regexp.MustCompile(`\bid\s*:\s*'?(\d+)`)
+	scoreRegex    = regexp.MustCompile(`coraza-replay anomaly scores ([^,\s]*),([^,\s]*),([^,\s\]"]*)`)
+)
+
+// Result is the verdict of the WAF for a transaction.
+type Result struct {
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	// MatchedRules are the sorted IDs of the rules logged for the transaction.
+	MatchedRules []int `json:"matched_rules"`
+	// AnomalyScore is the inbound anomaly score of the CRS.
+	AnomalyScore int `json:"anomaly_score"`
+	// InterruptionPhase is the phase the transaction was interrupted in, empty if it wasn't.
+	InterruptionPhase string `json:"interruption_phase,omitempty"`
+	// Status is the status received by the client: the one of the interruption, the recorded
+	// one or 200 when the transaction has no recorded response.
+	Status int `json:"status"`
+}
+
+// Interrupted returns whether the WAF interrupted the transaction.
+func (r Result) Interrupted() bool {
+	return len(r.InterruptionPhase) > 0
+}
+
+// Replayer runs transactions through a filter started with a plugin configuration. As the host
+// emulator is global, a single Replayer can exist at once and it must be closed after use.
+type Replayer struct {
+	host  proxytest.HostEmulator
+	reset func()
+}
+
+// New starts the filter with the plugin configuration.
+func New(pluginConfig []byte) (*Replayer, error) {
+	config, err := withScoreRule(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := proxytest.
+		NewEmulatorOption().
+		WithVMContext(wasmplugin.NewVMContext()).
+		WithPluginConfiguration(config)
+	host, reset := proxytest.NewHostEmulator(opt)
+	if host.StartPlugin() != types.OnPluginStartStatusOK {
+		reset()
+		return nil, errors.New("failed to start the plugin, see the logs for details")
+	}
+	return &Replayer{host: host, reset: reset}, nil
+}
+
+// Close stops the filter.
+func (r *Replayer) Close() {
+	r.reset()
+}
+
+// Replay runs the transactions through a filter started with the plugin configuration.
+func Replay(pluginConfig []byte, txs []Transaction) ([]Result, error) {
+	r, err := New(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	results := make([]Result, 0, len(txs))
+	for _, tx := range txs {
+		results = append(results, r.Run(tx))
+	}
+	return results, nil
+}
+
+// withScoreRule appends the rule logging the anomaly score to the directives not extending
+// others, evaluated before the extending ones, or to the deprecated rules field when there is no
+// directives_map. It fails when the directives already use the ID of the rule; collisions in
+// included files are reported by Coraza when the directives are parsed.
+func withScoreRule(pluginConfig []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(pluginConfig))
+	d.UseNumber()
+	var config map[string]interface{}
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid plugin configuration: %v", err)
+	}
+
+	if usesRuleID(config["directives_map"], scoreRuleID) || usesRuleID(config["rules"], scoreRuleID) {
+		return nil, fmt.Errorf("rule ID %d is reserved to log the anomaly score", scoreRuleID)
+	}
+
+	directivesMap, _ := config["directives_map"].(map[string]interface{})
+	if len(directivesMap) == 0 {
+		rules, ok := config["rules"].([]interface{})
+		if !ok {
+			return nil, errors.New("invalid plugin configuration: missing directives_map")
+		}
+		config["rules"] = append(rules, scoreRule)
+		return json.Marshal(config)
+	}
+
+	for name, value := range directivesMap {
+		switch v := value.(type) {
+		case []interface{}:
+			directivesMap[name] = append(v, scoreRule)
+		case map[string]interface{}:
+			if _, ok := v["extends"]; ok {
+				continue
+			}
+			directives, _ := v["directives"].([]interface{})
+			v["directives"] = append(directives, scoreRule)
+		}
+	}
+	return json.Marshal(config)
+}
+
+// usesRuleID returns whether a directive of value, walked through its arrays and objects,
+// declares a rule with the id.
+func usesRuleID(value interface{}, id int) bool {
+	switch v := value.(type) {
+	case string:
+		for _, m := range idActionRegex.FindAllStringSubmatch(v, -1) {
+			if m[1] == strconv.Itoa(id) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if usesRuleID(item, id) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if usesRuleID(item, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run replays the transaction. The request is followed by its recorded response, or by an
+// empty 200 response, unless the WAF interrupted it.
+func (r *Replayer) Run(tx Transaction) Result {
+	res := Result{Method: tx.Request.Method, URI: tx.Request.URI}
+	logs := r.newLogs()
+	id := r.host.InitializeHttpContext()
+	res.InterruptionPhase, res.Status = r.send(id, tx)
+	r.host.CompleteHttpContext(id)
+
+	seen := map[int]bool{}
+	for _, log := range logs.since() {
+		if m := scoreRegex.FindStringSubmatch(log); m != nil {
+			res.AnomalyScore = parseScore(m[1:])
+			continue
+		}
+		if m := ruleIDRegex.FindStringSubmatch(log); m != nil {
+			ruleID, _ := strconv.Atoi(m[1])
+			if !seen[ruleID] {
+				seen[ruleID] = true
+				res.MatchedRules = append(res.MatchedRules, ruleID)
+			}
+		}
+	}
+	sort.Ints(res.MatchedRules)
+	return res
+}
+
+func (r *Replayer) send(id uint32, tx Transaction) (string, int) {
+	interrupted := func(phase string) (string, int, bool) {
+		if resp := r.host.GetSentLocalResponse(id); resp != nil {
+			return phase, int(resp.StatusCode), true
+		}
+		return "", 0, false
+	}
+
+	req := tx.Request
+	r.host.CallOnRequestHeaders(id, requestHeaders(req), len(req.Body) == 0)
+	if phase, status, ok := interrupted(PhaseRequestHeaders); ok {
+		return phase, status
+	}
+	if len(req.Body) > 0 {
+		r.host.CallOnRequestBody(id, []byte(req.Body), true)
+		if phase, status, ok := interrupted(PhaseRequestBody); ok {
+			return phase, status
+		}
+	}
+
+	resp := tx.Response
+	if resp == nil {
+		resp = &Response{Status: 200}
+	}
+	headers := [][2]string{{":status", strconv.Itoa(resp.Status)}}
+	for _, h := range resp.Headers {
+		headers = append(headers, [2]string{strings.ToLower(h[0]), h[1]})
+	}
+	r.host.CallOnResponseHeaders(id, headers, len(resp.Body) == 0)
+	if phase, status, ok := interrupted(PhaseResponseHeaders); ok {
+		return phase, status
+	}
+	if len(resp.Body) > 0 {
+		r.host.CallOnResponseBody(id, []byte(resp.Body), true)
+		// Response bodies can't be denied anymore, the filter replaces them instead.
+		if body := r.host.GetCurrentResponseBody(id); !bytes.Equal(body, []byte(resp.Body)) {
+			return PhaseResponseBody, resp.Status
+		}
+	}
+	return "", resp.Status
+}
+
+// requestHeaders converts the request to the headers sent by Envoy: the request line and the
+// Host header become pseudo-headers and header names are lowercased. Requests without a Host
+// header are sent to localhost.
+func requestHeaders(req Request) [][2]string {
+	authority := "localhost"
+	var headers [][2]string
+	for _, h := range req.Headers {
+		name := strings.ToLower(h[0])
+		if name == "host" {
+			authority = h[1]
+			continue
+		}
+		headers = append(headers, [2]string{name, h[1]})
+	}
+	return append([][2]string{
+		{":method", req.Method},
+		{":path", req.URI},
+		{":authority", authority},
+	}, headers...)
+}
+
+// parseScore returns the first score set among the CRS variables, from the most to the least
+// recent CRS versions, skipping the ones not set.
+func parseScore(scores []string) int {
+	for _, s := range scores {
+		if score, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			return score
+		}
+	}
+	return 0
+}
+
+// logs collects the logs written by the filter, as rules are logged with their severity.
+type logs struct {
+	host  proxytest.HostEmulator
+	start []int
+}
+
+func (r *Replayer) newLogs() logs {
+	l := logs{host: r.host}
+	for _, level := range l.levels() {
+		l.start = append(l.start, len(level))
+	}
+	return l
+}
+
+func (l logs) levels() [][]string {
+	return [][]string{l.host.GetInfoLogs(), l.host.GetWarnLogs(), l.host.GetErrorLogs(), l.host.GetCriticalLogs()}
+}
+
+// since returns the logs written since the collection started.
+func (l logs) since() []string {
+	var lines []string
+	for i, level := range l.levels() {
+		lines = append(lines, level[l.start[i]:]...)
+	}
+	return lines
+}
@@ -0,0 +1,110 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	config := []byte(`{
+		"directives_map": {
+			"base": [
+				"SecRuleEngine On",
+				"SecRequestBodyAccess On",
+				"SecResponseBodyAccess On",
+				"SecResponseBodyMimeType text/plain",
+				"SecAction \"id:1,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=0\"",
+				"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,deny,log,msg:'admin'\"",
+				"SecRule ARGS:q \"@contains attack\" \"id:102,phase:2,pass,log,msg:'attack',setvar:tx.blocking_inbound_anomaly_score=+5\"",
+				"SecRule ARGS_POST:comment \"@contains blocked\" \"id:103,phase:2,deny,status:406,log,msg:'body'\"",
+				"SecRule RESPONSE_BODY \"@contains secret\" \"id:104,phase:4,deny,log,msg:'leak'\""
+			],
+			"default": {"extends": "base", "directives": []}
+		},
+		"default_directives": "default"
+	}`)
+
+	r, err := New(config)
+	require.NoError(t, err)
+	defer r.Close()
+
+	tests := []struct {
+		name     string
+		tx       Transaction
+		expected Result
+	}{
+		{
+			name:     "allowed",
+			tx:       Transaction{Request: Request{Method: "GET", URI: "/hello", Headers: [][2]string{{"Host", "localhost"}}}},
+			expected: Result{Method: "GET", URI: "/hello", Status: 200},
+		},
+		{
+			name:     "request headers",
+			tx:       Transaction{Request: Request{Method: "GET", URI: "/admin"}},
+			expected: Result{Method: "GET", URI: "/admin", MatchedRules: []int{101}, InterruptionPhase: PhaseRequestHeaders, Status: 403},
+		},
+		{
+			name: "detection with anomaly score",
+			tx: Transaction{
+				Request:  Request{Method: "GET", URI: "/search?q=attack"},
+				Response: &Response{Status: 404, Headers: [][2]string{{"Content-Type", "text/plain"}}, Body: "not found"},
+			},
+			expected: Result{Method: "GET", URI: "/search?q=attack", MatchedRules: []int{102}, AnomalyScore: 5, Status: 404},
+		},
+		{
+			name: "request body",
+			tx: Transaction{Request: Request{
+				Method:  "POST",
+				URI:     "/form",
+				Headers: [][2]string{{"Content-Type", "application/x-www-form-urlencoded"}, {"Content-Length", "15"}},
+				Body:    "comment=blocked",
+			}},
+			expected: Result{Method: "POST", URI: "/form", MatchedRules: []int{103}, InterruptionPhase: PhaseRequestBody, Status: 406},
+		},
+		{
+			name: "response body",
+			tx: Transaction{
+				Request:  Request{Method: "GET", URI: "/data"},
+				Response: &Response{Status: 200, Headers: [][2]string{{"Content-Type", "text/plain"}, {"Content-Length", "6"}}, Body: "secret"},
+			},
+			expected: Result{Method: "GET", URI: "/data", MatchedRules: []int{104}, InterruptionPhase: PhaseResponseBody, Status: 200},
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, r.Run(tt.tx))
+		})
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New([]byte(`{`))
+	require.Error(t, err)
+
+	_, err = New([]byte(`{}`))
+	require.Error(t, err)
+
+	_, err = New([]byte(`{"directives_map": {"default": ["SecAction \"id: 99999999,phase:1,pass\""]}, "default_directives": "default"}`))
+	require.ErrorContains(t, err, "rule ID 99999999 is reserved")
+
+	_, err = New([]byte(`{"directives_map": {"default": ["SecRule"]}, "default_directives": "default"}`))
+	require.Error(t, err)
+}
+
+func TestRunDeprecatedRules(t *testing.T) {
+	r, err := New([]byte(`{"rules": [
+		"SecRuleEngine On",
+		"SecRule ARGS:q \"@contains attack\" \"id:102,phase:2,pass,log,msg:'attack',setvar:tx.blocking_inbound_anomaly_score=+5\""
+	]}`))
+	require.NoError(t, err)
+	defer r.Close()
+
+	res := r.Run(Transaction{Request: Request{Method: "GET", URI: "/search?q=attack"}})
+	require.Equal(t, Result{Method: "GET", URI: "/search?q=attack", MatchedRules: []int{102}, AnomalyScore: 5, Status: 200}, res)
+}
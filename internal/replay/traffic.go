@@ -0,0 +1,182 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Transaction is a recorded request along with its response, if any.
+type Transaction struct {
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+}
+
+// Request is a recorded HTTP request. The authority is taken from the Host header, defaulting
+// to localhost.
+type Request struct {
+	Method  string      `json:"method"`
+	URI     string      `json:"uri"`
+	Headers [][2]string `json:"headers"`
+	Body    string      `json:"body,omitempty"`
+}
+
+// Response is a recorded HTTP response.
+type Response struct {
+	Status  int         `json:"status"`
+	Headers [][2]string `json:"headers"`
+	Body    string      `json:"body,omitempty"`
+}
+
+// ReadFile reads the transactions of a HAR file, when its extension is .har, or of a JSONL file.
+func ReadFile(path string) ([]Transaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		return ReadHAR(f)
+	}
+	return ReadJSONL(f)
+}
+
+// ReadJSONL reads transactions written one per line, e.g.
+// {"request": {"method": "GET", "uri": "/", "headers": [["host", "example.com"]]}, "response": {"status": 200}}.
+// Empty lines are skipped.
+func ReadJSONL(r io.Reader) ([]Transaction, error) {
+	var txs []Transaction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var tx Transaction
+		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
+			return nil, fmt.Errorf("invalid transaction at line %d: %v", line, err)
+		}
+		if err := tx.Request.validate(); err != nil {
+			return nil, fmt.Errorf("invalid transaction at line %d: %v", line, err)
+		}
+		txs = append(txs, tx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (r Request) validate() error {
+	if len(r.Method) == 0 {
+		return errors.New("missing request method")
+	}
+	if len(r.URI) == 0 {
+		return errors.New("missing request URI")
+	}
+	return nil
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string      `json:"method"`
+				URL      string      `json:"url"`
+				Headers  []harHeader `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int         `json:"status"`
+				Headers []harHeader `json:"headers"`
+				Content struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ReadHAR reads the transactions of a HAR (HTTP Archive) file. Entries without a response,
+// i.e. with a status 0, only replay the request.
+func ReadHAR(r io.Reader) ([]Transaction, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("invalid HAR file: %v", err)
+	}
+
+	txs := make([]Transaction, 0, len(har.Log.Entries))
+	for i, e := range har.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL of entry %d: %v", i, err)
+		}
+
+		tx := Transaction{Request: Request{Method: e.Request.Method, URI: u.RequestURI()}}
+		hasHost := false
+		for _, h := range e.Request.Headers {
+			switch strings.ToLower(h.Name) {
+			case ":authority":
+				// HTTP/2 entries record the authority as a pseudo-header.
+				tx.Request.Headers = append(tx.Request.Headers, [2]string{"host", h.Value})
+				hasHost = true
+				continue
+			case "host":
+				hasHost = true
+			}
+			if strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			tx.Request.Headers = append(tx.Request.Headers, [2]string{h.Name, h.Value})
+		}
+		if !hasHost && len(u.Host) > 0 {
+			tx.Request.Headers = append(tx.Request.Headers, [2]string{"host", u.Host})
+		}
+		if e.Request.PostData != nil {
+			tx.Request.Body = e.Request.PostData.Text
+		}
+		if err := tx.Request.validate(); err != nil {
+			return nil, fmt.Errorf("invalid entry %d: %v", i, err)
+		}
+
+		if e.Response.Status > 0 {
+			resp := &Response{Status: e.Response.Status, Body: e.Response.Content.Text}
+			for _, h := range e.Response.Headers {
+				if !strings.HasPrefix(h.Name, ":") {
+					resp.Headers = append(resp.Headers, [2]string{h.Name, h.Value})
+				}
+			}
+			if e.Response.Content.Encoding == "base64" {
+				body, err := base64.StdEncoding.DecodeString(resp.Body)
+				if err != nil {
+					return nil, fmt.Errorf("invalid response content of entry %d: %v", i, err)
+				}
+				resp.Body = string(body)
+			}
+			tx.Response = resp
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
@@ -0,0 +1,58 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFile(t *testing.T) {
+	expected := []Transaction{
+		{
+			Request: Request{Method: "GET", URI: "/search?q=panda", Headers: [][2]string{{"host", "example.com"}, {"user-agent", "test"}}},
+			Response: &Response{
+				Status:  200,
+				Headers: [][2]string{{"Content-Type", "text/plain"}},
+				Body:    "hello",
+			},
+		},
+		{
+			Request: Request{
+				Method:  "POST",
+				URI:     "/login",
+				Headers: [][2]string{{"Content-Type", "application/x-www-form-urlencoded"}, {"host", "localhost:8080"}},
+				Body:    "user=panda",
+			},
+		},
+	}
+
+	txs, err := ReadFile(filepath.Join("testdata", "traffic.har"))
+	require.NoError(t, err)
+	require.Equal(t, expected, txs)
+
+	// JSONL headers are kept as recorded.
+	expected[0].Request.Headers = [][2]string{{"Host", "example.com"}, {"User-Agent", "test"}}
+	expected[1].Request.Headers = [][2]string{{"Host", "localhost:8080"}, {"Content-Type", "application/x-www-form-urlencoded"}}
+	txs, err = ReadFile(filepath.Join("testdata", "traffic.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, expected, txs)
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := ReadJSONL(strings.NewReader(`{"request": {"method": "GET", "uri": "/"}}` + "\n{"))
+	require.EqualError(t, err, "invalid transaction at line 2: unexpected end of JSON input")
+
+	_, err = ReadJSONL(strings.NewReader(`{"request": {"uri": "/"}}`))
+	require.EqualError(t, err, "invalid transaction at line 1: missing request method")
+
+	_, err = ReadHAR(strings.NewReader(`{"log": {"entries": [{"request": {"url": "http://localhost/"}}]}}`))
+	require.EqualError(t, err, "invalid entry 0: missing request method")
+
+	_, err = ReadHAR(strings.NewReader(`[]`))
+	require.Error(t, err)
+}
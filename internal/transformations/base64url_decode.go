@@ -0,0 +1,18 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package transformations
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// base64URLDecode decodes base64url (RFC 4648 section 5) data, with or without padding.
+func base64URLDecode(data string) (string, error) {
+	res, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil {
+		return data, err
+	}
+	return string(res), nil
+}
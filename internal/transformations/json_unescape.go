@@ -0,0 +1,92 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package transformations
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// jsonUnescape decodes the escape sequences of JSON strings (RFC 8259 section 7), including
+// \uXXXX sequences and their surrogate pairs. Invalid sequences are kept as is.
+func jsonUnescape(data string) (string, error) {
+	i := strings.IndexByte(data, '\\')
+	if i < 0 {
+		return data, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(data))
+	b.WriteString(data[:i])
+	for i < len(data) {
+		c := data[i]
+		if c != '\\' || i+1 == len(data) {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+
+		switch data[i+1] {
+		case '"', '\\', '/':
+			b.WriteByte(data[i+1])
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, n := decodeJSONRune(data[i:])
+			if n == 0 {
+				b.WriteString(data[i : i+2])
+				i += 2
+				continue
+			}
+			b.WriteRune(r)
+			i += n
+			continue
+		default:
+			b.WriteString(data[i : i+2])
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// decodeJSONRune decodes the \uXXXX sequence at the start of s, along with the low surrogate
+// following a high one. It returns the number of bytes consumed, 0 if the sequence is invalid.
+func decodeJSONRune(s string) (rune, int) {
+	r, ok := parseJSONHex(s)
+	if !ok {
+		return 0, 0
+	}
+	if utf16.IsSurrogate(r) {
+		if low, ok := parseJSONHex(s[6:]); ok {
+			if dec := utf16.DecodeRune(r, low); dec != utf8.RuneError {
+				return dec, 12
+			}
+		}
+		// Lone surrogates can not be encoded in UTF-8.
+		return utf8.RuneError, 6
+	}
+	return r, 6
+}
+
+// parseJSONHex parses a \uXXXX sequence at the start of s.
+func parseJSONHex(s string) (rune, bool) {
+	if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[2:6], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(v), true
+}
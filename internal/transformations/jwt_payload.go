@@ -0,0 +1,31 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package transformations
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+// jwtPayload decodes the payload of a JSON Web Token, its middle segment, without verifying
+// the signature. The token may be prefixed with "Bearer ", so that the Authorization header
+// can be transformed directly.
+func jwtPayload(data string) (string, error) {
+	token := strings.TrimSpace(data)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return data, errInvalidJWT
+	}
+	payload, err := base64URLDecode(parts[1])
+	if err != nil {
+		return data, err
+	}
+	return payload, nil
+}
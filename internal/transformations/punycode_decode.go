@@ -0,0 +1,136 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package transformations
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Punycode parameters, see RFC 3492 section 5.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+	punycodePrefix      = "xn--"
+)
+
+var errInvalidPunycode = errors.New("invalid punycode")
+
+// punycodeDecode decodes the internationalized labels of a domain name, the ones prefixed
+// with "xn--", e.g. "xn--bcher-kva.example" is decoded to "bücher.example". Other labels
+// are kept as is.
+func punycodeDecode(data string) (string, error) {
+	if !strings.Contains(strings.ToLower(data), punycodePrefix) {
+		return data, nil
+	}
+
+	labels := strings.Split(data, ".")
+	for i, label := range labels {
+		if len(label) < len(punycodePrefix) || !strings.EqualFold(label[:len(punycodePrefix)], punycodePrefix) {
+			continue
+		}
+		decoded, err := decodePunycode(label[len(punycodePrefix):])
+		if err != nil {
+			return data, err
+		}
+		labels[i] = decoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// decodePunycode implements the decoding procedure of RFC 3492 section 6.2.
+func decodePunycode(s string) (string, error) {
+	var output []rune
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for _, r := range s[:i] {
+			if r >= 0x80 {
+				return "", errInvalidPunycode
+			}
+			output = append(output, r)
+		}
+		s = s[i+1:]
+	}
+
+	n, bias, i := punycodeInitialN, punycodeInitialBias, 0
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := punycodeBase; ; k += punycodeBase {
+			if pos == len(s) {
+				return "", errInvalidPunycode
+			}
+			digit, ok := punycodeDigit(s[pos])
+			pos++
+			if !ok || digit > (math.MaxInt32-i)/w {
+				return "", errInvalidPunycode
+			}
+			i += digit * w
+
+			t := k - bias
+			if t < punycodeTMin {
+				t = punycodeTMin
+			} else if t > punycodeTMax {
+				t = punycodeTMax
+			}
+			if digit < t {
+				break
+			}
+			if w > math.MaxInt32/(punycodeBase-t) {
+				return "", errInvalidPunycode
+			}
+			w *= punycodeBase - t
+		}
+
+		length := len(output) + 1
+		bias = punycodeAdapt(i-oldi, length, oldi == 0)
+		if i/length > math.MaxInt32-n {
+			return "", errInvalidPunycode
+		}
+		n += i / length
+		i %= length
+		if n > 0x10FFFF || (n >= 0xD800 && n <= 0xDFFF) {
+			return "", errInvalidPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
+
+func punycodeDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
+
+// punycodeAdapt is the bias adaptation function of RFC 3492 section 6.1.
+func punycodeAdapt(delta, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
@@ -0,0 +1,16 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package transformations
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+)
+
+// Register registers the project specific transformations, available in every build.
+func Register() {
+	plugins.RegisterTransformation("base64UrlDecode", base64URLDecode)
+	plugins.RegisterTransformation("jsonUnescape", jsonUnescape)
+	plugins.RegisterTransformation("jwtPayload", jwtPayload)
+	plugins.RegisterTransformation("punycodeDecode", punycodeDecode)
+}
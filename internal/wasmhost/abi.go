@@ -0,0 +1,657 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmhost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Statuses returned by the host functions.
+const (
+	statusOK            = 0
+	statusNotFound      = 1
+	statusBadArgument   = 2
+	statusEmpty         = 7
+	statusCasMismatch   = 8
+	statusUnimplemented = 12
+)
+
+type logLevel uint32
+
+const (
+	logLevelTrace logLevel = iota
+	logLevelDebug
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+	logLevelCritical
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case logLevelTrace:
+		return "trace"
+	case logLevelDebug:
+		return "debug"
+	case logLevelInfo:
+		return "info"
+	case logLevelWarn:
+		return "warn"
+	case logLevelError:
+		return "error"
+	case logLevelCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("level(%d)", uint32(l))
+}
+
+// Header map types.
+const (
+	mapTypeHttpRequestHeaders   = 0
+	mapTypeHttpRequestTrailers  = 1
+	mapTypeHttpResponseHeaders  = 2
+	mapTypeHttpResponseTrailers = 3
+)
+
+// Buffer types.
+const (
+	bufferTypeHttpRequestBody     = 0
+	bufferTypeHttpResponseBody    = 1
+	bufferTypeVMConfiguration     = 6
+	bufferTypePluginConfiguration = 7
+)
+
+var (
+	i32 = api.ValueTypeI32
+	i64 = api.ValueTypeI64
+)
+
+type hostFunction struct {
+	params []api.ValueType
+	fn     func(ctx context.Context, mod api.Module, stack []uint64) uint32
+}
+
+// instantiateABI instantiates the env module with the host functions imported by the module.
+func (h *Host) instantiateABI(compiled wazero.CompiledModule) error {
+	functions := h.hostFunctions()
+	builder := h.runtime.NewHostModuleBuilder("env")
+	for _, def := range compiled.ImportedFunctions() {
+		module, name, _ := def.Import()
+		if module != "env" {
+			continue
+		}
+
+		f, ok := functions[name]
+		if !ok {
+			h.stub(builder, name, def)
+			continue
+		}
+		results := []api.ValueType{i32}
+		if !equalTypes(def.ParamTypes(), f.params) || !equalTypes(def.ResultTypes(), results) {
+			return fmt.Errorf("import %q has signature %s -> %s, want %s -> %s", name,
+				typeNames(def.ParamTypes()), typeNames(def.ResultTypes()),
+				typeNames(f.params), typeNames(results))
+		}
+		fn := f.fn
+		builder.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+				stack[0] = uint64(fn(ctx, mod, stack))
+			}), f.params, results).
+			Export(name)
+	}
+	_, err := builder.Instantiate(h.ctx)
+	return err
+}
+
+// stub implements an import unknown to the host, returning zeros.
+func (h *Host) stub(builder wazero.HostModuleBuilder, name string, def api.FunctionDefinition) {
+	results := def.ResultTypes()
+	builder.NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			h.unimplemented[name]++
+			for i := range results {
+				stack[i] = 0
+			}
+		}), def.ParamTypes(), results).
+		Export(name)
+}
+
+func equalTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func typeNames(types []api.ValueType) string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, api.ValueTypeName(t))
+	}
+	return "(" + strings.Join(names, ",") + ")"
+}
+
+// hostFunctions returns the proxy-wasm host functions, by import name, as implemented by the
+// version of the ABI used by the SDK.
+func (h *Host) hostFunctions() map[string]hostFunction {
+	return map[string]hostFunction{
+		"proxy_log": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				level := logLevel(stack[0])
+				msg := string(read(mod, stack[1], stack[2]))
+				h.logs[level] = append(h.logs[level], msg)
+				if h.config.LogWriter != nil {
+					fmt.Fprintf(h.config.LogWriter, "proxy_%s_log: %s\n", level, msg)
+				}
+				return statusOK
+			},
+		},
+		"proxy_send_local_response": {
+			params: []api.ValueType{i32, i32, i32, i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				s := h.current()
+				if s == nil {
+					return statusBadArgument
+				}
+				s.localResponse = &proxytest.LocalHttpResponse{
+					StatusCode:       uint32(stack[0]),
+					StatusCodeDetail: string(read(mod, stack[1], stack[2])),
+					Data:             read(mod, stack[3], stack[4]),
+					Headers:          deserializeMap(read(mod, stack[5], stack[6])),
+					GRPCStatus:       int32(stack[7]),
+				}
+				return statusOK
+			},
+		},
+		"proxy_get_shared_data": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				e, ok := h.sharedData[string(read(mod, stack[0], stack[1]))]
+				if !ok {
+					return statusNotFound
+				}
+				mod.Memory().WriteUint32Le(uint32(stack[4]), e.cas)
+				return h.returnBytes(ctx, mod, e.value, stack[2], stack[3])
+			},
+		},
+		"proxy_set_shared_data": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				key := string(read(mod, stack[0], stack[1]))
+				e := h.sharedData[key]
+				if cas := uint32(stack[4]); cas != 0 && cas != e.cas {
+					return statusCasMismatch
+				}
+				h.sharedData[key] = sharedDataEntry{value: read(mod, stack[2], stack[3]), cas: e.cas + 1}
+				return statusOK
+			},
+		},
+		"proxy_register_shared_queue": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				name := string(read(mod, stack[0], stack[1]))
+				id, ok := h.queues[name]
+				if !ok {
+					id = uint32(len(h.queues) + 1)
+					h.queues[name] = id
+				}
+				mod.Memory().WriteUint32Le(uint32(stack[2]), id)
+				return statusOK
+			},
+		},
+		"proxy_resolve_shared_queue": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				id, ok := h.queues[string(read(mod, stack[2], stack[3]))]
+				if !ok {
+					return statusNotFound
+				}
+				mod.Memory().WriteUint32Le(uint32(stack[4]), id)
+				return statusOK
+			},
+		},
+		"proxy_dequeue_shared_queue": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				id := uint32(stack[0])
+				if !h.hasQueue(id) {
+					return statusNotFound
+				}
+				q := h.queueData[id]
+				if len(q) == 0 {
+					return statusEmpty
+				}
+				h.queueData[id] = q[1:]
+				return h.returnBytes(ctx, mod, q[0], stack[1], stack[2])
+			},
+		},
+		"proxy_enqueue_shared_queue": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				id := uint32(stack[0])
+				if !h.hasQueue(id) {
+					return statusNotFound
+				}
+				h.queueData[id] = append(h.queueData[id], read(mod, stack[1], stack[2]))
+				return statusOK
+			},
+		},
+		"proxy_get_header_map_value": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				key := string(read(mod, stack[1], stack[2]))
+				for _, kv := range *m {
+					if strings.EqualFold(kv[0], key) {
+						return h.returnBytes(ctx, mod, []byte(kv[1]), stack[3], stack[4])
+					}
+				}
+				return statusNotFound
+			},
+		},
+		"proxy_add_header_map_value": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				*m = append(*m, [2]string{string(read(mod, stack[1], stack[2])), string(read(mod, stack[3], stack[4]))})
+				return statusOK
+			},
+		},
+		"proxy_replace_header_map_value": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				key, value := string(read(mod, stack[1], stack[2])), string(read(mod, stack[3], stack[4]))
+				*m = append(removeHeader(*m, key), [2]string{key, value})
+				return statusOK
+			},
+		},
+		"proxy_remove_header_map_value": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				*m = removeHeader(*m, string(read(mod, stack[1], stack[2])))
+				return statusOK
+			},
+		},
+		"proxy_get_header_map_pairs": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				return h.returnBytes(ctx, mod, serializeMap(*m), stack[1], stack[2])
+			},
+		},
+		"proxy_set_header_map_pairs": {
+			params: []api.ValueType{i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m := h.headerMap(stack[0])
+				if m == nil {
+					return statusBadArgument
+				}
+				*m = deserializeMap(read(mod, stack[1], stack[2]))
+				return statusOK
+			},
+		},
+		"proxy_get_buffer_bytes": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				var buf []byte
+				switch stack[0] {
+				case bufferTypeHttpRequestBody, bufferTypeHttpResponseBody:
+					b := h.body(stack[0])
+					if b == nil {
+						return statusBadArgument
+					}
+					buf = *b
+				case bufferTypeVMConfiguration:
+					buf = h.config.VMConfiguration
+				case bufferTypePluginConfiguration:
+					buf = h.config.PluginConfiguration
+				default:
+					return statusBadArgument
+				}
+
+				start, maxSize := int(uint32(stack[1])), int(uint32(stack[2]))
+				if len(buf) == 0 {
+					return statusNotFound
+				}
+				if start >= len(buf) {
+					return statusBadArgument
+				}
+				end := len(buf)
+				if maxSize < end-start {
+					end = start + maxSize
+				}
+				return h.returnBytes(ctx, mod, buf[start:end], stack[3], stack[4])
+			},
+		},
+		"proxy_set_buffer_bytes": {
+			params: []api.ValueType{i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				b := h.body(stack[0])
+				if b == nil {
+					return statusBadArgument
+				}
+				start, maxSize := int(uint32(stack[1])), int(uint32(stack[2]))
+				data := read(mod, stack[3], stack[4])
+				switch {
+				case start == 0 && maxSize == 0:
+					*b = append(data, *b...)
+				case start == 0 && maxSize >= len(*b):
+					*b = data
+				case start >= len(*b):
+					*b = append(*b, data...)
+				default:
+					return statusBadArgument
+				}
+				return statusOK
+			},
+		},
+		"proxy_continue_stream": {
+			params: []api.ValueType{i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				return statusOK
+			},
+		},
+		"proxy_close_stream": {
+			params: []api.ValueType{i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				return statusOK
+			},
+		},
+		"proxy_http_call": {
+			params: []api.ValueType{i32, i32, i32, i32, i32, i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				// Callouts are recorded but never answered.
+				id := uint32(len(h.callouts) + 1)
+				h.callouts[id] = &callout{
+					upstream: string(read(mod, stack[0], stack[1])),
+					headers:  deserializeMap(read(mod, stack[2], stack[3])),
+					body:     read(mod, stack[4], stack[5]),
+				}
+				mod.Memory().WriteUint32Le(uint32(stack[9]), id)
+				return statusOK
+			},
+		},
+		"proxy_call_foreign_function": {
+			params: []api.ValueType{i32, i32, i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				h.unimplemented["proxy_call_foreign_function"]++
+				return statusUnimplemented
+			},
+		},
+		"proxy_set_tick_period_milliseconds": {
+			params: []api.ValueType{i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				h.tickPeriod = uint32(stack[0])
+				return statusOK
+			},
+		},
+		"proxy_set_effective_context": {
+			params: []api.ValueType{i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				id := uint32(stack[0])
+				if _, ok := h.streams[id]; !ok && id != rootContextID {
+					return statusBadArgument
+				}
+				h.effectiveContext = id
+				return statusOK
+			},
+		},
+		"proxy_done": {
+			params: []api.ValueType{},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				return statusOK
+			},
+		},
+		"proxy_define_metric": {
+			params: []api.ValueType{i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				name := string(read(mod, stack[1], stack[2]))
+				id, ok := h.metricIDs[name]
+				if !ok {
+					id = uint32(len(h.metricIDs) + 1)
+					h.metricIDs[name] = id
+					h.metrics[id] = &metric{name: name}
+				}
+				mod.Memory().WriteUint32Le(uint32(stack[3]), id)
+				return statusOK
+			},
+		},
+		"proxy_increment_metric": {
+			params: []api.ValueType{i32, i64},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m, ok := h.metrics[uint32(stack[0])]
+				if !ok {
+					return statusNotFound
+				}
+				m.value += stack[1]
+				return statusOK
+			},
+		},
+		"proxy_record_metric": {
+			params: []api.ValueType{i32, i64},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m, ok := h.metrics[uint32(stack[0])]
+				if !ok {
+					return statusNotFound
+				}
+				m.value = stack[1]
+				return statusOK
+			},
+		},
+		"proxy_get_metric": {
+			params: []api.ValueType{i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				m, ok := h.metrics[uint32(stack[0])]
+				if !ok {
+					return statusNotFound
+				}
+				mod.Memory().WriteUint64Le(uint32(stack[1]), m.value)
+				return statusOK
+			},
+		},
+		"proxy_get_property": {
+			params: []api.ValueType{i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				value, ok := h.properties[propertyPath(read(mod, stack[0], stack[1]))]
+				if !ok {
+					return statusNotFound
+				}
+				return h.returnBytes(ctx, mod, value, stack[2], stack[3])
+			},
+		},
+		"proxy_set_property": {
+			params: []api.ValueType{i32, i32, i32, i32},
+			fn: func(ctx context.Context, mod api.Module, stack []uint64) uint32 {
+				h.properties[propertyPath(read(mod, stack[0], stack[1]))] = read(mod, stack[2], stack[3])
+				return statusOK
+			},
+		},
+	}
+}
+
+// current returns the stream of the effective context, nil for the root context.
+func (h *Host) current() *stream {
+	return h.streams[h.effectiveContext]
+}
+
+func (h *Host) hasQueue(id uint32) bool {
+	for _, queueID := range h.queues {
+		if queueID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Host) headerMap(mapType uint64) *[][2]string {
+	s := h.current()
+	if s == nil {
+		return nil
+	}
+	switch mapType {
+	case mapTypeHttpRequestHeaders:
+		return &s.requestHeaders
+	case mapTypeHttpRequestTrailers:
+		return &s.requestTrailers
+	case mapTypeHttpResponseHeaders:
+		return &s.responseHeaders
+	case mapTypeHttpResponseTrailers:
+		return &s.responseTrailers
+	}
+	return nil
+}
+
+func (h *Host) body(bufferType uint64) *[]byte {
+	s := h.current()
+	if s == nil {
+		return nil
+	}
+	switch bufferType {
+	case bufferTypeHttpRequestBody:
+		return &s.requestBody
+	case bufferTypeHttpResponseBody:
+		return &s.responseBody
+	}
+	return nil
+}
+
+// returnBytes copies the data to memory allocated by the module, writing its pointer and size
+// at the addresses passed by the module.
+func (h *Host) returnBytes(ctx context.Context, mod api.Module, data []byte, retPtr, retSizePtr uint64) uint32 {
+	ptr, err := allocate(ctx, mod, len(data))
+	if err != nil {
+		panic(err)
+	}
+	mem := mod.Memory()
+	if !mem.Write(ptr, data) || !mem.WriteUint32Le(uint32(retPtr), ptr) || !mem.WriteUint32Le(uint32(retSizePtr), uint32(len(data))) {
+		panic(errors.New("out of bounds memory access"))
+	}
+	return statusOK
+}
+
+func allocate(ctx context.Context, mod api.Module, size int) (uint32, error) {
+	if size > math.MaxInt32 {
+		return 0, fmt.Errorf("allocation of %d bytes", size)
+	}
+	// Allocations of zero bytes may return a nil pointer, which the SDK reads as not found.
+	if size == 0 {
+		size = 1
+	}
+	results, err := mod.ExportedFunction("proxy_on_memory_allocate").Call(ctx, uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	if results[0] == 0 {
+		return 0, fmt.Errorf("allocation of %d bytes failed", size)
+	}
+	return uint32(results[0]), nil
+}
+
+// read copies the memory of the module, panicking, so trapping the call, when out of bounds.
+func read(mod api.Module, ptr, size uint64) []byte {
+	b, ok := mod.Memory().Read(uint32(ptr), uint32(size))
+	if !ok {
+		panic(fmt.Errorf("out of bounds memory read of %d bytes at %d", uint32(size), uint32(ptr)))
+	}
+	return append([]byte{}, b...)
+}
+
+// propertyPath converts a serialized property path, with segments separated by null bytes, to
+// the dot separated path of Config.Properties.
+func propertyPath(b []byte) string {
+	return strings.ReplaceAll(string(b), "\x00", ".")
+}
+
+// serializeMap serializes the headers as expected by the SDK: the number of headers, the sizes
+// of the names and values, then the null terminated names and values, sizes being 32-bit little
+// endian integers.
+func serializeMap(headers [][2]string) []byte {
+	size := 4
+	for _, h := range headers {
+		size += len(h[0]) + len(h[1]) + 10
+	}
+	b := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(b, uint32(len(headers)))
+	for _, h := range headers {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(h[0])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(h[1])))
+	}
+	for _, h := range headers {
+		b = append(b, h[0]...)
+		b = append(b, 0)
+		b = append(b, h[1]...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// deserializeMap deserializes headers serialized as in serializeMap, returning the headers
+// read until the data is truncated.
+func deserializeMap(b []byte) [][2]string {
+	if len(b) < 4 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	sizes, data := 4, 4+8*n
+	if n < 0 || data > len(b) {
+		return nil
+	}
+	headers := make([][2]string, 0, n)
+	for i := 0; i < n; i++ {
+		keySize := int(binary.LittleEndian.Uint32(b[sizes:]))
+		valueSize := int(binary.LittleEndian.Uint32(b[sizes+4:]))
+		sizes += 8
+		if keySize+valueSize+2 > len(b)-data {
+			break
+		}
+		key := string(b[data : data+keySize])
+		data += keySize + 1
+		value := string(b[data : data+valueSize])
+		data += valueSize + 1
+		headers = append(headers, [2]string{key, value})
+	}
+	return headers
+}
+
+func removeHeader(headers [][2]string, key string) [][2]string {
+	kept := headers[:0]
+	for _, h := range headers {
+		if !strings.EqualFold(h[0], key) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,404 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package wasmhost runs the filter compiled to wasm, e.g. build/main.wasm, in wazero along
+// with a minimal host implementation of the proxy-wasm ABI. Unlike the proxytest emulator,
+// which runs the filter as Go code, it exercises the TinyGo build with its garbage collector,
+// the patched imports and the wasm operators, without Envoy.
+package wasmhost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const rootContextID uint32 = 1
+
+// wasmPageSize is the size of a page of the linear memory.
+const wasmPageSize = 65536
+
+// Config configures the host.
+type Config struct {
+	// PluginConfiguration is the configuration of the plugin, the one of the Envoy filter.
+	PluginConfiguration []byte
+	// VMConfiguration is the configuration of the VM.
+	VMConfiguration []byte
+	// Properties are the properties returned to the filter, keyed by their dot separated path,
+	// e.g. "source.address".
+	Properties map[string][]byte
+	// LogWriter receives the logs of the filter, if set.
+	LogWriter io.Writer
+	// Stdout and Stderr receive the output of the wasm module, if set.
+	Stdout, Stderr io.Writer
+	// CompilationCache, if set, is shared by the hosts running the same module to compile it once.
+	CompilationCache wazero.CompilationCache
+}
+
+// Host runs a proxy-wasm filter. Its methods mirror the ones of proxytest.HostEmulator so
+// that scenarios can run with both. Once the filter trapped, e.g. because of a panic, calls
+// are no-ops and Err returns the trap.
+type Host struct {
+	ctx     context.Context
+	runtime wazero.Runtime
+	module  api.Module
+	config  Config
+	err     error
+
+	nextContextID    uint32
+	effectiveContext uint32
+	streams          map[uint32]*stream
+
+	logs          map[logLevel][]string
+	properties    map[string][]byte
+	sharedData    map[string]sharedDataEntry
+	queues        map[string]uint32
+	queueData     map[uint32][][]byte
+	metrics       map[uint32]*metric
+	metricIDs     map[string]uint32
+	callouts      map[uint32]*callout
+	tickPeriod    uint32
+	unimplemented map[string]int
+}
+
+type stream struct {
+	requestHeaders, requestTrailers   [][2]string
+	responseHeaders, responseTrailers [][2]string
+	requestBody, responseBody         []byte
+	requestBodyBuffered               bool
+	responseBodyBuffered              bool
+	localResponse                     *proxytest.LocalHttpResponse
+}
+
+type sharedDataEntry struct {
+	value []byte
+	cas   uint32
+}
+
+type metric struct {
+	name  string
+	value uint64
+}
+
+type callout struct {
+	upstream string
+	headers  [][2]string
+	body     []byte
+}
+
+// New compiles and instantiates the wasm module, implementing the proxy-wasm imports. Imports
+// unknown to the host are stubbed, returning zeros, and counted in Unimplemented. Imports
+// known with a different signature fail the instantiation.
+func New(ctx context.Context, wasm []byte, config Config) (*Host, error) {
+	h := &Host{
+		ctx:           ctx,
+		config:        config,
+		nextContextID: rootContextID + 1,
+		streams:       map[uint32]*stream{},
+		logs:          map[logLevel][]string{},
+		properties:    map[string][]byte{},
+		sharedData:    map[string]sharedDataEntry{},
+		queues:        map[string]uint32{},
+		queueData:     map[uint32][][]byte{},
+		metrics:       map[uint32]*metric{},
+		metricIDs:     map[string]uint32{},
+		callouts:      map[uint32]*callout{},
+		unimplemented: map[string]int{},
+	}
+	for k, v := range config.Properties {
+		h.properties[k] = v
+	}
+
+	runtimeConfig := wazero.NewRuntimeConfig()
+	if config.CompilationCache != nil {
+		runtimeConfig = runtimeConfig.WithCompilationCache(config.CompilationCache)
+	}
+	h.runtime = wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, h.runtime); err != nil {
+		h.runtime.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := h.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		h.runtime.Close(ctx)
+		return nil, err
+	}
+	if err := h.instantiateABI(compiled); err != nil {
+		h.runtime.Close(ctx)
+		return nil, err
+	}
+
+	// Reactors, e.g. built by Go, export _initialize instead of _start.
+	modConfig := wazero.NewModuleConfig().WithStartFunctions("_initialize", "_start")
+	if config.Stdout != nil {
+		modConfig = modConfig.WithStdout(config.Stdout)
+	}
+	if config.Stderr != nil {
+		modConfig = modConfig.WithStderr(config.Stderr)
+	}
+	h.module, err = h.runtime.InstantiateModule(ctx, compiled, modConfig)
+	if err != nil {
+		h.runtime.Close(ctx)
+		return nil, err
+	}
+
+	for _, name := range []string{"proxy_on_memory_allocate", "proxy_on_context_create", "proxy_on_vm_start", "proxy_on_configure"} {
+		if h.module.ExportedFunction(name) == nil {
+			h.runtime.Close(ctx)
+			return nil, fmt.Errorf("missing export %q", name)
+		}
+	}
+	return h, nil
+}
+
+// Close closes the wasm runtime.
+func (h *Host) Close() error {
+	return h.runtime.Close(h.ctx)
+}
+
+// Err returns the trap of the filter, if any.
+func (h *Host) Err() error {
+	return h.err
+}
+
+// MemorySize returns the size of the linear memory in bytes, which never shrinks.
+func (h *Host) MemorySize() uint32 {
+	return h.module.Memory().Size()
+}
+
+// MemoryPages returns the size of the linear memory in pages of 64KiB.
+func (h *Host) MemoryPages() uint32 {
+	return h.MemorySize() / wasmPageSize
+}
+
+// Unimplemented returns the calls of the imports stubbed by the host, by import name.
+func (h *Host) Unimplemented() map[string]int {
+	return h.unimplemented
+}
+
+// call calls an exported function of the filter, recording the trap if it fails.
+func (h *Host) call(name string, params ...uint64) uint64 {
+	if h.err != nil {
+		return 0
+	}
+	fn := h.module.ExportedFunction(name)
+	if fn == nil {
+		// Exports of callbacks the filter doesn't implement are optional.
+		return 0
+	}
+	results, err := fn.Call(h.ctx, params...)
+	if err != nil {
+		h.err = fmt.Errorf("%s: %w", name, err)
+		return 0
+	}
+	if len(results) == 0 {
+		return 0
+	}
+	return results[0]
+}
+
+// StartVM creates the root context and starts the VM.
+func (h *Host) StartVM() types.OnVMStartStatus {
+	h.call("proxy_on_context_create", uint64(rootContextID), 0)
+	return types.OnVMStartStatus(h.call("proxy_on_vm_start", uint64(rootContextID), uint64(len(h.config.VMConfiguration))) != 0)
+}
+
+// StartPlugin starts the VM, if not already started, and configures the plugin.
+func (h *Host) StartPlugin() types.OnPluginStartStatus {
+	if h.effectiveContext == 0 {
+		if h.StartVM() != types.OnVMStartStatusOK {
+			return types.OnPluginStartStatusFailed
+		}
+	}
+	h.effectiveContext = rootContextID
+	return types.OnPluginStartStatus(h.call("proxy_on_configure", uint64(rootContextID), uint64(len(h.config.PluginConfiguration))) != 0)
+}
+
+// Tick calls the OnTick callback of the plugin.
+func (h *Host) Tick() {
+	h.effectiveContext = rootContextID
+	h.call("proxy_on_tick", uint64(rootContextID))
+}
+
+// GetTickPeriod returns the tick period set by the plugin, in milliseconds.
+func (h *Host) GetTickPeriod() uint32 {
+	return h.tickPeriod
+}
+
+// InitializeHttpContext creates an HTTP context.
+func (h *Host) InitializeHttpContext() uint32 {
+	id := h.nextContextID
+	h.nextContextID++
+	h.streams[id] = &stream{}
+	h.effectiveContext = id
+	h.call("proxy_on_context_create", uint64(id), uint64(rootContextID))
+	return id
+}
+
+// CallOnRequestHeaders calls the OnHttpRequestHeaders callback with the headers.
+func (h *Host) CallOnRequestHeaders(contextID uint32, headers [][2]string, endOfStream bool) types.Action {
+	s := h.stream(contextID)
+	s.requestHeaders = cloneHeaders(headers)
+	return types.Action(h.call("proxy_on_request_headers", uint64(contextID), uint64(len(headers)), boolParam(endOfStream)))
+}
+
+// CallOnRequestBody calls the OnHttpRequestBody callback with the chunk, buffered along with the
+// previous ones when the filter paused the stream. As with proxytest, the callback receives the
+// size of the chunk rather than the one of the buffered body.
+func (h *Host) CallOnRequestBody(contextID uint32, body []byte, endOfStream bool) types.Action {
+	s := h.stream(contextID)
+	if s.requestBodyBuffered {
+		s.requestBody = append(s.requestBody, body...)
+	} else {
+		s.requestBody = append([]byte{}, body...)
+	}
+	action := types.Action(h.call("proxy_on_request_body", uint64(contextID), uint64(len(body)), boolParam(endOfStream)))
+	s.requestBodyBuffered = action == types.ActionPause
+	return action
+}
+
+// CallOnRequestTrailers calls the OnHttpRequestTrailers callback with the trailers.
+func (h *Host) CallOnRequestTrailers(contextID uint32, trailers [][2]string) types.Action {
+	s := h.stream(contextID)
+	s.requestTrailers = cloneHeaders(trailers)
+	return types.Action(h.call("proxy_on_request_trailers", uint64(contextID), uint64(len(trailers))))
+}
+
+// CallOnResponseHeaders calls the OnHttpResponseHeaders callback with the headers.
+func (h *Host) CallOnResponseHeaders(contextID uint32, headers [][2]string, endOfStream bool) types.Action {
+	s := h.stream(contextID)
+	s.responseHeaders = cloneHeaders(headers)
+	return types.Action(h.call("proxy_on_response_headers", uint64(contextID), uint64(len(headers)), boolParam(endOfStream)))
+}
+
+// CallOnResponseBody calls the OnHttpResponseBody callback with the chunk, buffered along with
+// the previous ones when the filter paused the stream. As with proxytest, the callback receives
+// the size of the chunk rather than the one of the buffered body.
+func (h *Host) CallOnResponseBody(contextID uint32, body []byte, endOfStream bool) types.Action {
+	s := h.stream(contextID)
+	if s.responseBodyBuffered {
+		s.responseBody = append(s.responseBody, body...)
+	} else {
+		s.responseBody = append([]byte{}, body...)
+	}
+	action := types.Action(h.call("proxy_on_response_body", uint64(contextID), uint64(len(body)), boolParam(endOfStream)))
+	s.responseBodyBuffered = action == types.ActionPause
+	return action
+}
+
+// CallOnResponseTrailers calls the OnHttpResponseTrailers callback with the trailers.
+func (h *Host) CallOnResponseTrailers(contextID uint32, trailers [][2]string) types.Action {
+	s := h.stream(contextID)
+	s.responseTrailers = cloneHeaders(trailers)
+	return types.Action(h.call("proxy_on_response_trailers", uint64(contextID), uint64(len(trailers))))
+}
+
+// CompleteHttpContext completes the HTTP context, calling the OnHttpStreamDone callback. The
+// context can still be inspected afterwards.
+func (h *Host) CompleteHttpContext(contextID uint32) {
+	h.effectiveContext = contextID
+	h.call("proxy_on_done", uint64(contextID))
+	h.call("proxy_on_log", uint64(contextID))
+	h.call("proxy_on_delete", uint64(contextID))
+}
+
+// DeleteHttpContext drops the state of a completed HTTP context, e.g. in long runs.
+func (h *Host) DeleteHttpContext(contextID uint32) {
+	delete(h.streams, contextID)
+}
+
+// GetSentLocalResponse returns the response sent by the filter, nil if it didn't.
+func (h *Host) GetSentLocalResponse(contextID uint32) *proxytest.LocalHttpResponse {
+	return h.stream(contextID).localResponse
+}
+
+// GetCurrentRequestHeaders returns the request headers, as modified by the filter.
+func (h *Host) GetCurrentRequestHeaders(contextID uint32) [][2]string {
+	return h.stream(contextID).requestHeaders
+}
+
+// GetCurrentResponseHeaders returns the response headers, as modified by the filter.
+func (h *Host) GetCurrentResponseHeaders(contextID uint32) [][2]string {
+	return h.stream(contextID).responseHeaders
+}
+
+// GetCurrentRequestBody returns the request body, as modified by the filter.
+func (h *Host) GetCurrentRequestBody(contextID uint32) []byte {
+	return h.stream(contextID).requestBody
+}
+
+// GetCurrentResponseBody returns the response body, as modified by the filter.
+func (h *Host) GetCurrentResponseBody(contextID uint32) []byte {
+	return h.stream(contextID).responseBody
+}
+
+// SetProperty sets a property returned to the filter.
+func (h *Host) SetProperty(path []string, data []byte) error {
+	if len(path) == 0 {
+		return errors.New("empty property path")
+	}
+	h.properties[strings.Join(path, ".")] = data
+	return nil
+}
+
+// GetCounterMetric returns the value of a counter defined by the filter.
+func (h *Host) GetCounterMetric(name string) (uint64, error) {
+	id, ok := h.metricIDs[name]
+	if !ok {
+		return 0, fmt.Errorf("%s not found", name)
+	}
+	return h.metrics[id].value, nil
+}
+
+// GetTraceLogs returns the trace logs written by the filter.
+func (h *Host) GetTraceLogs() []string { return h.logs[logLevelTrace] }
+
+// GetDebugLogs returns the debug logs written by the filter.
+func (h *Host) GetDebugLogs() []string { return h.logs[logLevelDebug] }
+
+// GetInfoLogs returns the info logs written by the filter.
+func (h *Host) GetInfoLogs() []string { return h.logs[logLevelInfo] }
+
+// GetWarnLogs returns the warn logs written by the filter.
+func (h *Host) GetWarnLogs() []string { return h.logs[logLevelWarn] }
+
+// GetErrorLogs returns the error logs written by the filter.
+func (h *Host) GetErrorLogs() []string { return h.logs[logLevelError] }
+
+// GetCriticalLogs returns the critical logs written by the filter.
+func (h *Host) GetCriticalLogs() []string { return h.logs[logLevelCritical] }
+
+// ResetLogs drops the logs written so far, e.g. between the iterations of long runs.
+func (h *Host) ResetLogs() {
+	h.logs = map[logLevel][]string{}
+}
+
+func (h *Host) stream(contextID uint32) *stream {
+	s, ok := h.streams[contextID]
+	if !ok {
+		s = &stream{}
+		h.streams[contextID] = s
+	}
+	h.effectiveContext = contextID
+	return s
+}
+
+func boolParam(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func cloneHeaders(headers [][2]string) [][2]string {
+	return append([][2]string{}, headers...)
+}
@@ -0,0 +1,125 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmhost
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// buildGuest builds the guest of testdata/guest, skipping the test when the Go toolchain can't,
+// e.g. before Go 1.24.
+func buildGuest(t *testing.T, tags string) []byte {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "guest.wasm")
+	cmd := exec.Command("go", "build", "-buildmode=c-shared", "-tags", tags, "-o", out, ".")
+	cmd.Dir = filepath.Join("testdata", "guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("failed to build the guest: %v\n%s", err, output)
+	}
+	wasm, err := os.ReadFile(out)
+	require.NoError(t, err)
+	return wasm
+}
+
+func TestHost(t *testing.T) {
+	wasm := buildGuest(t, "")
+	host, err := New(context.Background(), wasm, Config{PluginConfiguration: []byte("hello")})
+	require.NoError(t, err)
+	defer host.Close()
+
+	require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+	require.Equal(t, []string{"configuration: hello"}, host.GetInfoLogs())
+	require.Equal(t, map[string]int{"proxy_get_log_level": 1}, host.Unimplemented())
+
+	t.Run("headers", func(t *testing.T) {
+		id := host.InitializeHttpContext()
+		require.NoError(t, host.SetProperty([]string{"request", "protocol"}, []byte("HTTP/1.1")))
+		action := host.CallOnRequestHeaders(id, [][2]string{{":path", "/protocol"}, {":method", "GET"}}, true)
+		require.Equal(t, types.ActionContinue, action)
+		require.Equal(t, [][2]string{
+			{":path", "/protocol"},
+			{":method", "GET"},
+			{"x-protocol", "HTTP/1.1"},
+			{"x-guest", "hello"},
+		}, host.GetCurrentRequestHeaders(id))
+		host.CompleteHttpContext(id)
+		require.Nil(t, host.GetSentLocalResponse(id))
+	})
+
+	t.Run("bodies", func(t *testing.T) {
+		id := host.InitializeHttpContext()
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{{":path", "/"}}, false))
+		require.Equal(t, types.ActionPause, host.CallOnRequestBody(id, []byte("abc"), false))
+		require.Equal(t, types.ActionPause, host.CallOnRequestBody(id, []byte{}, false))
+		require.Equal(t, types.ActionContinue, host.CallOnRequestBody(id, []byte("def"), true))
+		require.Contains(t, host.GetInfoLogs(), "request body: abcdef")
+
+		require.Equal(t, types.ActionContinue, host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, false))
+		require.Equal(t, types.ActionContinue, host.CallOnResponseBody(id, []byte("hello"), true))
+		require.Equal(t, []byte("HELLO"), host.GetCurrentResponseBody(id))
+		host.CompleteHttpContext(id)
+	})
+
+	t.Run("local response", func(t *testing.T) {
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, [][2]string{{":path", "/deny"}}, true)
+		require.Equal(t, types.ActionPause, action)
+		host.CompleteHttpContext(id)
+		resp := host.GetSentLocalResponse(id)
+		require.NotNil(t, resp)
+		require.EqualValues(t, 403, resp.StatusCode)
+		require.Equal(t, []byte("denied"), resp.Data)
+
+		host.DeleteHttpContext(id)
+		require.Nil(t, host.GetSentLocalResponse(id))
+	})
+
+	requests, err := host.GetCounterMetric("guest.requests")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, requests)
+	require.NotZero(t, host.MemorySize())
+	require.NoError(t, host.Err())
+
+	t.Run("trap", func(t *testing.T) {
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{{":path", "/panic"}}, true)
+		require.Error(t, host.Err())
+
+		// Calls are no-ops once the filter trapped.
+		id = host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{{":path", "/"}}, true)
+		require.Len(t, host.GetCurrentRequestHeaders(id), 1)
+	})
+}
+
+func TestABIMismatch(t *testing.T) {
+	wasm := buildGuest(t, "mismatch")
+	_, err := New(context.Background(), wasm, Config{})
+	require.ErrorContains(t, err, `import "proxy_log" has signature (i32,i32,i64) -> (i32)`)
+}
+
+func TestSerializeMap(t *testing.T) {
+	headers := [][2]string{{":path", "/"}, {"empty", ""}, {"x-test", "value"}}
+	b := serializeMap(headers)
+	require.Equal(t, headers, deserializeMap(b))
+	require.Empty(t, deserializeMap(serializeMap(nil)))
+
+	// Truncated data returns the headers read so far.
+	require.Equal(t, headers[:2], deserializeMap(b[:len(b)-1]))
+	require.Empty(t, deserializeMap(b[:10]))
+	require.Empty(t, deserializeMap(nil))
+}
+
+func TestPropertyPath(t *testing.T) {
+	require.Equal(t, "source.address", propertyPath([]byte("source\x00address")))
+	require.Equal(t, "plugin_name", propertyPath([]byte("plugin_name")))
+}
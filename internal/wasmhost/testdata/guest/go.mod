@@ -0,0 +1,3 @@
+module github.com/corazawaf/coraza-proxy-wasm/internal/wasmhost/testdata/guest
+
+go 1.24
@@ -0,0 +1,203 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Command guest is a minimal proxy-wasm filter, written against the raw ABI, used to test the
+// host. It is built with GOOS=wasip1 GOARCH=wasm -buildmode=c-shared, along with the mismatch
+// build tag to import a host function with a wrong signature.
+//
+// Requests to /deny are denied, requests to /panic trap, response bodies are uppercased and
+// requests get a x-guest header with the plugin configuration.
+package main
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+//go:wasmimport env proxy_log
+func proxyLog(level, ptr, size uint32) uint32
+
+//go:wasmimport env proxy_get_buffer_bytes
+func proxyGetBufferBytes(bufferType, start, maxSize uint32, retPtr, retSizePtr unsafe.Pointer) uint32
+
+//go:wasmimport env proxy_set_buffer_bytes
+func proxySetBufferBytes(bufferType, start, maxSize, ptr, size uint32) uint32
+
+//go:wasmimport env proxy_get_header_map_value
+func proxyGetHeaderMapValue(mapType, keyPtr, keySize uint32, retPtr, retSizePtr unsafe.Pointer) uint32
+
+//go:wasmimport env proxy_add_header_map_value
+func proxyAddHeaderMapValue(mapType, keyPtr, keySize, valuePtr, valueSize uint32) uint32
+
+//go:wasmimport env proxy_send_local_response
+func proxySendLocalResponse(status, detailPtr, detailSize, bodyPtr, bodySize, headersPtr, headersSize, grpcStatus uint32) uint32
+
+//go:wasmimport env proxy_define_metric
+func proxyDefineMetric(metricType, namePtr, nameSize uint32, retID unsafe.Pointer) uint32
+
+//go:wasmimport env proxy_increment_metric
+func proxyIncrementMetric(id uint32, offset int64) uint32
+
+//go:wasmimport env proxy_get_property
+func proxyGetProperty(pathPtr, pathSize uint32, retPtr, retSizePtr unsafe.Pointer) uint32
+
+// proxy_get_log_level is part of a later version of the ABI, unknown to the host.
+//
+//go:wasmimport env proxy_get_log_level
+func proxyGetLogLevel(retLevel unsafe.Pointer) uint32
+
+// allocations keeps the memory allocated for the host reachable.
+var allocations [][]byte
+
+var (
+	config     []byte
+	requestsID uint32
+)
+
+//go:wasmexport proxy_abi_version_0_2_0
+func proxyABIVersion() {}
+
+//go:wasmexport proxy_on_memory_allocate
+func proxyOnMemoryAllocate(size uint32) uint32 {
+	b := make([]byte, size)
+	allocations = append(allocations, b)
+	return ptr(b)
+}
+
+//go:wasmexport proxy_on_context_create
+func proxyOnContextCreate(contextID, rootContextID uint32) {}
+
+//go:wasmexport proxy_on_vm_start
+func proxyOnVMStart(rootContextID, vmConfigSize uint32) uint32 {
+	var level uint32
+	proxyGetLogLevel(unsafe.Pointer(&level))
+	return 1
+}
+
+//go:wasmexport proxy_on_configure
+func proxyOnConfigure(rootContextID, configSize uint32) uint32 {
+	b, ok := getBuffer(7, 0, configSize)
+	if !ok {
+		log(4, "missing configuration")
+		return 0
+	}
+	config = b
+	log(2, "configuration: "+string(config))
+	name := []byte("guest.requests")
+	proxyDefineMetric(0, ptr(name), uint32(len(name)), unsafe.Pointer(&requestsID))
+	return 1
+}
+
+//go:wasmexport proxy_on_request_headers
+func proxyOnRequestHeaders(contextID, numHeaders, endOfStream uint32) uint32 {
+	allocations = nil
+	proxyIncrementMetric(requestsID, 1)
+
+	path, _ := getHeader(0, ":path")
+	switch path {
+	case "/deny":
+		body := []byte("denied")
+		proxySendLocalResponse(403, 0, 0, ptr(body), uint32(len(body)), 0, 0, 0xffffffff)
+		return 1
+	case "/panic":
+		panic("panic requested")
+	case "/protocol":
+		if protocol, ok := getProperty("request\x00protocol"); ok {
+			addHeader(0, "x-protocol", protocol)
+		}
+	}
+	addHeader(0, "x-guest", string(config))
+	return 0
+}
+
+//go:wasmexport proxy_on_request_body
+func proxyOnRequestBody(contextID, bodySize, endOfStream uint32) uint32 {
+	if endOfStream == 0 {
+		// Buffers the whole body.
+		return 1
+	}
+	body, _ := getBuffer(0, 0, 1<<20)
+	log(2, "request body: "+string(body))
+	return 0
+}
+
+//go:wasmexport proxy_on_request_trailers
+func proxyOnRequestTrailers(contextID, numTrailers uint32) uint32 { return 0 }
+
+//go:wasmexport proxy_on_response_headers
+func proxyOnResponseHeaders(contextID, numHeaders, endOfStream uint32) uint32 { return 0 }
+
+//go:wasmexport proxy_on_response_body
+func proxyOnResponseBody(contextID, bodySize, endOfStream uint32) uint32 {
+	body, ok := getBuffer(1, 0, bodySize)
+	if !ok {
+		return 0
+	}
+	upper := bytes.ToUpper(body)
+	proxySetBufferBytes(1, 0, uint32(len(body)), ptr(upper), uint32(len(upper)))
+	return 0
+}
+
+//go:wasmexport proxy_on_response_trailers
+func proxyOnResponseTrailers(contextID, numTrailers uint32) uint32 { return 0 }
+
+//go:wasmexport proxy_on_done
+func proxyOnDone(contextID uint32) uint32 { return 1 }
+
+//go:wasmexport proxy_on_log
+func proxyOnLog(contextID uint32) {}
+
+//go:wasmexport proxy_on_delete
+func proxyOnDelete(contextID uint32) {}
+
+func main() {}
+
+func ptr(b []byte) uint32 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func bytesAt(p, size uint32) []byte {
+	if p == 0 {
+		return nil
+	}
+	return append([]byte{}, unsafe.Slice((*byte)(unsafe.Pointer(uintptr(p))), size)...)
+}
+
+func log(level uint32, msg string) {
+	b := []byte(msg)
+	proxyLog(level, ptr(b), uint32(len(b)))
+}
+
+func getBuffer(bufferType, start, maxSize uint32) ([]byte, bool) {
+	var p, size uint32
+	if proxyGetBufferBytes(bufferType, start, maxSize, unsafe.Pointer(&p), unsafe.Pointer(&size)) != 0 {
+		return nil, false
+	}
+	return bytesAt(p, size), true
+}
+
+func getHeader(mapType uint32, key string) (string, bool) {
+	k := []byte(key)
+	var p, size uint32
+	if proxyGetHeaderMapValue(mapType, ptr(k), uint32(len(k)), unsafe.Pointer(&p), unsafe.Pointer(&size)) != 0 {
+		return "", false
+	}
+	return string(bytesAt(p, size)), true
+}
+
+func addHeader(mapType uint32, key, value string) {
+	k, v := []byte(key), []byte(value)
+	proxyAddHeaderMapValue(mapType, ptr(k), uint32(len(k)), ptr(v), uint32(len(v)))
+}
+
+func getProperty(path string) (string, bool) {
+	b := []byte(path)
+	var p, size uint32
+	if proxyGetProperty(ptr(b), uint32(len(b)), unsafe.Pointer(&p), unsafe.Pointer(&size)) != 0 {
+		return "", false
+	}
+	return string(bytesAt(p, size)), true
+}
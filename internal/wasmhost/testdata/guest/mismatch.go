@@ -0,0 +1,14 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build mismatch
+
+package main
+
+//go:wasmimport env proxy_log
+func proxyLog64(level, ptr uint32, size uint64) uint32
+
+//go:wasmexport proxy_on_tick
+func proxyOnTick(rootContextID uint32) {
+	proxyLog64(2, 0, 0)
+}
@@ -0,0 +1,185 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/magefile/mage/sh"
+)
+
+// Baseline of the benchmarks, refreshed with BENCH_UPDATE=true.
+var benchBaseline = filepath.Join("testdata", "bench", "baseline.txt")
+
+// Iterations and runs of each benchmark, unless BENCH_TIME and BENCH_COUNT are set. Benchmarks run
+// a fixed number of iterations as the per-phase ones run the rest of the transaction untimed.
+var defaultBenchTime = "10x"
+var defaultBenchCount = "3"
+
+// Regression, in percent, tolerated by Bench unless BENCH_THRESHOLD is set.
+var defaultBenchThreshold = 20.0
+
+// benchResult is the median of the runs of a benchmark, less sensitive to outliers than the mean.
+type benchResult struct {
+	nsPerOp, bytesPerOp, allocsPerOp float64
+}
+
+// Bench runs the benchmarks of the phases of the transactions with the CRS, writing the results to
+// build/bench.txt, and fails when B/op or allocs/op regress by more than BENCH_THRESHOLD percent
+// compared to testdata/bench/baseline.txt. Timings vary too much between runs and machines to be
+// gated on, their change is only printed.
+func Bench() error {
+	benchTime := os.Getenv("BENCH_TIME")
+	if benchTime == "" {
+		benchTime = defaultBenchTime
+	}
+	count := os.Getenv("BENCH_COUNT")
+	if count == "" {
+		count = defaultBenchCount
+	}
+	threshold := defaultBenchThreshold
+	if t := os.Getenv("BENCH_THRESHOLD"); t != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(t, 64); err != nil {
+			return fmt.Errorf("invalid BENCH_THRESHOLD: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll("build", 0755); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if _, err := sh.Exec(nil, io.MultiWriter(os.Stdout, &out), os.Stderr, "go", "test", "-run", "^$",
+		"-bench", ".", "-benchmem", "-benchtime", benchTime, "-count", count, "."); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join("build", "bench.txt"), out.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if os.Getenv("BENCH_UPDATE") == "true" {
+		if err := os.MkdirAll(filepath.Dir(benchBaseline), 0755); err != nil {
+			return err
+		}
+		fmt.Printf("Updating %s\n", benchBaseline)
+		return os.WriteFile(benchBaseline, out.Bytes(), 0644)
+	}
+
+	baselineOut, err := os.ReadFile(benchBaseline)
+	if err != nil {
+		return fmt.Errorf("failed to read the baseline, create it with BENCH_UPDATE=true: %v", err)
+	}
+	return compareBenchmarks(parseBenchmarks(baselineOut), parseBenchmarks(out.Bytes()), threshold)
+}
+
+// parseBenchmarks returns the median of the runs of each benchmark of the output of
+// go test -bench -benchmem.
+func parseBenchmarks(out []byte) map[string]benchResult {
+	runs := map[string]map[string][]float64{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		// Strips the GOMAXPROCS suffix, e.g. BenchmarkPhases/small_get/done-8.
+		name := fields[0]
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+
+		if runs[name] == nil {
+			runs[name] = map[string][]float64{}
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			if v, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				runs[name][fields[i+1]] = append(runs[name][fields[i+1]], v)
+			}
+		}
+	}
+
+	results := map[string]benchResult{}
+	for name, units := range runs {
+		results[name] = benchResult{
+			nsPerOp:     median(units["ns/op"]),
+			bytesPerOp:  median(units["B/op"]),
+			allocsPerOp: median(units["allocs/op"]),
+		}
+	}
+	return results
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// compareBenchmarks prints the change of each benchmark compared to the baseline, failing when
+// its B/op or allocs/op regress by more than threshold percent. The change of ns/op is only
+// informative.
+func compareBenchmarks(baseline, current map[string]benchResult, threshold float64) error {
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var regressions []string
+	fmt.Printf("%-50s %12s %12s %12s\n", "benchmark", "ns/op", "B/op", "allocs/op")
+	for _, name := range names {
+		cur := current[name]
+		base, ok := baseline[name]
+		if !ok {
+			fmt.Printf("%-50s %12s %12s %12s\n", name, "new", "new", "new")
+			continue
+		}
+		var deltas []string
+		regressed := false
+		for _, m := range []struct {
+			base, cur float64
+			gated     bool
+		}{
+			{base.nsPerOp, cur.nsPerOp, false},
+			{base.bytesPerOp, cur.bytesPerOp, true},
+			{base.allocsPerOp, cur.allocsPerOp, true},
+		} {
+			delta := 0.0
+			if m.base > 0 {
+				delta = (m.cur - m.base) / m.base * 100
+			} else if m.cur > 0 {
+				delta = 100
+			}
+			if m.gated && delta > threshold {
+				regressed = true
+			}
+			deltas = append(deltas, fmt.Sprintf("%+.1f%%", delta))
+		}
+		fmt.Printf("%-50s %12s %12s %12s\n", name, deltas[0], deltas[1], deltas[2])
+		if regressed {
+			regressions = append(regressions, name)
+		}
+	}
+
+	if len(regressions) > 0 {
+		return fmt.Errorf("benchmarks regressed by more than %.0f%%: %s", threshold, strings.Join(regressions, ", "))
+	}
+	return nil
+}
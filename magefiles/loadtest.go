@@ -4,8 +4,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"fortio.org/fortio/fhttp"
@@ -14,23 +24,101 @@ import (
 	"github.com/magefile/mage/sh"
 )
 
-// LoadTest runs load tests against the ftw deployment.
+var loadTestThreads = []int{1, 2, 4}
+var loadTestPayloadSizes = []int{0, 100, 1000, 10000}
+
+// Target QPS and duration of each run, unless LOADTEST_QPS and LOADTEST_DURATION are set. A QPS of
+// -1 sends requests as fast as possible, measuring the maximum throughput.
+var defaultLoadTestQPS = 100.0
+var defaultLoadTestDuration = 10 * time.Second
+
+var loadTestDir = filepath.Join("build", "loadtest")
+
+// Summary of the load tests, unless LOADTEST_OUTPUT is set.
+var defaultLoadTestOutput = filepath.Join("build", "loadtest.json")
+
+var errEnvoyNotFound = errors.New("envoy not found in PATH, set ENVOY_BIN")
+
+// loadTestResult holds the latencies and throughput of a run.
+type loadTestResult struct {
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"`
+	AvgMs    float64 `json:"avg_ms"`
+	P50Ms    float64 `json:"p50_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+	QPS      float64 `json:"qps"`
+}
+
+// loadTestComparison compares the runs with and without the filter of a payload size and a number
+// of threads.
+type loadTestComparison struct {
+	PayloadSize   int            `json:"payload_size"`
+	Threads       int            `json:"threads"`
+	Wasm          loadTestResult `json:"wasm"`
+	NoWasm        loadTestResult `json:"no_wasm"`
+	P50OverheadMs float64        `json:"p50_overhead_ms"`
+	P99OverheadMs float64        `json:"p99_overhead_ms"`
+}
+
+// loadTestSummary is written as JSON to track the results over time.
+type loadTestSummary struct {
+	Date     string               `json:"date"`
+	Commit   string               `json:"commit,omitempty"`
+	Mode     string               `json:"mode"`
+	QPS      float64              `json:"target_qps"`
+	Duration string               `json:"duration"`
+	Results  []loadTestComparison `json:"results"`
+}
+
+// loadTestOptions are the settings of the runs, read from the environment.
+type loadTestOptions struct {
+	qps      float64
+	duration time.Duration
+}
+
+func newLoadTestOptions() (loadTestOptions, error) {
+	opts := loadTestOptions{qps: defaultLoadTestQPS, duration: defaultLoadTestDuration}
+	if v := os.Getenv("LOADTEST_QPS"); v != "" {
+		qps, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid LOADTEST_QPS: %v", err)
+		}
+		opts.qps = qps
+	}
+	if v := os.Getenv("LOADTEST_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid LOADTEST_DURATION: %v", err)
+		}
+		opts.duration = d
+	}
+	return opts, nil
+}
+
+// LoadTest runs load tests against the ftw deployment. Requires docker-compose.
 func LoadTest() error {
-	for _, threads := range []int{1, 2, 4} {
-		for _, payloadSize := range []int{0, 100, 1000, 10000} {
+	opts, err := newLoadTestOptions()
+	if err != nil {
+		return err
+	}
+	results := map[bool]map[[2]int]loadTestResult{true: {}, false: {}}
+	for _, threads := range loadTestThreads {
+		for _, payloadSize := range loadTestPayloadSizes {
 			for _, conf := range []string{"envoy-config.yaml", "envoy-config-nowasm.yaml"} {
-				if err := doLoadTest(conf, payloadSize, threads); err != nil {
+				res, err := doLoadTest(conf, payloadSize, threads, opts)
+				if err != nil {
 					return err
 				}
+				results[conf == "envoy-config.yaml"][[2]int{payloadSize, threads}] = res
 			}
 		}
 	}
-	return nil
+	return writeLoadTestSummary("docker", opts, results)
 }
 
-func doLoadTest(conf string, payloadSize int, threads int) error {
+func doLoadTest(conf string, payloadSize int, threads int, opts loadTestOptions) (loadTestResult, error) {
 	if err := sh.RunV("docker-compose", "--file", "ftw/docker-compose.yml", "build", "--pull"); err != nil {
-		return err
+		return loadTestResult{}, err
 	}
 	defer func() {
 		_ = sh.RunV("docker-compose", "--file", "ftw/docker-compose.yml", "kill")
@@ -38,40 +126,257 @@ func doLoadTest(conf string, payloadSize int, threads int) error {
 	}()
 	if err := sh.RunWithV(map[string]string{"ENVOY_CONFIG": fmt.Sprintf("/conf/%s", conf)}, "docker-compose",
 		"--file", "ftw/docker-compose.yml", "run", "--service-ports", "--rm", "-d", "envoy"); err != nil {
+		return loadTestResult{}, err
+	}
+
+	url := "http://localhost:8080/anything"
+	if err := waitForEnvoy(url, nil); err != nil {
+		return loadTestResult{}, err
+	}
+	fmt.Printf("Running load test with config=%s, payloadSize=%d, threads=%d\n", conf, payloadSize, threads)
+	return runLoadTest(url, payloadSize, threads, opts)
+}
+
+// LoadTestLocal runs the load tests of LoadTest against a local Envoy, without Docker, forwarding
+// requests to an in-process echo server. ENVOY_BIN sets the Envoy binary, envoy in PATH by
+// default, and build/main.wasm must be built. Results are compared with and without the filter
+// and written to build/loadtest.json, or LOADTEST_OUTPUT. LOADTEST_QPS and LOADTEST_DURATION
+// set the target QPS, 100 by default, and the duration of each run, 10s by default.
+func LoadTestLocal() error {
+	opts, err := newLoadTestOptions()
+	if err != nil {
+		return err
+	}
+	envoy := os.Getenv("ENVOY_BIN")
+	if envoy == "" {
+		if envoy, err = exec.LookPath("envoy"); err != nil {
+			return errEnvoyNotFound
+		}
+	}
+	wasmPath, err := filepath.Abs(filepath.Join("build", "main.wasm"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(wasmPath); err != nil {
+		return fmt.Errorf("failed to find the filter, run mage build: %v", err)
+	}
+	if err := os.MkdirAll(loadTestDir, 0755); err != nil {
+		return err
+	}
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(echoHandler)}
+	go func() { _ = srv.Serve(upstream) }()
+	defer srv.Close()
+
+	results := map[bool]map[[2]int]loadTestResult{true: {}, false: {}}
+	for _, wasm := range []bool{true, false} {
+		if err := doLoadTestLocal(envoy, wasmPath, upstream.Addr().(*net.TCPAddr).Port, wasm, opts, results[wasm]); err != nil {
+			return err
+		}
+	}
+	return writeLoadTestSummary("local", opts, results)
+}
+
+func doLoadTestLocal(envoy, wasmPath string, upstreamPort int, wasm bool, opts loadTestOptions, results map[[2]int]loadTestResult) error {
+	name := "nowasm"
+	if wasm {
+		name = "wasm"
+	}
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	conf := filepath.Join(loadTestDir, fmt.Sprintf("envoy-config-%s.yaml", name))
+	if err := writeEnvoyConfig(conf, envoyConfig{Port: port, UpstreamPort: upstreamPort, Wasm: wasm, WasmPath: wasmPath}); err != nil {
+		return err
+	}
+	logFile, err := os.Create(filepath.Join(loadTestDir, fmt.Sprintf("envoy-%s.log", name)))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(envoy, "-c", conf, "--log-level", "warn", "--disable-hot-restart")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		_ = cmd.Process.Kill()
+		<-exited
+	}()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/anything", port)
+	if err := waitForEnvoy(url, exited); err != nil {
+		return fmt.Errorf("%v, see %s", err, logFile.Name())
+	}
+	for _, threads := range loadTestThreads {
+		for _, payloadSize := range loadTestPayloadSizes {
+			fmt.Printf("Running load test with config=%s, payloadSize=%d, threads=%d\n", conf, payloadSize, threads)
+			res, err := runLoadTest(url, payloadSize, threads, opts)
+			if err != nil {
+				return err
+			}
+			results[[2]int{payloadSize, threads}] = res
+		}
+	}
+	return nil
+}
+
+// envoyConfig are the parameters of envoyConfigTemplate.
+type envoyConfig struct {
+	Port         int
+	UpstreamPort int
+	Wasm         bool
+	WasmPath     string
+}
+
+// envoyConfigTemplate is ftw/envoy-config.yaml, or ftw/envoy-config-nowasm.yaml, listening and
+// forwarding requests to local ports.
+var envoyConfigTemplate = template.Must(template.New("envoy").Parse(`static_resources:
+  listeners:
+    - address:
+        socket_address:
+          address: 127.0.0.1
+          port_value: {{ .Port }}
+      filter_chains:
+        - filters:
+            - name: envoy.filters.network.http_connection_manager
+              typed_config:
+                "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+                stat_prefix: ingress_http
+                codec_type: auto
+                route_config:
+                  virtual_hosts:
+                    - name: local_route
+                      domains:
+                        - "*"
+                      routes:
+                        - match:
+                            prefix: "/"
+                          route:
+                            cluster: local_server
+                http_filters:
+{{- if .Wasm }}
+                  - name: envoy.filters.http.wasm
+                    typed_config:
+                      "@type": type.googleapis.com/envoy.extensions.filters.http.wasm.v3.Wasm
+                      config:
+                        name: "coraza-filter"
+                        root_id: ""
+                        configuration:
+                          "@type": "type.googleapis.com/google.protobuf.StringValue"
+                          value: |
+                            {
+                              "directives_map": {
+                                  "default": [
+                                    "Include @recommended-conf",
+                                    "Include @ftw-conf",
+                                    "Include @crs-setup-conf",
+                                    "Include @owasp_crs/*.conf"
+                                  ]
+                              },
+                              "default_directives": "default",
+                              "metric_labels": {},
+                              "per_authority_directives": {}
+                            }
+                        vm_config:
+                          runtime: "envoy.wasm.runtime.v8"
+                          vm_id: "my_vm_id"
+                          code:
+                            local:
+                              filename: "{{ .WasmPath }}"
+{{- end }}
+                  - name: envoy.filters.http.router
+                    typed_config:
+                      "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+
+  clusters:
+    - name: local_server
+      connect_timeout: 6000s
+      type: STATIC
+      load_assignment:
+        cluster_name: local_server
+        endpoints:
+          - lb_endpoints:
+              - endpoint:
+                  address:
+                    socket_address:
+                      address: 127.0.0.1
+                      port_value: {{ .UpstreamPort }}
+`))
+
+func writeEnvoyConfig(path string, conf envoyConfig) error {
+	f, err := os.Create(path)
+	if err != nil {
 		return err
 	}
+	defer f.Close()
+	return envoyConfigTemplate.Execute(f, conf)
+}
 
-	// Wait for Envoy to start.
+// echoHandler responds with the body of the request, like the /anything endpoint of httpbin.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	_, _ = io.Copy(w, r.Body)
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitForEnvoy waits for Envoy to respond to url, failing when it exits, if exited isn't nil.
+func waitForEnvoy(url string, exited <-chan error) error {
 	for i := 0; i < 1000; i++ {
-		if resp, err := http.Get("http://localhost:8080/anything"); err != nil {
-			continue
-		} else {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("envoy exited: %v", err)
+		default:
+		}
+		if resp, err := http.Get(url); err == nil {
 			if resp.Body != nil {
 				resp.Body.Close()
 			}
 			if resp.StatusCode == http.StatusOK {
-				break
+				return nil
 			}
 		}
 		time.Sleep(50 * time.Millisecond)
 	}
+	return errors.New("envoy did not start")
+}
 
-	opts := &fhttp.HTTPRunnerOptions{
+func runLoadTest(url string, payloadSize int, threads int, opts loadTestOptions) (loadTestResult, error) {
+	ro := &fhttp.HTTPRunnerOptions{
 		RunnerOptions: periodic.RunnerOptions{
-			QPS:        100,
-			NumThreads: threads,
-			Duration:   10 * time.Second,
+			QPS:         opts.qps,
+			NumThreads:  threads,
+			Duration:    opts.duration,
+			Percentiles: []float64{50, 99},
 		},
 		HTTPOptions: fhttp.HTTPOptions{
-			URL:     "http://localhost:8080/anything",
+			URL:     url,
 			Payload: fnet.GenerateRandomPayload(payloadSize),
 		},
 	}
 
-	fmt.Printf("Running load test with config=%s, payloadSize=%d, threads=%d\n", conf, payloadSize, threads)
-	res, err := fhttp.RunHTTPTest(opts)
+	res, err := fhttp.RunHTTPTest(ro)
 	if err != nil {
-		return err
+		return loadTestResult{}, err
 	}
 	rr := res.Result()
 	fmt.Printf("All done %d calls (plus %d warmup) %.3f ms avg, %.1f qps\n",
@@ -80,5 +385,69 @@ func doLoadTest(conf string, payloadSize int, threads int) error {
 		1000.*rr.DurationHistogram.Avg,
 		rr.ActualQPS)
 
-	return nil
+	result := loadTestResult{
+		Requests: rr.DurationHistogram.Count,
+		AvgMs:    1000. * rr.DurationHistogram.Avg,
+		QPS:      rr.ActualQPS,
+	}
+	for code, count := range res.RetCodes {
+		if code != http.StatusOK {
+			result.Errors += count
+		}
+	}
+	for _, p := range rr.DurationHistogram.Percentiles {
+		switch p.Percentile {
+		case 50:
+			result.P50Ms = 1000. * p.Value
+		case 99:
+			result.P99Ms = 1000. * p.Value
+		}
+	}
+	return result, nil
+}
+
+// writeLoadTestSummary prints the results, with and without the filter, for each payload size and
+// number of threads, and writes them as JSON.
+func writeLoadTestSummary(mode string, opts loadTestOptions, results map[bool]map[[2]int]loadTestResult) error {
+	summary := loadTestSummary{
+		Date:     time.Now().UTC().Format(time.RFC3339),
+		Mode:     mode,
+		QPS:      opts.qps,
+		Duration: opts.duration.String(),
+	}
+	if commit, err := sh.Output("git", "rev-parse", "HEAD"); err == nil {
+		summary.Commit = strings.TrimSpace(commit)
+	}
+
+	fmt.Printf("%8s %8s %21s %21s %21s\n", "payload", "threads", "p50 ms (wasm/no)", "p99 ms (wasm/no)", "qps (wasm/no)")
+	for _, payloadSize := range loadTestPayloadSizes {
+		for _, threads := range loadTestThreads {
+			key := [2]int{payloadSize, threads}
+			c := loadTestComparison{
+				PayloadSize: payloadSize,
+				Threads:     threads,
+				Wasm:        results[true][key],
+				NoWasm:      results[false][key],
+			}
+			c.P50OverheadMs = c.Wasm.P50Ms - c.NoWasm.P50Ms
+			c.P99OverheadMs = c.Wasm.P99Ms - c.NoWasm.P99Ms
+			summary.Results = append(summary.Results, c)
+			fmt.Printf("%8d %8d %10.3f/%-10.3f %10.3f/%-10.3f %10.1f/%-10.1f\n", payloadSize, threads,
+				c.Wasm.P50Ms, c.NoWasm.P50Ms, c.Wasm.P99Ms, c.NoWasm.P99Ms, c.Wasm.QPS, c.NoWasm.QPS)
+		}
+	}
+
+	output := os.Getenv("LOADTEST_OUTPUT")
+	if output == "" {
+		output = defaultLoadTestOutput
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Writing the summary to %s\n", output)
+	return os.WriteFile(output, append(b, '\n'), 0644)
 }
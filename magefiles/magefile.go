@@ -4,9 +4,13 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -25,6 +29,47 @@ var addLicenseVersion = "04bfe4ee9ca5764577b029acc6a1957fd1997153" // https://gi
 var golangCILintVer = "v1.48.0"                                    // https://github.com/golangci/golangci-lint/releases
 var gosImportsVer = "v0.3.1"                                       // https://github.com/rinchsan/gosimports/releases/tag/v0.3.1
 
+// CRS plugins embedded by default, see https://github.com/coreruleset/plugin-registry
+var defaultCRSPlugins = []string{"wordpress-rule-exclusions", "drupal-rule-exclusions", "nextcloud-rule-exclusions"}
+
+// Commits of the CRS plugins downloaded by CrsPlugins, a plugin without one requires CRS_PLUGINS_REF.
+// Bump them after reviewing the upstream changes, like crsTestsRef.
+var crsPluginRefs = map[string]string{
+	"wordpress-rule-exclusions": "",
+	"drupal-rule-exclusions":    "",
+	"nextcloud-rule-exclusions": "",
+}
+var crsPluginsDir = filepath.Join("wasmplugin", "rules", "crs-plugins")
+
+// Rules profiles select the rules embedded in the filter, see wasmplugin/fs_rules_*.go
+var rulesProfileTags = map[string]string{
+	"none":     "rules_none",
+	"crs-core": "rules_crs_core",
+	"crs-full": "",
+	"custom":   "rules_custom",
+}
+var customRulesDir = filepath.Join("wasmplugin", "custom-rules")
+
+// Operator engines of the test matrix: Go's implementations, and the wasilibs ones used by the
+// filter (re2, aho-corasick, libinjection) run natively through wazero.
+var operatorEngines = []struct {
+	name string
+	tags string
+}{
+	{name: "go"},
+	{name: "wasilibs", tags: "wasilibs_native"},
+}
+var defaultTestMatrixRun = "^(TestLifecycle|TestParseCRS)$"
+
+// CRS regression tests run by FtwLocal, keep in sync with the CRS version of ftw/Dockerfile.
+var crsTestsRef = "477d8c3431d042294af2651f08d63d10b6f3fd60"
+var crsTestsDir = filepath.Join("build", "crs-tests")
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Number of transactions of the soak test, unless WASM_SOAK is set.
+var defaultSoakTransactions = "5000"
+
 var errCommitFormatting = errors.New("files not formatted, please commit formatting changes")
 var errNoGitDir = errors.New("no .git directory found")
 
@@ -137,6 +182,27 @@ func Test() error {
 	return sh.RunV("go", "test", "./...")
 }
 
+// TestMatrix runs the lifecycle and CRS parsing tests with both the Go and wasilibs operators,
+// catching divergences between Go's regexp and re2. TEST_MATRIX_RUN overrides the tests to run.
+func TestMatrix() error {
+	run := os.Getenv("TEST_MATRIX_RUN")
+	if run == "" {
+		run = defaultTestMatrixRun
+	}
+
+	var failed []string
+	for _, engine := range operatorEngines {
+		fmt.Printf("Running tests with the %s operators\n", engine.name)
+		if err := sh.RunV("go", "test", "-count=1", "-tags="+engine.tags, "-run", run, "."); err != nil {
+			failed = append(failed, engine.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("tests failed with the %s operators", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 // Coverage runs tests with coverage and race detector enabled.
 func Coverage() error {
 	if err := os.MkdirAll("build", 0755); err != nil {
@@ -159,13 +225,90 @@ func Check() {
 	mg.SerialDeps(Lint, Test)
 }
 
-// Build builds the Coraza wasm plugin.
+// CrsPlugins downloads the CRS plugins to embed in the filter. Plugins are selected with CRS_PLUGINS
+// (comma separated names, "none" to skip) and downloaded at the commits pinned in crsPluginRefs.
+// CRS_PLUGINS_REF overrides the commit SHA of all of them. Plugins already downloaded are kept.
+func CrsPlugins() error {
+	plugins := defaultCRSPlugins
+	if env, ok := os.LookupEnv("CRS_PLUGINS"); ok {
+		plugins = nil
+		if env != "none" {
+			for _, p := range strings.Split(env, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					plugins = append(plugins, p)
+				}
+			}
+		}
+	}
+
+	refOverride := os.Getenv("CRS_PLUGINS_REF")
+	if refOverride != "" && !commitSHA.MatchString(refOverride) {
+		return fmt.Errorf("CRS_PLUGINS_REF must be a commit SHA, got %q", refOverride)
+	}
+
+	if err := os.MkdirAll(crsPluginsDir, 0755); err != nil {
+		return err
+	}
+
+	for _, plugin := range plugins {
+		if matches, _ := filepath.Glob(filepath.Join(crsPluginsDir, plugin+"-*.conf")); len(matches) > 0 {
+			continue
+		}
+		ref := refOverride
+		if ref == "" {
+			ref = crsPluginRefs[plugin]
+		}
+		if !commitSHA.MatchString(ref) {
+			return fmt.Errorf("no commit pinned for CRS plugin %q, add it to crsPluginRefs or set CRS_PLUGINS_REF", plugin)
+		}
+		url := fmt.Sprintf("https://github.com/coreruleset/%s-plugin/archive/%s.tar.gz", plugin, ref)
+		fmt.Printf("Downloading CRS plugin %s from %s\n", plugin, url)
+		// Archives are rooted at <repository>-<ref>/, plugin files live in its plugins directory.
+		extracted, err := downloadTarGz(url, func(parts []string) string {
+			if len(parts) != 3 || parts[1] != "plugins" {
+				return ""
+			}
+			return filepath.Join(crsPluginsDir, parts[2])
+		})
+		if err != nil {
+			return fmt.Errorf("failed to download CRS plugin %q: %v", plugin, err)
+		}
+		if extracted == 0 {
+			return fmt.Errorf("failed to download CRS plugin %q: no plugin files found", plugin)
+		}
+	}
+	return nil
+}
+
+// Build builds the Coraza wasm plugin. RULES_PROFILE selects the embedded rules: none, crs-core,
+// crs-full (default) or custom, which embeds the directory set in RULES_DIR.
 func Build() error {
+	profile := os.Getenv("RULES_PROFILE")
+	if profile == "" {
+		profile = "crs-full"
+	}
+	profileTag, ok := rulesProfileTags[profile]
+	if !ok {
+		return fmt.Errorf("unknown rules profile %q", profile)
+	}
+
+	switch profile {
+	case "crs-full":
+		mg.Deps(CrsPlugins)
+	case "custom":
+		if err := copyCustomRules(os.Getenv("RULES_DIR")); err != nil {
+			return err
+		}
+	}
+
 	if err := os.MkdirAll("build", 0755); err != nil {
 		return err
 	}
 
 	buildTags := []string{"custommalloc", "no_fs_access"}
+	if profileTag != "" {
+		buildTags = append(buildTags, profileTag)
+	}
 	if os.Getenv("TIMING") == "true" {
 		buildTags = append(buildTags, "timing", "proxywasm_timing")
 	}
@@ -192,6 +335,34 @@ func Build() error {
 	return patchWasm(filepath.Join("build", "mainraw.wasm"), filepath.Join("build", "main.wasm"), initialPages)
 }
 
+// copyCustomRules replaces the rules embedded by the custom profile with the content of dir.
+func copyCustomRules(dir string) error {
+	if dir == "" {
+		return errors.New("RULES_DIR is required by the custom rules profile")
+	}
+	if err := os.RemoveAll(customRulesDir); err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(customRulesDir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(dst, content, 0644)
+	})
+}
+
 // E2e runs e2e tests with a built plugin against the example deployment. Requires docker-compose.
 func E2e() error {
 	if err := sh.RunV("docker-compose", "--file", "e2e/docker-compose.yml", "build", "--pull"); err != nil {
@@ -223,6 +394,109 @@ func Ftw() error {
 	return sh.RunWithV(env, "docker-compose", "--file", "ftw/docker-compose.yml", "run", "--rm", task)
 }
 
+// FtwLocal runs ftw tests in-process with the proxytest host emulator, without Docker nor Envoy.
+// CRS regression tests are downloaded to build/crs-tests unless FTW_TESTS_DIR is set, and
+// FTW_INCLUDE selects the tests to run, e.g. FTW_INCLUDE=920410.
+func FtwLocal() error {
+	dir := os.Getenv("FTW_TESTS_DIR")
+	if dir == "" {
+		dir = crsTestsDir
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			url := fmt.Sprintf("https://github.com/coreruleset/coreruleset/archive/%s.tar.gz", crsTestsRef)
+			fmt.Printf("Downloading CRS regression tests from %s\n", url)
+			// Archives are rooted at <repository>-<ref>/, tests live in tests/regression/tests.
+			extracted, err := downloadTarGz(url, func(parts []string) string {
+				if len(parts) < 5 || parts[1] != "tests" || parts[2] != "regression" || parts[3] != "tests" {
+					return ""
+				}
+				return filepath.Join(dir, filepath.Join(parts[4:]...))
+			})
+			if err != nil {
+				return fmt.Errorf("failed to download CRS regression tests: %v", err)
+			}
+			if extracted == 0 {
+				return errors.New("failed to download CRS regression tests: no test files found")
+			}
+		}
+	}
+
+	env := map[string]string{
+		"FTW_TESTS_DIR": dir,
+		"FTW_INCLUDE":   os.Getenv("FTW_INCLUDE"),
+	}
+	return sh.RunWithV(env, "go", "test", "-count=1", "-run", "^TestFTW$", ".")
+}
+
+// Soak runs the memory soak test on build/main.wasm in wazero, failing when the memory grows after
+// warm-up. WASM_SOAK overrides the number of transactions, and building with MEMSTATS=true also
+// checks the heap. See TestWasmSoak for the other settings.
+func Soak() error {
+	n := os.Getenv("WASM_SOAK")
+	if n == "" {
+		n = defaultSoakTransactions
+	}
+	env := map[string]string{"WASM_SOAK": n}
+	return sh.RunWithV(env, "go", "test", "-count=1", "-timeout=0", "-v", "-run", "^TestWasmSoak$", ".")
+}
+
+// downloadTarGz extracts the regular files of a gzipped tar archive, writing each one to the path
+// returned by dest for the slash separated parts of its name, or skipping it when dest returns "".
+// Entries with absolute names or ".." elements are rejected. It returns the number of files written.
+func downloadTarGz(url string, dest func(parts []string) string) (int, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %q", res.Status)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	extracted := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return extracted, err
+		}
+		parts := strings.Split(hdr.Name, "/")
+		if strings.HasPrefix(hdr.Name, "/") || filepath.IsAbs(hdr.Name) {
+			return extracted, fmt.Errorf("archive entry %q has an absolute name", hdr.Name)
+		}
+		for _, part := range parts {
+			if part == ".." {
+				return extracted, fmt.Errorf("archive entry %q escapes the destination", hdr.Name)
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		path := dest(parts)
+		if path == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return extracted, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return extracted, err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return extracted, err
+		}
+		extracted++
+	}
+	return extracted, nil
+}
+
 // RunExample spins up the test environment, access at http://localhost:8080. Requires docker-compose.
 func RunExample() error {
 	return sh.RunWithV(map[string]string{"ENVOY_IMAGE": os.Getenv("ENVOY_IMAGE")}, "docker-compose", "--file", "example/docker-compose.yml", "up", "-d", "envoy-logs")
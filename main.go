@@ -7,10 +7,12 @@ import (
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 
 	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/transformations"
 	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
 )
 
 func main() {
 	operators.Register()
+	transformations.Register()
 	proxywasm.SetVMContext(wasmplugin.NewVMContext())
 }
@@ -5,21 +5,40 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 
+	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/transformations"
 	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
 )
 
-func checkTXMetric(t *testing.T, host proxytest.HostEmulator, expectedCounter int) {
+func TestMain(m *testing.M) {
+	// Registers the same operators and transformations as main, for the go tests.
+	operators.Register()
+	transformations.Register()
+	os.Exit(m.Run())
+}
+
+// metricHost is implemented by the hosts running the plugin, to check its metrics.
+type metricHost interface {
+	GetCounterMetric(name string) (uint64, error)
+}
+
+func checkTXMetric(t *testing.T, host metricHost, expectedCounter int) {
 	t.Helper()
 	value, err := host.GetCounterMetric("waf_filter.tx.total")
 	require.NoError(t, err)
@@ -35,7 +54,420 @@ func requireEqualAction(t *testing.T, expected types.Action, actual types.Action
 	require.Equal(t, expected, actual, msg, actionName[expected], actionName[actual])
 }
 
+// lifecycleTest is a scenario of TestLifecycle, also run on the wasm binary by TestWasmLifecycle.
+type lifecycleTest struct {
+	name                                string
+	inlineRules                         string
+	requestHdrsAction                   types.Action
+	requestBodyAction                   types.Action
+	responseHdrsAction                  types.Action
+	responded403                        bool
+	responded413                        bool
+	respondedNullBody                   bool
+	expectResponseRejectSinceFirstChunk bool
+}
+
+var lifecycleTests = []lifecycleTest{
+	{
+		name:               "no rules",
+		inlineRules:        ``,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "url accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "url denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_URI \"@streq /hello?name=panda\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "method accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_METHOD \"@streq post\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "method denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_METHOD \"@streq get\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "protocol accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_PROTOCOL \"@streq http/2.0\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+	},
+	{
+		name: "protocol denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_PROTOCOL \"@streq http/1.1\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+	},
+	{
+		name: "request header name accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_HEADERS_NAMES \"@streq accept-encoding\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request header name denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_HEADERS_NAMES \"@streq user-agent\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "server name denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule SERVER_NAME \"@streq localhost\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request header value accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_HEADERS:user-agent \"@streq rusttest\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request header value denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule REQUEST_HEADERS:user-agent \"@streq gotest\" \"id:101,phase:1,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionPause,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"name=yogi\" \"id:101,phase:2,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body denied, end of body",
+		inlineRules: `
+		SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"name=pooh\" \"id:101,phase:2,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionPause,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body denied, start of body",
+		inlineRules: `
+		SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionPause,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body accepted, no request body access",
+		inlineRules: `
+	SecRuleEngine On\nSecRequestBodyAccess Off\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
+	`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body accepted, payload above process partial",
+		inlineRules: `
+	SecRuleEngine On\nSecRequestBodyAccess On\nSecRequestBodyLimit 2\nSecRequestBodyLimitAction ProcessPartial\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
+	`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "request body denied, above limits",
+		inlineRules: `
+		SecRuleEngine On\nSecRequestBodyAccess On\nSecRequestBodyLimit 2\nSecRequestBodyLimitAction Reject\nSecRule REQUEST_BODY \"name=yogi\" \"id:101,phase:2,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionPause,
+		responseHdrsAction: types.ActionContinue,
+		responded413:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "status accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_STATUS \"500\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "status denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_STATUS \"200\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionPause,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "status accepted rx",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_STATUS \"@rx [^\\d]+\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "status denied rx",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_STATUS \"@rx [\\d]+\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionPause,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response header name accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_HEADERS_NAMES \"@streq transfer-encoding\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response header name denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_HEADERS_NAMES \"@streq server\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionPause,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response header value accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_HEADERS:server \"@streq rusttest\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response header value denied",
+		inlineRules: `
+		SecRuleEngine On\nSecRule RESPONSE_HEADERS:server \"@streq gotest\" \"id:101,phase:3,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionPause,
+		responded403:       true,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response body accepted",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess On\nSecRule RESPONSE_BODY \"@contains pooh\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response body denied, end of body",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyMimeType text/plain\nSecRule RESPONSE_BODY \"@contains yogi\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  true,
+	},
+	{
+		name: "response body denied, start of body",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyMimeType text/plain\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  true,
+	},
+	{
+		name: "response body accepted, no response body access",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess Off\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response body accepted, payload above process partial",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyLimit 2\nSecResponseBodyLimitAction ProcessPartial\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:  types.ActionContinue,
+		requestBodyAction:  types.ActionContinue,
+		responseHdrsAction: types.ActionContinue,
+		responded403:       false,
+		respondedNullBody:  false,
+	},
+	{
+		name: "response body denied, above limits",
+		inlineRules: `
+		SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyLimit 2\nSecResponseBodyLimitAction Reject\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
+		`,
+		requestHdrsAction:                   types.ActionContinue,
+		requestBodyAction:                   types.ActionContinue,
+		responseHdrsAction:                  types.ActionContinue,
+		responded403:                        false, // proxy-wasm does not support it at phase 4
+		respondedNullBody:                   true,
+		expectResponseRejectSinceFirstChunk: true,
+	},
+}
+
+func (tt lifecycleTest) pluginConfiguration() string {
+	conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
+	if inlineRules := strings.TrimSpace(tt.inlineRules); inlineRules != "" {
+		conf = fmt.Sprintf(`{"directives_map": {"default": ["%s"]}, "default_directives": "default"}`, inlineRules)
+	}
+	return conf
+}
+
 func TestLifecycle(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range lifecycleTests {
+			tt := tc
+
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(tt.pluginConfiguration()))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				runLifecycle(t, host, tt, 1)
+			})
+		}
+	})
+}
+
+// lifecycleHost is the part of proxytest.HostEmulator driving a transaction.
+type lifecycleHost interface {
+	metricHost
+	InitializeHttpContext() uint32
+	SetProperty(path []string, data []byte) error
+	CallOnRequestHeaders(contextID uint32, headers [][2]string, endOfStream bool) types.Action
+	CallOnRequestBody(contextID uint32, body []byte, endOfStream bool) types.Action
+	CallOnResponseHeaders(contextID uint32, headers [][2]string, endOfStream bool) types.Action
+	CallOnResponseBody(contextID uint32, body []byte, endOfStream bool) types.Action
+	CompleteHttpContext(contextID uint32)
+	GetSentLocalResponse(contextID uint32) *proxytest.LocalHttpResponse
+	GetCurrentResponseBody(contextID uint32) []byte
+}
+
+// runLifecycle runs a transaction of the scenario on the started plugin, txs being the number
+// of transactions run by the plugin so far, this one included.
+func runLifecycle(t *testing.T, host lifecycleHost, tt lifecycleTest, txs int) {
+	t.Helper()
+
 	reqProtocol := "HTTP/1.1"
 	reqHdrs := [][2]string{
 		{":path", "/hello?name=panda"},
@@ -54,475 +486,91 @@ func TestLifecycle(t *testing.T) {
 	}
 	respBody := []byte(`Hello, yogi!`)
 
-	tests := []struct {
-		name                                string
-		inlineRules                         string
-		requestHdrsAction                   types.Action
-		requestBodyAction                   types.Action
-		responseHdrsAction                  types.Action
-		responded403                        bool
-		responded413                        bool
-		respondedNullBody                   bool
-		expectResponseRejectSinceFirstChunk bool
-	}{
-		{
-			name:               "no rules",
-			inlineRules:        ``,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "url accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "url denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_URI \"@streq /hello?name=panda\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "method accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_METHOD \"@streq post\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "method denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_METHOD \"@streq get\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "protocol accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_PROTOCOL \"@streq http/2.0\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-		},
-		{
-			name: "protocol denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_PROTOCOL \"@streq http/1.1\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-		},
-		{
-			name: "request header name accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_HEADERS_NAMES \"@streq accept-encoding\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request header name denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_HEADERS_NAMES \"@streq user-agent\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "server name denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule SERVER_NAME \"@streq localhost\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request header value accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_HEADERS:user-agent \"@streq rusttest\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request header value denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule REQUEST_HEADERS:user-agent \"@streq gotest\" \"id:101,phase:1,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionPause,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"name=yogi\" \"id:101,phase:2,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body denied, end of body",
-			inlineRules: `
-			SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"name=pooh\" \"id:101,phase:2,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionPause,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body denied, start of body",
-			inlineRules: `
-			SecRuleEngine On\nSecRequestBodyAccess On\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionPause,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body accepted, no request body access",
-			inlineRules: `
-		SecRuleEngine On\nSecRequestBodyAccess Off\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
-		`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body accepted, payload above process partial",
-			inlineRules: `
-		SecRuleEngine On\nSecRequestBodyAccess On\nSecRequestBodyLimit 2\nSecRequestBodyLimitAction ProcessPartial\nSecRule REQUEST_BODY \"animal=bear\" \"id:101,phase:2,t:lowercase,deny\"
-		`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "request body denied, above limits",
-			inlineRules: `
-			SecRuleEngine On\nSecRequestBodyAccess On\nSecRequestBodyLimit 2\nSecRequestBodyLimitAction Reject\nSecRule REQUEST_BODY \"name=yogi\" \"id:101,phase:2,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionPause,
-			responseHdrsAction: types.ActionContinue,
-			responded413:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "status accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_STATUS \"500\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "status denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_STATUS \"200\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionPause,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "status accepted rx",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_STATUS \"@rx [^\\d]+\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "status denied rx",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_STATUS \"@rx [\\d]+\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionPause,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response header name accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_HEADERS_NAMES \"@streq transfer-encoding\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response header name denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_HEADERS_NAMES \"@streq server\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionPause,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response header value accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_HEADERS:server \"@streq rusttest\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response header value denied",
-			inlineRules: `
-			SecRuleEngine On\nSecRule RESPONSE_HEADERS:server \"@streq gotest\" \"id:101,phase:3,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionPause,
-			responded403:       true,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response body accepted",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess On\nSecRule RESPONSE_BODY \"@contains pooh\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response body denied, end of body",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyMimeType text/plain\nSecRule RESPONSE_BODY \"@contains yogi\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  true,
-		},
-		{
-			name: "response body denied, start of body",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyMimeType text/plain\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  true,
-		},
-		{
-			name: "response body accepted, no response body access",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess Off\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response body accepted, payload above process partial",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyLimit 2\nSecResponseBodyLimitAction ProcessPartial\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:  types.ActionContinue,
-			requestBodyAction:  types.ActionContinue,
-			responseHdrsAction: types.ActionContinue,
-			responded403:       false,
-			respondedNullBody:  false,
-		},
-		{
-			name: "response body denied, above limits",
-			inlineRules: `
-			SecRuleEngine On\nSecResponseBodyAccess On\nSecResponseBodyLimit 2\nSecResponseBodyLimitAction Reject\nSecRule RESPONSE_BODY \"@contains hello\" \"id:101,phase:4,t:lowercase,deny\"
-			`,
-			requestHdrsAction:                   types.ActionContinue,
-			requestBodyAction:                   types.ActionContinue,
-			responseHdrsAction:                  types.ActionContinue,
-			responded403:                        false, // proxy-wasm does not support it at phase 4
-			respondedNullBody:                   true,
-			expectResponseRejectSinceFirstChunk: true,
-		},
-	}
-
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-
-			t.Run(tt.name, func(t *testing.T) {
-				conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
-				if inlineRules := strings.TrimSpace(tt.inlineRules); inlineRules != "" {
-					conf = fmt.Sprintf(`{"directives_map": {"default": ["%s"]}, "default_directives": "default"}`, inlineRules)
-				}
-				opt := proxytest.
-					NewEmulatorOption().
-					WithVMContext(vm).
-					WithPluginConfiguration([]byte(conf))
-
-				host, reset := proxytest.NewHostEmulator(opt)
-				defer reset()
-
-				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+	id := host.InitializeHttpContext()
 
-				id := host.InitializeHttpContext()
+	require.NoError(t, host.SetProperty([]string{"request", "protocol"}, []byte(reqProtocol)))
 
-				require.NoError(t, host.SetProperty([]string{"request", "protocol"}, []byte(reqProtocol)))
+	requestBodyAction := types.ActionPause
+	responseHdrsAction := types.ActionPause
 
-				requestBodyAction := types.ActionPause
-				responseHdrsAction := types.ActionPause
+	requestHdrsAction := host.CallOnRequestHeaders(id, reqHdrs, false)
+	require.Equal(t, tt.requestHdrsAction, requestHdrsAction)
 
-				requestHdrsAction := host.CallOnRequestHeaders(id, reqHdrs, false)
-				require.Equal(t, tt.requestHdrsAction, requestHdrsAction)
-
-				checkTXMetric(t, host, 1)
-
-				// Stream bodies in chunks of 5
-
-				if requestHdrsAction == types.ActionContinue {
-					for i := 0; i < len(reqBody); i += 5 {
-						eos := i+5 >= len(reqBody)
-						var body []byte
-						if eos {
-							body = reqBody[i:]
-						} else {
-							body = reqBody[i : i+5]
-						}
-						requestBodyAction = host.CallOnRequestBody(id, body, eos)
-						requestBodyAccess := strings.Contains(tt.inlineRules, "SecRequestBodyAccess On")
-						switch {
-						case eos:
-							requireEqualAction(t, tt.requestBodyAction, requestBodyAction, "unexpected body action, want %q, have %q on end of stream")
-						case requestBodyAccess:
-							requireEqualAction(t, types.ActionPause, requestBodyAction, "unexpected request body action, want %q, have %q")
-						default:
-							requireEqualAction(t, types.ActionContinue, requestBodyAction, "unexpected request body action, want %q, have %q")
-						}
-					}
-				}
+	checkTXMetric(t, host, txs)
 
-				if requestBodyAction == types.ActionContinue {
-					responseHdrsAction = host.CallOnResponseHeaders(id, respHdrs, false)
-					require.Equal(t, tt.responseHdrsAction, responseHdrsAction)
-				}
+	// Stream bodies in chunks of 5
 
-				if responseHdrsAction == types.ActionContinue {
-					responseBodyAccess := strings.Contains(tt.inlineRules, "SecResponseBodyAccess On")
-					for i := 0; i < len(respBody); i += 5 {
-						eos := i+5 >= len(respBody)
-						var body []byte
-						if eos {
-							body = respBody[i:]
-						} else {
-							body = respBody[i : i+5]
-						}
-						responseBodyAction := host.CallOnResponseBody(id, body, eos)
-						switch {
-						// expectResponseRejectLimitActionSinceFirstChunk: writing the first chunk (len(respBody) bytes), it is expected to reach
-						// the ResponseBodyLimit with the Action set to Reject. When these conditions happen, ActionContinue will be returned,
-						// with the interruption enforced replacing the body with null bytes (checked with tt.respondedNullBody)
-						case eos, tt.expectResponseRejectSinceFirstChunk:
-							requireEqualAction(t, types.ActionContinue, responseBodyAction, "unexpected response body action, want %q, have %q on end of stream")
-						case responseBodyAccess:
-							requireEqualAction(t, types.ActionPause, responseBodyAction, "unexpected response body action, want %q, have %q")
-						default:
-							requireEqualAction(t, types.ActionContinue, responseBodyAction, "unexpected response body action, want %q, have %q")
-						}
-					}
-				}
+	if requestHdrsAction == types.ActionContinue {
+		for i := 0; i < len(reqBody); i += 5 {
+			eos := i+5 >= len(reqBody)
+			var body []byte
+			if eos {
+				body = reqBody[i:]
+			} else {
+				body = reqBody[i : i+5]
+			}
+			requestBodyAction = host.CallOnRequestBody(id, body, eos)
+			requestBodyAccess := strings.Contains(tt.inlineRules, "SecRequestBodyAccess On")
+			switch {
+			case eos:
+				requireEqualAction(t, tt.requestBodyAction, requestBodyAction, "unexpected body action, want %q, have %q on end of stream")
+			case requestBodyAccess:
+				requireEqualAction(t, types.ActionPause, requestBodyAction, "unexpected request body action, want %q, have %q")
+			default:
+				requireEqualAction(t, types.ActionContinue, requestBodyAction, "unexpected request body action, want %q, have %q")
+			}
+		}
+	}
 
-				// Call OnHttpStreamDone.
-				host.CompleteHttpContext(id)
+	if requestBodyAction == types.ActionContinue {
+		responseHdrsAction = host.CallOnResponseHeaders(id, respHdrs, false)
+		require.Equal(t, tt.responseHdrsAction, responseHdrsAction)
+	}
 
-				pluginResp := host.GetSentLocalResponse(id)
-				switch {
-				case tt.responded403:
-					require.NotNil(t, pluginResp)
-					require.EqualValues(t, 403, pluginResp.StatusCode)
-				case tt.responded413:
-					require.NotNil(t, pluginResp)
-					require.EqualValues(t, 413, pluginResp.StatusCode)
-				default:
-					require.Nil(t, pluginResp)
-				}
-				if tt.respondedNullBody {
-					pluginBodyResp := host.GetCurrentResponseBody(id)
-					require.NotNil(t, pluginBodyResp)
-					require.EqualValues(t, bytes.Repeat([]byte("\x00"), len(pluginBodyResp)), pluginBodyResp)
-				}
-			})
+	if responseHdrsAction == types.ActionContinue {
+		responseBodyAccess := strings.Contains(tt.inlineRules, "SecResponseBodyAccess On")
+		for i := 0; i < len(respBody); i += 5 {
+			eos := i+5 >= len(respBody)
+			var body []byte
+			if eos {
+				body = respBody[i:]
+			} else {
+				body = respBody[i : i+5]
+			}
+			responseBodyAction := host.CallOnResponseBody(id, body, eos)
+			switch {
+			// expectResponseRejectLimitActionSinceFirstChunk: writing the first chunk (len(respBody) bytes), it is expected to reach
+			// the ResponseBodyLimit with the Action set to Reject. When these conditions happen, ActionContinue will be returned,
+			// with the interruption enforced replacing the body with null bytes (checked with tt.respondedNullBody)
+			case eos, tt.expectResponseRejectSinceFirstChunk:
+				requireEqualAction(t, types.ActionContinue, responseBodyAction, "unexpected response body action, want %q, have %q on end of stream")
+			case responseBodyAccess:
+				requireEqualAction(t, types.ActionPause, responseBodyAction, "unexpected response body action, want %q, have %q")
+			default:
+				requireEqualAction(t, types.ActionContinue, responseBodyAction, "unexpected response body action, want %q, have %q")
+			}
 		}
-	})
+	}
+
+	// Call OnHttpStreamDone.
+	host.CompleteHttpContext(id)
+
+	pluginResp := host.GetSentLocalResponse(id)
+	switch {
+	case tt.responded403:
+		require.NotNil(t, pluginResp)
+		require.EqualValues(t, 403, pluginResp.StatusCode)
+	case tt.responded413:
+		require.NotNil(t, pluginResp)
+		require.EqualValues(t, 413, pluginResp.StatusCode)
+	default:
+		require.Nil(t, pluginResp)
+	}
+	if tt.respondedNullBody {
+		pluginBodyResp := host.GetCurrentResponseBody(id)
+		require.NotNil(t, pluginBodyResp)
+		require.EqualValues(t, bytes.Repeat([]byte("\x00"), len(pluginBodyResp)), pluginBodyResp)
+	}
 }
 
 func TestBadConfig(t *testing.T) {
@@ -894,6 +942,1239 @@ SecRuleEngine On\nSecRule REQUEST_URI \"@streq /hello\" \"id:101,phase:4,t:lower
 	})
 }
 
+func TestTrailers(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/grpc.Service/Method"},
+		{":method", "POST"},
+		{":authority", "localhost"},
+		{"Content-Type", "application/x-www-form-urlencoded"},
+	}
+	reqTrailers := [][2]string{
+		{"X-Request-Checksum", "malicious"},
+	}
+	respHdrs := [][2]string{
+		{":status", "200"},
+		{"Content-Type", "application/grpc"},
+	}
+	respTrailers := [][2]string{
+		{"grpc-status", "13"},
+	}
+	reqBody := []byte(`animal=bear&food=honey`)
+	respBody := []byte(`Hello, yogi!`)
+	bodyAccessRules := `SecRuleEngine On\nSecRequestBodyAccess On\nSecResponseBodyAccess On\nSecResponseBodyMimeType application/grpc`
+
+	tests := []struct {
+		name                  string
+		rules                 string
+		requestTrailersAction types.Action
+		responded403          bool
+		respondedNullBody     bool
+	}{
+		{
+			name: "request trailer accepted",
+			rules: `
+SecRule REQUEST_HEADERS:X-Request-Checksum \"@streq valid\" \"id:101,phase:2,deny\"
+`,
+			requestTrailersAction: types.ActionContinue,
+		},
+		{
+			name: "request trailer denied",
+			rules: `
+SecRule REQUEST_HEADERS:X-Request-Checksum \"@streq malicious\" \"id:101,phase:2,deny\"
+`,
+			requestTrailersAction: types.ActionPause,
+			responded403:          true,
+		},
+		{
+			name: "request body ending with trailers denied",
+			rules: `
+SecRule ARGS_POST:food \"@streq honey\" \"id:101,phase:2,deny\"
+`,
+			requestTrailersAction: types.ActionPause,
+			responded403:          true,
+		},
+		{
+			name: "response trailer denied",
+			rules: `
+SecRule RESPONSE_HEADERS:grpc-status \"@streq 13\" \"id:101,phase:4,deny\"
+`,
+			requestTrailersAction: types.ActionContinue,
+			respondedNullBody:     true,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+					{"directives_map": {"default": ["%s\n%s"]}, "default_directives": "default"}
+				`, bodyAccessRules, strings.TrimSpace(tt.rules))
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+
+				action := host.CallOnRequestHeaders(id, reqHdrs, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				// The body never signals the end of stream, trailers do.
+				action = host.CallOnRequestBody(id, reqBody, false)
+				require.Equal(t, types.ActionPause, action)
+
+				action = host.CallOnRequestTrailers(id, reqTrailers)
+				require.Equal(t, tt.requestTrailersAction, action)
+
+				if action == types.ActionContinue {
+					action = host.CallOnResponseHeaders(id, respHdrs, false)
+					require.Equal(t, types.ActionContinue, action)
+
+					action = host.CallOnResponseBody(id, respBody, false)
+					require.Equal(t, types.ActionPause, action)
+
+					action = host.CallOnResponseTrailers(id, respTrailers)
+					require.Equal(t, types.ActionContinue, action)
+				}
+
+				// Call OnHttpStreamDone.
+				host.CompleteHttpContext(id)
+
+				pluginResp := host.GetSentLocalResponse(id)
+				if tt.responded403 {
+					require.NotNil(t, pluginResp)
+					require.EqualValues(t, 403, pluginResp.StatusCode)
+				} else {
+					require.Nil(t, pluginResp)
+				}
+
+				if tt.respondedNullBody {
+					pluginBodyResp := host.GetCurrentResponseBody(id)
+					require.EqualValues(t, bytes.Repeat([]byte("\x00"), len(respBody)), pluginBodyResp)
+				}
+			})
+		}
+	})
+}
+
+func TestPersistentCollections(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/login"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+	}
+	rules := `SecRuleEngine On\nSecAction \"id:100,phase:1,nolog,pass,initcol:ip=%{REMOTE_ADDR},setvar:ip.attempts=+1\"\nSecRule TX:ip.attempts \"@gt 2\" \"id:101,phase:1,deny\"`
+	conf := fmt.Sprintf(`{"directives_map": {"default": ["%s"]}, "default_directives": "default"}`, rules)
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for i, tc := range []struct {
+			address string
+			action  types.Action
+		}{
+			{address: "10.0.0.1:5000", action: types.ActionContinue},
+			{address: "10.0.0.1:5001", action: types.ActionContinue},
+			{address: "10.0.0.2:5000", action: types.ActionContinue},
+			{address: "10.0.0.1:5002", action: types.ActionPause},
+		} {
+			id := host.InitializeHttpContext()
+			require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(tc.address)))
+			action := host.CallOnRequestHeaders(id, reqHdrs, true)
+			require.Equal(t, tc.action, action, "unexpected action for request %d", i)
+			host.CompleteHttpContext(id)
+		}
+	})
+}
+
+func TestRateLimits(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/api"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"X-API-Key", "abc"},
+	}
+
+	tests := []struct {
+		name       string
+		conf       string
+		actions    []types.Action
+		statusCode uint32
+	}{
+		{
+			name: "deny",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On"]},
+				"default_directives": "default",
+				"rate_limits": [{"key": "remote_addr", "limit": 2, "window": "1h"}]
+			}`,
+			actions:    []types.Action{types.ActionContinue, types.ActionContinue, types.ActionPause},
+			statusCode: 429,
+		},
+		{
+			name: "detection only",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine DetectionOnly"]},
+				"default_directives": "default",
+				"rate_limits": [{"key": "remote_addr", "limit": 1, "window": "1h"}]
+			}`,
+			actions: []types.Action{types.ActionContinue, types.ActionContinue},
+		},
+		{
+			name: "log exposed to rules",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On\nSecRule TX:rate_limit_exceeded \"@eq 1\" \"id:101,phase:1,deny\""]},
+				"default_directives": "default",
+				"rate_limits": [{"key": "header:x-api-key", "limit": 1, "window": "1h", "action": "log"}]
+			}`,
+			actions:    []types.Action{types.ActionContinue, types.ActionPause},
+			statusCode: 403,
+		},
+		{
+			name: "remaining exposed to rules",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On\nSecRule TX:rate_limit_remaining \"@lt 2\" \"id:101,phase:1,deny\""]},
+				"default_directives": "default",
+				"rate_limits": [{"key": "header:x-api-key", "limit": 3, "window": "1h", "action": "log"}]
+			}`,
+			actions:    []types.Action{types.ActionContinue, types.ActionPause},
+			statusCode: 403,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(tt.conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				for i, expectedAction := range tt.actions {
+					id := host.InitializeHttpContext()
+					require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte("10.0.0.1:5000")))
+					action := host.CallOnRequestHeaders(id, reqHdrs, true)
+					require.Equal(t, expectedAction, action, "unexpected action for request %d", i)
+					host.CompleteHttpContext(id)
+
+					pluginResp := host.GetSentLocalResponse(id)
+					if expectedAction == types.ActionPause {
+						require.NotNil(t, pluginResp)
+						require.EqualValues(t, tt.statusCode, pluginResp.StatusCode)
+					} else {
+						require.Nil(t, pluginResp)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestBlocklist(t *testing.T) {
+	type request struct {
+		path       string
+		address    string
+		statusCode uint32
+	}
+
+	tests := []struct {
+		name     string
+		conf     string
+		queue    string
+		commands []string
+		requests []request
+		// infoLog is logged while handling the requests.
+		infoLog string
+	}{
+		{
+			name: "entries pushed through the queue",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On"]},
+				"default_directives": "default",
+				"blocklist": {}
+			}`,
+			queue:    "coraza.blocklist",
+			commands: []string{"add 10.0.0.1", "add 192.168.0.0/16 1h\nadd 2001:db8::/32"},
+			requests: []request{
+				{path: "/hello", address: "10.0.0.1:5000", statusCode: 403},
+				{path: "/hello", address: "10.0.0.2:5000"},
+				{path: "/hello", address: "192.168.10.1:5000", statusCode: 403},
+				{path: "/hello", address: "[2001:db8::1]:5000", statusCode: 403},
+			},
+		},
+		{
+			name: "entries removed through the queue",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On"]},
+				"default_directives": "default",
+				"blocklist": {"queue": "blocked_ips"}
+			}`,
+			queue:    "blocked_ips",
+			commands: []string{"add 10.0.0.0/24", "remove 10.0.0.0/24"},
+			requests: []request{
+				{path: "/hello", address: "10.0.0.1:5000"},
+			},
+		},
+		{
+			name: "entries added by rules",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine On\nSecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny,blocklist:10m\""]},
+				"default_directives": "default",
+				"blocklist": {}
+			}`,
+			requests: []request{
+				{path: "/hello", address: "10.0.0.1:5000"},
+				{path: "/admin", address: "10.0.0.1:5000", statusCode: 403},
+				{path: "/hello", address: "10.0.0.1:5000", statusCode: 403},
+				{path: "/hello", address: "10.0.0.2:5000"},
+			},
+		},
+		{
+			name: "detection only",
+			conf: `{
+				"directives_map": {"default": ["SecRuleEngine DetectionOnly\nSecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny,blocklist:10m\""]},
+				"default_directives": "default",
+				"blocklist": {}
+			}`,
+			queue:    "coraza.blocklist",
+			commands: []string{"add 10.0.0.1"},
+			requests: []request{
+				{path: "/hello", address: "10.0.0.1:5000"},
+				{path: "/admin", address: "10.0.0.2:5000"},
+				{path: "/hello", address: "10.0.0.2:5000"},
+			},
+			infoLog: "Blocklist not enforced, the rule engine is DetectionOnly",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(tt.conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				// Emulates a control plane sidecar pushing entries to the queue.
+				if len(tt.commands) > 0 {
+					queueID, err := proxywasm.RegisterSharedQueue(tt.queue)
+					require.NoError(t, err)
+					for _, c := range tt.commands {
+						require.NoError(t, proxywasm.EnqueueSharedQueue(queueID, []byte(c)))
+					}
+				}
+
+				for i, req := range tt.requests {
+					id := host.InitializeHttpContext()
+					require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(req.address)))
+					action := host.CallOnRequestHeaders(id, [][2]string{
+						{":path", req.path},
+						{":method", "GET"},
+						{":authority", "localhost"},
+					}, true)
+					host.CompleteHttpContext(id)
+
+					pluginResp := host.GetSentLocalResponse(id)
+					if req.statusCode == 0 {
+						require.Equal(t, types.ActionContinue, action, "unexpected action for request %d", i)
+						require.Nil(t, pluginResp)
+					} else {
+						require.Equal(t, types.ActionPause, action, "unexpected action for request %d", i)
+						require.NotNil(t, pluginResp)
+						require.EqualValues(t, req.statusCode, pluginResp.StatusCode)
+					}
+				}
+				if len(tt.infoLog) > 0 {
+					require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"), tt.infoLog)
+				}
+			})
+		}
+	})
+}
+
+func TestDirectivesSource(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": ["SecRuleEngine On"]},
+		"default_directives": "default",
+		"directives_source": {"cluster": "rules", "path": "/rules.conf", "refresh_period": "1ms"}
+	}`
+
+	adminRule := []byte(`SecRule REQUEST_URI "@streq /admin" "id:101,phase:1,deny"`)
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		requestAdmin := func(t *testing.T) types.Action {
+			t.Helper()
+			id := host.InitializeHttpContext()
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/admin"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			host.CompleteHttpContext(id)
+			return action
+		}
+
+		// lastCallout returns the latest HTTP call dispatched by the plugin.
+		lastCallout := func(t *testing.T) proxytest.HttpCalloutAttribute {
+			t.Helper()
+			callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+			require.NotEmpty(t, callouts)
+			return callouts[len(callouts)-1]
+		}
+
+		// refresh waits for the refresh period and returns the dispatched HTTP call.
+		refresh := func(t *testing.T) proxytest.HttpCalloutAttribute {
+			t.Helper()
+			calls := len(host.GetCalloutAttributesFromContext(proxytest.PluginContextID))
+			time.Sleep(2 * time.Millisecond)
+			host.Tick()
+			require.Len(t, host.GetCalloutAttributesFromContext(proxytest.PluginContextID), calls+1)
+			return lastCallout(t)
+		}
+
+		// Until fetched only inline directives are applied.
+		callout := lastCallout(t)
+		require.Equal(t, "rules", callout.Upstream)
+		require.Contains(t, callout.Headers, [2]string{":path", "/rules.conf"})
+		require.Equal(t, types.ActionContinue, requestAdmin(t))
+		require.Contains(t, strings.Join(host.GetWarnLogs(), "\n"), "only evaluated by the inline directives")
+
+		// No new call is dispatched while one is in flight.
+		time.Sleep(2 * time.Millisecond)
+		host.Tick()
+		require.Len(t, host.GetCalloutAttributesFromContext(proxytest.PluginContextID), 1)
+
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "200"}, {"etag", `"v1"`}}, nil, adminRule)
+		require.Equal(t, types.ActionPause, requestAdmin(t))
+
+		callout = refresh(t)
+		require.Contains(t, callout.Headers, [2]string{"if-none-match", `"v1"`})
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "304"}}, nil, nil)
+		require.Equal(t, types.ActionPause, requestAdmin(t))
+
+		// The last good directives are kept when the fetch fails or they do not compile.
+		callout = refresh(t)
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "503"}}, nil, nil)
+		require.Equal(t, types.ActionPause, requestAdmin(t))
+
+		callout = refresh(t)
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "200"}, {"etag", `"v2"`}}, nil, []byte("SecRule INVALID"))
+		require.Equal(t, types.ActionPause, requestAdmin(t))
+
+		callout = refresh(t)
+		require.Contains(t, callout.Headers, [2]string{"if-none-match", `"v1"`})
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "200"}, {"etag", `"v3"`}}, nil, []byte("# no rules"))
+		require.Equal(t, types.ActionContinue, requestAdmin(t))
+	})
+}
+
+func TestDirectivesSourceFailClosed(t *testing.T) {
+	conf := `{
+		"default_directives": "default",
+		"directives_source": {"cluster": "rules", "refresh_period": "1ms", "fail_closed": true}
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.Contains(t, strings.Join(host.GetWarnLogs(), "\n"), "rejecting their requests")
+
+		request := func() uint32 {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			host.CompleteHttpContext(id)
+			if resp := host.GetSentLocalResponse(id); resp != nil {
+				return resp.StatusCode
+			}
+			return 0
+		}
+
+		// Requests are rejected until the directives are fetched.
+		require.EqualValues(t, 503, request())
+
+		callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+		require.Len(t, callouts, 1)
+		host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "200"}}, nil, []byte("SecRuleEngine On"))
+		require.EqualValues(t, 0, request())
+	})
+}
+
+func TestDirectivesExtends(t *testing.T) {
+	conf := `{
+		"directives_map": {
+			"base": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,deny,status:403\""
+			],
+			"tenant": {"extends": "base", "directives": [
+				"SecRule REQUEST_URI \"@beginsWith /private\" \"id:201,phase:1,deny,status:401\""
+			]},
+			"alias": {"extends": "tenant"}
+		},
+		"default_directives": "base"
+	}`
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		logs := strings.Join(host.GetInfoLogs(), "\n")
+		require.Contains(t, logs, `Directives "tenant" extend "base", evaluated after its shared WAF`)
+		require.Contains(t, logs, `Directives "alias" only extend "tenant", sharing its WAF`)
+
+		request := func(authority, path string) uint32 {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", path},
+				{":method", "GET"},
+				{":authority", authority},
+			}, true)
+			host.CompleteHttpContext(id)
+			if resp := host.GetSentLocalResponse(id); resp != nil {
+				return resp.StatusCode
+			}
+			return 0
+		}
+
+		require.EqualValues(t, 403, request("base", "/admin"))
+		require.EqualValues(t, 0, request("base", "/private"))
+		for _, authority := range []string{"tenant", "alias"} {
+			require.EqualValues(t, 403, request(authority, "/admin"))
+			require.EqualValues(t, 401, request(authority, "/private"))
+			require.EqualValues(t, 0, request(authority, "/"))
+		}
+	})
+}
+
+func TestInlineFiles(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": ["SecRuleEngine On", "Include custom/*.conf"]},
+		"default_directives": "default",
+		"files": {
+			"custom/app.conf": "SecRule REQUEST_HEADERS:User-Agent \"@pmFromFile bad-ua.data\" \"id:101,phase:1,deny\"",
+			"custom/admin.conf": "SecRule REMOTE_ADDR \"@ipMatchFromFile admin-ips.data\" \"id:102,phase:1,pass,nolog,ctl:ruleRemoveById=103\"\nSecRule REQUEST_URI \"@beginsWith /admin\" \"id:103,phase:1,deny\"",
+			"custom/bad-ua.data": {"content": "Z3JhYmJlcgpuaWt0bw==", "encoding": "base64"},
+			"custom/admin-ips.data": "10.0.0.0/8"
+		}
+	}`
+
+	tests := []struct {
+		name      string
+		path      string
+		userAgent string
+		address   string
+		action    types.Action
+	}{
+		{name: "regular request", path: "/", userAgent: "Mozilla/5.0", address: "192.168.0.1:5000", action: types.ActionContinue},
+		{name: "user agent from base64 file", path: "/", userAgent: "Nikto/2.1.6", address: "192.168.0.1:5000", action: types.ActionPause},
+		{name: "admin from unknown address", path: "/admin", userAgent: "Mozilla/5.0", address: "192.168.0.1:5000", action: types.ActionPause},
+		{name: "admin from known address", path: "/admin", userAgent: "Mozilla/5.0", address: "10.0.0.1:5000", action: types.ActionContinue},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(tt.address)))
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"User-Agent", tt.userAgent},
+				}, true)
+				require.Equal(t, tt.action, action)
+			})
+		}
+	})
+}
+
+func TestCRSPlugins(t *testing.T) {
+	// The plugin is inlined, official plugins are embedded at build time.
+	conf := `{
+		"directives_map": {"default": ["Include @recommended-conf", "SecRuleEngine On", "Include @crs-setup-conf", "Include @owasp_crs/*.conf"]},
+		"default_directives": "default",
+		"crs_plugins": ["test"],
+		"files": {
+			"@crs-plugins/test-before.conf": "SecRule REQUEST_URI \"@streq /plugin\" \"id:9500001,phase:1,deny\"",
+			"@crs-plugins/test-after.conf": "SecRule TX:inbound_anomaly_score_pl1 \"@gt 0\" \"id:9500002,phase:1,deny\""
+		}
+	}`
+
+	tests := []struct {
+		name      string
+		path      string
+		userAgent string
+		action    types.Action
+	}{
+		{name: "regular request", path: "/", userAgent: "Mozilla/5.0", action: types.ActionContinue},
+		{name: "rule loaded before CRS", path: "/plugin", userAgent: "Mozilla/5.0", action: types.ActionPause},
+		// The score is only set when the rule is evaluated after the CRS ones.
+		{name: "rule loaded after CRS", path: "/", userAgent: "Grabber/0.1 (X11; U; Linux i686; en-US; rv:1.7)", action: types.ActionPause},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"User-Agent", tt.userAgent},
+					{"Accept", "text/html"},
+				}, true)
+				require.Equal(t, tt.action, action)
+			})
+		}
+	})
+}
+
+func TestCustomOperators(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRule REQUEST_HEADERS:Host \"@hostnameMatch *.internal.example.com\" \"id:101,phase:1,chain,deny\"",
+			"SecRule REMOTE_ADDR \"!@cidrMatchFromConfig internal\" \"t:none\"",
+			"SecRule REQUEST_URI \"@beginsWith /api\" \"id:102,phase:1,chain,deny\"",
+			"SecRule REQUEST_HEADERS:Authorization \"!@jwtVerify api\" \"t:none\""
+		]},
+		"default_directives": "default",
+		"operators": {
+			"jwt_keys": {"api": {"alg": "HS256", "key": "secret"}},
+			"cidr_lists": {"internal": ["10.0.0.0/8"]}
+		}
+	}`
+
+	sign := func(secret string) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user"}`))
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(header + "." + payload))
+		return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name          string
+		host          string
+		sourceAddress string
+		path          string
+		authorization string
+		action        types.Action
+	}{
+		{name: "public host", host: "www.example.com", sourceAddress: "1.2.3.4", path: "/", action: types.ActionContinue},
+		{name: "internal host from internal network", host: "app.internal.example.com", sourceAddress: "10.1.2.3", path: "/", action: types.ActionContinue},
+		{name: "internal host from public network", host: "app.internal.example.com:8080", sourceAddress: "1.2.3.4", path: "/", action: types.ActionPause},
+		{name: "api with valid token", host: "www.example.com", sourceAddress: "1.2.3.4", path: "/api", authorization: "Bearer " + sign("secret"), action: types.ActionContinue},
+		{name: "api with invalid token", host: "www.example.com", sourceAddress: "1.2.3.4", path: "/api", authorization: "Bearer " + sign("other"), action: types.ActionPause},
+		{name: "api without token", host: "www.example.com", sourceAddress: "1.2.3.4", path: "/api", action: types.ActionPause},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(tt.sourceAddress+":12345")))
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", tt.host},
+					{"Authorization", tt.authorization},
+				}, true)
+				require.Equal(t, tt.action, action)
+			})
+		}
+	})
+}
+
+func TestGeoLookup(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRule REMOTE_ADDR \"@geoLookup\" \"id:101,phase:1,chain,deny\"",
+			"SecRule GEO:COUNTRY_CODE \"!@within FR DE\" \"t:none\"",
+			"SecRule REMOTE_ADDR \"@geoLookup\" \"id:102,phase:1,chain,deny\"",
+			"SecRule GEO:ASN \"@streq 64496\" \"t:none\""
+		]},
+		"default_directives": "default",
+		"geoip": {"database": "geoip/countries.csv"},
+		"files": {
+			"geoip/countries.csv": "192.0.2.0/24,FR,EU\n198.51.100.0/24,US,NA\n203.0.113.0/24,DE,EU,AS64496"
+		}
+	}`
+
+	tests := []struct {
+		name    string
+		address string
+		action  types.Action
+	}{
+		{name: "allowed country", address: "192.0.2.1", action: types.ActionContinue},
+		{name: "blocked country", address: "198.51.100.1", action: types.ActionPause},
+		{name: "blocked ASN", address: "203.0.113.1", action: types.ActionPause},
+		{name: "unknown address", address: "10.0.0.1", action: types.ActionContinue},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(tt.address+":12345")))
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.action, action)
+			})
+		}
+	})
+
+	t.Run("missing database", func(t *testing.T) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(wasmplugin.NewVMContext()).
+			WithPluginConfiguration([]byte(`{"directives_map": {"default": ["SecRule REMOTE_ADDR \"@geoLookup\" \"id:101,phase:1,deny\""]}, "default_directives": "default"}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for i := 0; i < 2; i++ {
+			id := host.InitializeHttpContext()
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			require.Equal(t, types.ActionContinue, action)
+		}
+
+		var warnings int
+		for _, log := range host.GetWarnLogs() {
+			if strings.Contains(log, "no GeoIP database is configured") {
+				warnings++
+			}
+		}
+		require.Equal(t, 1, warnings)
+	})
+}
+
+func TestCustomTransformations(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRule REQUEST_HEADERS:Authorization \"@rx \\\"role\\\":\\\"admin\\\"\" \"id:101,phase:1,t:jwtPayload,t:jsonUnescape,deny\"",
+			"SecRule REQUEST_HEADERS:Host \"@streq bücher.example\" \"id:102,phase:1,t:punycodeDecode,deny\""
+		]},
+		"default_directives": "default"
+	}`
+
+	// The role is escaped in the payload, only matched once unescaped.
+	adminToken := "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"role":"\u0061dmin"}`)) + ".c2ln"
+	userToken := "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"role":"user"}`)) + ".c2ln"
+
+	tests := []struct {
+		name          string
+		host          string
+		authorization string
+		action        types.Action
+	}{
+		{name: "regular request", host: "example.com", authorization: userToken, action: types.ActionContinue},
+		{name: "escaped JWT claim", host: "example.com", authorization: adminToken, action: types.ActionPause},
+		{name: "punycode host", host: "xn--bcher-kva.example", authorization: userToken, action: types.ActionPause},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", tt.host},
+					{"Authorization", tt.authorization},
+				}, true)
+				require.Equal(t, tt.action, action)
+			})
+		}
+	})
+}
+
+func TestAnnotateUpstream(t *testing.T) {
+	directives := `[
+		"SecRuleEngine DetectionOnly",
+		"SecRequestBodyAccess On",
+		"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,pass,msg:'Admin access',setvar:tx.blocking_inbound_anomaly_score=+5\"",
+		"SecRule ARGS:q \"@contains attack\" \"id:102,phase:2,pass,msg:'Attack',setvar:tx.blocking_inbound_anomaly_score=+5\"",
+		"SecAction \"id:103,phase:2,pass,nolog,setvar:tx.checked=1\""
+	]`
+	conf := fmt.Sprintf(`{
+		"directives_map": {
+			"annotated": {"directives": %s, "annotate_upstream": true},
+			"plain": %s
+		},
+		"default_directives": "annotated"
+	}`, directives, directives)
+
+	tests := []struct {
+		name            string
+		authority       string
+		path            string
+		body            string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:            "no match",
+			authority:       "localhost",
+			path:            "/",
+			expectedHeaders: map[string]string{"x-waf-score": "0"},
+		},
+		{
+			name:            "request headers match",
+			authority:       "localhost",
+			path:            "/admin",
+			expectedHeaders: map[string]string{"x-waf-score": "5", "x-waf-matched-rules": "101"},
+		},
+		{
+			name:            "request body match",
+			authority:       "localhost",
+			path:            "/admin",
+			body:            "q=attack",
+			expectedHeaders: map[string]string{"x-waf-score": "10", "x-waf-matched-rules": "101,102"},
+		},
+		{
+			name:            "not annotated",
+			authority:       "plain",
+			path:            "/admin",
+			expectedHeaders: map[string]string{"x-waf-score": "spoofed", "x-waf-matched-rules": ""},
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				headers := [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", tt.authority},
+					{"x-waf-score", "spoofed"},
+				}
+				if len(tt.body) == 0 {
+					action := host.CallOnRequestHeaders(id, headers, true)
+					require.Equal(t, types.ActionContinue, action)
+				} else {
+					headers = append(headers, [2]string{"content-type", "application/x-www-form-urlencoded"})
+					action := host.CallOnRequestHeaders(id, headers, false)
+					// Headers are held until the body is processed.
+					require.Equal(t, types.ActionPause, action)
+					action = host.CallOnRequestBody(id, []byte(tt.body), true)
+					require.Equal(t, types.ActionContinue, action)
+				}
+
+				actual := map[string]string{}
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					if strings.HasPrefix(h[0], "x-waf-") {
+						actual[h[0]] = h[1]
+					}
+				}
+				for name, value := range tt.expectedHeaders {
+					if len(value) == 0 {
+						require.NotContains(t, actual, name)
+					} else {
+						require.Equal(t, value, actual[name])
+					}
+				}
+				if tt.authority != "plain" {
+					require.NotEmpty(t, actual["x-waf-transaction-id"])
+				} else {
+					require.NotContains(t, actual, "x-waf-transaction-id")
+				}
+			})
+		}
+	})
+}
+
+func TestResponseHeaders(t *testing.T) {
+	conf := `{
+		"directives_map": {"default": {
+			"directives": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,pass,nolog,setvar:'tx.resp_header_add_cache_control=no-store'\"",
+				"SecRule RESPONSE_HEADERS:X-Powered-By \"@rx .\" \"id:102,phase:3,pass,nolog,setvar:tx.resp_header_remove_x_powered_by=1\""
+			],
+			"response_headers": {
+				"add": {"X-Content-Type-Options": "nosniff"},
+				"remove": ["Server"]
+			}
+		}},
+		"default_directives": "default"
+	}`
+
+	tests := []struct {
+		name            string
+		path            string
+		expectedHeaders [][2]string
+	}{
+		{
+			name:            "static headers",
+			path:            "/",
+			expectedHeaders: [][2]string{{":status", "200"}, {"content-type", "text/html"}, {"x-content-type-options", "nosniff"}},
+		},
+		{
+			name:            "rule headers",
+			path:            "/admin",
+			expectedHeaders: [][2]string{{":status", "200"}, {"content-type", "text/html"}, {"x-content-type-options", "nosniff"}, {"cache-control", "no-store"}},
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/html"},
+					{"server", "nginx"},
+					{"x-powered-by", "PHP/8.2"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+				require.ElementsMatch(t, tt.expectedHeaders, host.GetCurrentResponseHeaders(id))
+			})
+		}
+	})
+}
+
+func TestDebugHeader(t *testing.T) {
+	directives := `[
+		"SecRuleEngine On",
+		"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,deny,status:403,msg:'Admin access'\""
+	]`
+	conf := fmt.Sprintf(`{
+		"directives_map": {
+			"debug": {"directives": %s, "debug_header": {"key": "secret", "max_age": "1m"}},
+			"plain": %s
+		},
+		"default_directives": "debug"
+	}`, directives, directives)
+
+	sign := func(key string, t time.Time, authority, path string) string {
+		ts := fmt.Sprint(t.Unix())
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(ts + "\nGET\n" + authority + "\n" + path))
+		return fmt.Sprintf("%s:%x", ts, mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name         string
+		authority    string
+		debugHeader  string
+		interrupted  bool
+		matchedRules string
+	}{
+		{
+			name:         "signed",
+			authority:    "localhost",
+			debugHeader:  sign("secret", time.Now(), "localhost", "/admin"),
+			matchedRules: "101",
+		},
+		{
+			name:        "unsigned",
+			authority:   "localhost",
+			debugHeader: fmt.Sprint(time.Now().Unix()),
+			interrupted: true,
+		},
+		{
+			name:        "other key",
+			authority:   "localhost",
+			debugHeader: sign("other", time.Now(), "localhost", "/admin"),
+			interrupted: true,
+		},
+		{
+			name:        "expired",
+			authority:   "localhost",
+			debugHeader: sign("secret", time.Now().Add(-time.Hour), "localhost", "/admin"),
+			interrupted: true,
+		},
+		{
+			name:        "other path",
+			authority:   "localhost",
+			debugHeader: sign("secret", time.Now(), "localhost", "/"),
+			interrupted: true,
+		},
+		{
+			name:        "not enabled",
+			authority:   "plain",
+			debugHeader: sign("secret", time.Now(), "plain", "/admin"),
+			interrupted: true,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", tt.authority},
+					{"x-coraza-debug", tt.debugHeader},
+				}, true)
+
+				if tt.interrupted {
+					require.Equal(t, types.ActionPause, action)
+					require.EqualValues(t, 403, host.GetSentLocalResponse(id).StatusCode)
+					return
+				}
+				require.Equal(t, types.ActionContinue, action)
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					require.NotEqual(t, "x-coraza-debug", h[0], "debug header forwarded upstream")
+				}
+
+				action = host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, true)
+				require.Equal(t, types.ActionContinue, action)
+				require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"x-coraza-debug-matched-rules", tt.matchedRules})
+				host.CompleteHttpContext(id)
+				require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"), "Debug header verified")
+				// The debug log level is raised for the transaction.
+				require.Contains(t, strings.Join(host.GetDebugLogs(), "\n"), "Rule matched")
+			})
+		}
+	})
+
+	t.Run("rate limit not enforced", func(t *testing.T) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(wasmplugin.NewVMContext()).
+			WithPluginConfiguration([]byte(`{
+				"directives_map": {"debug": {"directives": ["SecRuleEngine On"], "debug_header": {"key": "secret"}}},
+				"default_directives": "debug",
+				"rate_limits": [{"key": "remote_addr", "limit": 1, "window": "1h"}]
+			}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for i := 0; i < 2; i++ {
+			id := host.InitializeHttpContext()
+			require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte("10.0.0.1:5000")))
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+				{"x-coraza-debug", sign("secret", time.Now(), "localhost", "/")},
+			}, true)
+			require.Equal(t, types.ActionContinue, action, "unexpected action for request %d", i)
+		}
+		require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"), "Rate limit not enforced")
+	})
+
+	t.Run("extending directives", func(t *testing.T) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(wasmplugin.NewVMContext()).
+			WithPluginConfiguration([]byte(`{
+				"directives_map": {
+					"base": ["SecRuleEngine On", "SecRule REQUEST_URI \"@beginsWith /admin\" \"id:101,phase:1,deny,status:403,msg:'Admin access'\""],
+					"tenant": {
+						"extends": "base",
+						"directives": ["SecRule REQUEST_URI \"@beginsWith /private\" \"id:201,phase:1,deny,status:401,msg:'Private access'\""],
+						"debug_header": {"key": "secret"}
+					}
+				},
+				"default_directives": "tenant"
+			}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		// Both the base and the extending directives switch to DetectionOnly.
+		for path, matchedRules := range map[string]string{"/admin": "101", "/private": "201"} {
+			id := host.InitializeHttpContext()
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", path},
+				{":method", "GET"},
+				{":authority", "localhost"},
+				{"x-coraza-debug", sign("secret", time.Now(), "localhost", path)},
+			}, true)
+			require.Equal(t, types.ActionContinue, action, "unexpected action for %s", path)
+			host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, true)
+			require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"x-coraza-debug-matched-rules", matchedRules})
+			host.CompleteHttpContext(id)
+		}
+	})
+
+	t.Run("rule id collision", func(t *testing.T) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(wasmplugin.NewVMContext()).
+			WithPluginConfiguration([]byte(`{
+				"directives_map": {"debug": {
+					"directives": ["SecRuleEngine On", "SecAction \"id:99999990,phase:1,pass,nolog\""],
+					"debug_header": {"key": "secret"}
+				}},
+				"default_directives": "debug"
+			}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+	})
+}
+
 func TestRetrieveAddressInfo(t *testing.T) {
 	var unsetPort = -1
 	reqHdrs := [][2]string{
@@ -0,0 +1,299 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tetratelabs/wazero"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/wasmhost"
+)
+
+const (
+	// wasmLifecycleRuns is the number of transactions run by TestWasmLifecycle for each scenario.
+	wasmLifecycleRuns = 20
+	// wasmMaxGrowthPages is the number of pages, of 64KiB, the memory can grow by after the first
+	// transaction of a scenario.
+	wasmMaxGrowthPages = 64
+)
+
+// readWasm reads the binary built by mage build, or the one of WASM_PATH, skipping the test
+// when it is missing.
+func readWasm(t *testing.T) []byte {
+	t.Helper()
+	path := os.Getenv("WASM_PATH")
+	if path == "" {
+		path = filepath.Join("build", "main.wasm")
+	}
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		t.Skipf("wasm not found: %v", err)
+	}
+	return wasm
+}
+
+// newWasmHost starts a wazero host running the binary, failing the test when the binary traps
+// or calls host functions the host doesn't implement.
+func newWasmHost(t *testing.T, wasm []byte, cache wazero.CompilationCache, pluginConfiguration string) *wasmhost.Host {
+	t.Helper()
+	host, err := wasmhost.New(context.Background(), wasm, wasmhost.Config{
+		PluginConfiguration: []byte(pluginConfiguration),
+		Stdout:              os.Stderr,
+		Stderr:              os.Stderr,
+		CompilationCache:    cache,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := host.Err(); err != nil {
+			t.Errorf("wasm trapped: %v", err)
+		}
+		if calls := host.Unimplemented(); len(calls) > 0 {
+			t.Errorf("wasm called unimplemented host functions: %v", calls)
+		}
+		host.Close()
+	})
+	return host
+}
+
+// TestWasmLifecycle runs the scenarios of TestLifecycle on the binary built by TinyGo, under
+// a wazero host rather than proxytest, to catch crashes of the TinyGo runtime, memory growth
+// and mismatches with the proxy-wasm ABI.
+func TestWasmLifecycle(t *testing.T) {
+	wasm := readWasm(t)
+	cache := wazero.NewCompilationCache()
+	defer cache.Close(context.Background())
+
+	for _, tc := range lifecycleTests {
+		tt := tc
+
+		t.Run(tt.name, func(t *testing.T) {
+			host := newWasmHost(t, wasm, cache, tt.pluginConfiguration())
+			require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+			runLifecycle(t, host, tt, 1)
+			pages := host.MemoryPages()
+			for i := 2; i <= wasmLifecycleRuns; i++ {
+				runLifecycle(t, host, tt, i)
+			}
+			require.LessOrEqual(t, host.MemoryPages()-pages, uint32(wasmMaxGrowthPages), "memory grew from %d pages", pages)
+		})
+	}
+}
+
+// demoDirectives are the directives of the example deployment, with the CRS in blocking mode
+// and response body access enabled.
+const demoDirectives = `{
+	"directives_map": {"default": ["Include @demo-conf", "Include @crs-setup-demo-conf", "Include @owasp_crs/*.conf"]},
+	"default_directives": "default"
+}`
+
+var memStatsRegex = regexp.MustCompile(`^Sys: (\d+), HeapSys: (\d+), HeapIdle: (\d+), HeapReleased: (\d+), TotalAlloc: (\d+)$`)
+
+// soakSample is the memory used by the filter after a number of transactions.
+type soakSample struct {
+	transactions int
+	memory       uint32
+	// sys and heapSys are the memstats of the last transaction, zero unless the filter is built
+	// with MEMSTATS=true.
+	sys, heapSys uint64
+}
+
+// TestWasmSoak runs WASM_SOAK transactions through the CRS on the built filter, sampling the
+// size of the linear memory and, when built with MEMSTATS=true, the memstats logged by the
+// filter. It fails when the memory, or the heap, grows by more than WASM_SOAK_MAX_GROWTH_MB,
+// 2 by default, after the first WASM_SOAK_WARMUP transactions, a tenth by default. Samples are
+// written as CSV to WASM_SOAK_SAMPLES, if set.
+func TestWasmSoak(t *testing.T) {
+	n := envInt(t, "WASM_SOAK", 0)
+	if n == 0 {
+		t.Skip("WASM_SOAK not set")
+	}
+	warmup := envInt(t, "WASM_SOAK_WARMUP", n/10)
+	maxGrowth := uint64(envInt(t, "WASM_SOAK_MAX_GROWTH_MB", 2)) << 20
+	require.Less(t, warmup, n, "warm-up must be shorter than the soak test")
+
+	host := newWasmHost(t, readWasm(t), nil, demoDirectives)
+	require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+	every := n / 100
+	if every == 0 {
+		every = 1
+	}
+	var samples []soakSample
+	baseline := soakSample{memory: host.MemorySize()}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 1; i <= n; i++ {
+		runSoakTransaction(host, rnd, i)
+		if host.Err() != nil {
+			t.Fatalf("wasm trapped at transaction %d", i)
+		}
+
+		if i == warmup || i%every == 0 || i == n {
+			sample := soakSample{transactions: i, memory: host.MemorySize()}
+			if logs := host.GetDebugLogs(); len(logs) > 0 {
+				for j := len(logs) - 1; j >= 0; j-- {
+					if m := memStatsRegex.FindStringSubmatch(logs[j]); m != nil {
+						sample.sys, _ = strconv.ParseUint(m[1], 10, 64)
+						sample.heapSys, _ = strconv.ParseUint(m[2], 10, 64)
+						break
+					}
+				}
+			}
+			samples = append(samples, sample)
+			if i == warmup {
+				baseline = sample
+			}
+		}
+		// Logs are only kept until the next sample, not to grow the memory of the test.
+		if i%every == 0 {
+			host.ResetLogs()
+		}
+	}
+
+	last := samples[len(samples)-1]
+	t.Logf("memory: %d bytes after %d transactions of warm-up, %d bytes after %d transactions", baseline.memory, warmup, last.memory, n)
+	if last.heapSys > 0 {
+		t.Logf("heap: %d bytes after %d transactions of warm-up, %d bytes after %d transactions", baseline.heapSys, warmup, last.heapSys, n)
+	}
+	if path := os.Getenv("WASM_SOAK_SAMPLES"); path != "" {
+		require.NoError(t, writeSoakSamples(path, samples))
+	}
+
+	require.LessOrEqual(t, uint64(last.memory-baseline.memory), maxGrowth, "linear memory grew after warm-up")
+	if last.heapSys > 0 && baseline.heapSys > 0 && last.heapSys > baseline.heapSys {
+		require.LessOrEqual(t, last.heapSys-baseline.heapSys, maxGrowth, "heap grew after warm-up")
+	}
+}
+
+// runSoakTransaction runs a transaction, picked by the iteration, with random bodies split in
+// random chunks, stopping when the filter interrupts it.
+func runSoakTransaction(host *wasmhost.Host, rnd *rand.Rand, i int) {
+	method, path := "GET", fmt.Sprintf("/soak/%d?page=%d", i, rnd.Intn(100))
+	contentType := ""
+	var reqBody []byte
+	switch i % 6 {
+	case 1:
+		method, contentType = "POST", "application/x-www-form-urlencoded"
+		reqBody = []byte(fmt.Sprintf("name=user%d&comment=%s", i, strings.Repeat("lorem ipsum ", rnd.Intn(1000))))
+	case 2:
+		method, contentType = "POST", "application/json"
+		reqBody = []byte(fmt.Sprintf(`{"id": %d, "items": [%s]}`, i, strings.TrimSuffix(strings.Repeat(`{"name": "item", "qty": 1},`, rnd.Intn(500)+1), ",")))
+	case 3:
+		path = fmt.Sprintf("/soak/%d?id=1'%%20or%%20'1'='1", i)
+	case 4:
+		method, contentType = "POST", "application/x-www-form-urlencoded"
+		reqBody = []byte("comment=<script>alert(document.cookie)</script>")
+	case 5:
+		method, contentType = "PUT", "application/octet-stream"
+		reqBody = make([]byte, rnd.Intn(64*1024))
+		rnd.Read(reqBody)
+	}
+
+	id := host.InitializeHttpContext()
+	_ = host.SetProperty([]string{"request", "protocol"}, []byte("HTTP/1.1"))
+	reqHdrs := [][2]string{
+		{":path", path},
+		{":method", method},
+		{":authority", "localhost"},
+		{"user-agent", "soak"},
+	}
+	if contentType != "" {
+		reqHdrs = append(reqHdrs, [2]string{"content-type", contentType}, [2]string{"content-length", strconv.Itoa(len(reqBody))})
+	}
+	defer func() {
+		host.CompleteHttpContext(id)
+		host.DeleteHttpContext(id)
+	}()
+
+	interrupted := func() bool { return host.GetSentLocalResponse(id) != nil }
+	host.CallOnRequestHeaders(id, reqHdrs, len(reqBody) == 0)
+	if interrupted() {
+		return
+	}
+	for _, chunk := range soakChunks(rnd, reqBody) {
+		host.CallOnRequestBody(id, chunk.data, chunk.eos)
+		if interrupted() {
+			return
+		}
+	}
+
+	respBody := []byte(fmt.Sprintf("<html><body>%s</body></html>", strings.Repeat("<p>hello</p>", rnd.Intn(2000))))
+	host.CallOnResponseHeaders(id, [][2]string{
+		{":status", "200"},
+		{"content-type", "text/html"},
+		{"content-length", strconv.Itoa(len(respBody))},
+	}, false)
+	if interrupted() {
+		return
+	}
+	for _, chunk := range soakChunks(rnd, respBody) {
+		host.CallOnResponseBody(id, chunk.data, chunk.eos)
+	}
+}
+
+type soakChunk struct {
+	data []byte
+	eos  bool
+}
+
+// soakChunks splits the body in up to 4 chunks of random sizes.
+func soakChunks(rnd *rand.Rand, body []byte) []soakChunk {
+	if len(body) == 0 {
+		return nil
+	}
+	var chunks []soakChunk
+	for len(body) > 0 {
+		size := len(body)
+		if len(chunks) < 3 {
+			size = rnd.Intn(len(body)) + 1
+		}
+		chunks = append(chunks, soakChunk{data: body[:size], eos: size == len(body)})
+		body = body[size:]
+	}
+	return chunks
+}
+
+func writeSoakSamples(path string, samples []soakSample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	_ = w.Write([]string{"transactions", "memory", "sys", "heap_sys"})
+	for _, s := range samples {
+		_ = w.Write([]string{
+			strconv.Itoa(s.transactions),
+			strconv.FormatUint(uint64(s.memory), 10),
+			strconv.FormatUint(s.sys, 10),
+			strconv.FormatUint(s.heapSys, 10),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func envInt(t *testing.T, name string, defaultValue int) int {
+	t.Helper()
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	require.NoError(t, err, "invalid %s", name)
+	return i
+}
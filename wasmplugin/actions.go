@@ -0,0 +1,363 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/collection"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/macro"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+func init() {
+	// Coraza ships initcol as a no-op and setvar only supports TX, these replacements
+	// back persistent collections (e.g. IP, SESSION) with the proxy-wasm shared data.
+	plugins.RegisterAction("initcol", newInitcol)
+	plugins.RegisterAction("setvar", newSetvar)
+	plugins.RegisterAction("blocklist", newBlocklistAction)
+}
+
+// initcolFn loads a persistent collection (e.g. initcol:ip=%{REMOTE_ADDR}) into TX, where
+// its values are available as TX:<collection>.<key>.
+type initcolFn struct {
+	collection string
+	key        macro.Macro
+}
+
+func newInitcol() plugintypes.Action {
+	return &initcolFn{}
+}
+
+func (a *initcolFn) Init(_ plugintypes.RuleMetadata, data string) error {
+	col, key, ok := strings.Cut(data, "=")
+	if !ok || len(key) == 0 {
+		return errors.New("invalid arguments, expected syntax {collection}={key}")
+	}
+
+	a.collection = strings.ToLower(col)
+	if _, ok := persistentCollections[a.collection]; !ok {
+		return errors.New("invalid arguments, expected collection GLOBAL, IP, RESOURCE, SESSION or USER")
+	}
+
+	m, err := macro.NewMacro(key)
+	if err != nil {
+		return err
+	}
+	a.key = m
+	return nil
+}
+
+func (a *initcolFn) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	if tx.ID() == summaryTransactionID {
+		return
+	}
+
+	key := a.key.Expand(tx)
+	if len(key) == 0 {
+		tx.DebugLogger().Debug().
+			Str("collection", a.collection).
+			Int("rule_id", r.ID()).
+			Msg("Skipping initcol, empty collection key")
+		return
+	}
+
+	values, isNew, err := collections.get(a.collection, key)
+	if err != nil {
+		tx.DebugLogger().Error().
+			Str("collection", a.collection).
+			Int("rule_id", r.ID()).
+			Err(err).
+			Msg("Failed to load persistent collection")
+		return
+	}
+
+	col := tx.Variables().TX()
+	col.Set(a.collection+".key", []string{key})
+	isNewValue := "0"
+	if isNew {
+		isNewValue = "1"
+	}
+	col.Set(a.collection+".is_new", []string{isNewValue})
+	for k, v := range values {
+		col.Set(a.collection+"."+k, v)
+	}
+}
+
+func (a *initcolFn) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// setvarFn replaces the Coraza setvar, keeping its behavior for TX and writing through
+// to the shared data for persistent collections previously loaded by initcol.
+type setvarFn struct {
+	collection string
+	key        macro.Macro
+	value      macro.Macro
+	isRemove   bool
+}
+
+func newSetvar() plugintypes.Action {
+	return &setvarFn{}
+}
+
+func (a *setvarFn) Init(_ plugintypes.RuleMetadata, data string) error {
+	if len(data) == 0 {
+		return errors.New("missing arguments")
+	}
+
+	if data[0] == '!' {
+		a.isRemove = true
+		data = data[1:]
+	}
+
+	key, val, valOk := strings.Cut(data, "=")
+	colKey, colVal, _ := strings.Cut(key, ".")
+	a.collection = strings.ToLower(colKey)
+	if _, ok := persistentCollections[a.collection]; !ok && a.collection != "tx" {
+		return errors.New("invalid arguments, expected collection TX, GLOBAL, IP, RESOURCE, SESSION or USER")
+	}
+	if strings.TrimSpace(colVal) == "" {
+		return errors.New("invalid arguments, expected syntax {collection}.{key}={value}")
+	}
+
+	var err error
+	if a.key, err = macro.NewMacro(colVal); err != nil {
+		return err
+	}
+
+	if valOk && len(val) > 0 {
+		if a.value, err = macro.NewMacro(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *setvarFn) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	key := strings.ToLower(a.key.Expand(tx))
+	value := ""
+	if a.value != nil {
+		value = a.value.Expand(tx)
+	}
+	tx.DebugLogger().Debug().
+		Str("var_key", key).
+		Str("var_value", value).
+		Int("rule_id", r.ID()).
+		Msg("Action evaluated")
+
+	if a.collection == "tx" {
+		a.evaluateTxCollection(r, tx, key, value)
+		return
+	}
+	if tx.ID() == summaryTransactionID {
+		return
+	}
+	a.evaluatePersistentCollection(r, tx, key, value)
+}
+
+func (a *setvarFn) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// evaluateTxCollection follows the Coraza setvar, as the CRS relies on its semantics.
+func (a *setvarFn) evaluateTxCollection(r plugintypes.RuleMetadata, tx plugintypes.TransactionState, key string, value string) {
+	col := tx.Variables().TX()
+	if a.isRemove {
+		col.Remove(key)
+		return
+	}
+
+	res := firstValue(col, key)
+	switch {
+	case len(value) == 0:
+		col.Set(key, []string{""})
+	case value[0] == '+':
+		sum := 0
+		if len(value) > 1 {
+			var err error
+			if sum, err = strconv.Atoi(value[1:]); err != nil {
+				tx.DebugLogger().Error().
+					Str("var_value", value).
+					Int("rule_id", r.ID()).
+					Err(err).
+					Msg("Invalid value")
+				return
+			}
+		}
+		val := 0
+		if res != "" {
+			var err error
+			if val, err = strconv.Atoi(res); err != nil {
+				tx.DebugLogger().Error().
+					Str("var_key", res).
+					Int("rule_id", r.ID()).
+					Err(err).
+					Msg("Invalid value")
+				return
+			}
+		}
+		col.Set(key, []string{strconv.Itoa(sum + val)})
+	case value[0] == '-':
+		// Decrementing an unset or non numeric variable is ignored.
+		me, _ := strconv.Atoi(value[1:])
+		txv, err := strconv.Atoi(res)
+		if err != nil {
+			return
+		}
+		col.Set(key, []string{strconv.Itoa(txv - me)})
+	default:
+		col.Set(key, []string{value})
+	}
+}
+
+func (a *setvarFn) evaluatePersistentCollection(r plugintypes.RuleMetadata, tx plugintypes.TransactionState, key string, value string) {
+	col := tx.Variables().TX()
+	colKey := firstValue(col, a.collection+".key")
+	if len(colKey) == 0 {
+		tx.DebugLogger().Error().
+			Str("collection", a.collection).
+			Int("rule_id", r.ID()).
+			Msg("Persistent collection not initialized, initcol is required before setvar")
+		return
+	}
+
+	var evalErr error
+	values, err := collections.update(a.collection, colKey, func(values url.Values) {
+		evalErr = nil
+		if a.isRemove {
+			values.Del(key)
+			return
+		}
+
+		res, err := setvarResult(values.Get(key), value)
+		if err != nil {
+			evalErr = err
+			return
+		}
+		values.Set(key, res)
+	})
+	if err == nil {
+		err = evalErr
+	}
+	if err != nil {
+		tx.DebugLogger().Error().
+			Str("collection", a.collection).
+			Str("var_key", key).
+			Str("var_value", value).
+			Int("rule_id", r.ID()).
+			Err(err).
+			Msg("Failed to update persistent collection")
+		return
+	}
+
+	// The stored value might have been updated by other transactions in the meantime.
+	txKey := a.collection + "." + key
+	if values.Has(key) {
+		col.Set(txKey, []string{values.Get(key)})
+	} else {
+		col.Remove(txKey)
+	}
+}
+
+// blocklistFn adds the client address to the blocklist (e.g. blocklist:10m), so that
+// its following requests are rejected before evaluating rules. Without a duration the
+// entry never expires.
+type blocklistFn struct {
+	ttl time.Duration
+}
+
+func newBlocklistAction() plugintypes.Action {
+	return &blocklistFn{}
+}
+
+func (a *blocklistFn) Init(_ plugintypes.RuleMetadata, data string) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	ttl, err := time.ParseDuration(data)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("invalid arguments, expected a positive duration")
+	}
+	a.ttl = ttl
+	return nil
+}
+
+func (a *blocklistFn) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	if tx.ID() == summaryTransactionID {
+		return
+	}
+
+	if activeBlocklist == nil {
+		tx.DebugLogger().Warn().
+			Int("rule_id", r.ID()).
+			Msg("Skipping blocklist, the blocklist is not configured")
+		return
+	}
+
+	remoteAddr := tx.Variables().RemoteAddr().Get()
+	if len(remoteAddr) == 0 {
+		tx.DebugLogger().Debug().
+			Int("rule_id", r.ID()).
+			Msg("Skipping blocklist, empty remote address")
+		return
+	}
+
+	command := blocklistCommandAdd + " " + strings.Trim(remoteAddr, "[]")
+	if a.ttl > 0 {
+		command += " " + a.ttl.String()
+	}
+	activeBlocklist.add(command)
+}
+
+func (a *blocklistFn) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// setvarResult computes the new value of a persistent variable following the setvar
+// syntax, where +N and -N respectively increment and decrement the current value, an
+// unset value counting as 0.
+func setvarResult(current, value string) (string, error) {
+	switch {
+	case len(value) == 0:
+		return "", nil
+	case value[0] == '+' || value[0] == '-':
+		delta := 0
+		if len(value) > 1 {
+			var err error
+			if delta, err = strconv.Atoi(value[1:]); err != nil {
+				return "", err
+			}
+		}
+		val := 0
+		if current != "" {
+			var err error
+			if val, err = strconv.Atoi(current); err != nil {
+				return "", err
+			}
+		}
+		if value[0] == '-' {
+			delta = -delta
+		}
+		return strconv.Itoa(val + delta), nil
+	default:
+		return value, nil
+	}
+}
+
+func firstValue(col collection.Keyed, key string) string {
+	if v := col.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strconv"
+	"strings"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+const (
+	annotationScoreHeader         = "x-waf-score"
+	annotationMatchedRulesHeader  = "x-waf-matched-rules"
+	annotationTransactionIDHeader = "x-waf-transaction-id"
+)
+
+var annotationHeaders = []string{annotationScoreHeader, annotationMatchedRulesHeader, annotationTransactionIDHeader}
+
+// anomalyScoreVariables are the TX variables holding the inbound anomaly score, from the
+// most to the least recent CRS versions.
+var anomalyScoreVariables = []string{"blocking_inbound_anomaly_score", "inbound_anomaly_score", "anomaly_score"}
+
+// stripUpstreamAnnotations removes the annotation headers sent by the client, so that the
+// upstream can trust them.
+func stripUpstreamAnnotations() {
+	for _, name := range annotationHeaders {
+		if err := proxywasm.RemoveHttpRequestHeader(name); err != nil {
+			proxywasm.LogWarnf("Failed to remove the %s request header: %v", name, err)
+		}
+	}
+}
+
+// annotateUpstreamRequest forwards the verdict of the WAF upstream in request headers: the
+// inbound anomaly score, the IDs of the matched rules with a message, and the transaction ID.
+func (ctx *httpContext) annotateUpstreamRequest() {
+	headers := [][2]string{
+		{annotationScoreHeader, strconv.Itoa(anomalyScore(ctx.tx))},
+		{annotationTransactionIDHeader, ctx.tx.ID()},
+	}
+	if ids := matchedRuleIDs(ctx.tx); len(ids) > 0 {
+		headers = append(headers, [2]string{annotationMatchedRulesHeader, ids})
+	}
+
+	for _, h := range headers {
+		if err := proxywasm.AddHttpRequestHeader(h[0], h[1]); err != nil {
+			ctx.logger.Error().Err(err).Str("header", h[0]).Msg("Failed to annotate the upstream request")
+		}
+	}
+}
+
+// anomalyScore returns the anomaly score of the transaction, summed over the layers of
+// directives extending others.
+func anomalyScore(tx ctypes.Transaction) int {
+	total := 0
+	for _, state := range transactionStates(tx) {
+		for _, name := range anomalyScoreVariables {
+			if values := state.Variables().TX().Get(name); len(values) > 0 {
+				if score, err := strconv.Atoi(values[0]); err == nil {
+					total += score
+					break
+				}
+			}
+		}
+	}
+	return total
+}
+
+// matchedRuleIDs returns the comma separated IDs of the matched rules with a message,
+// leaving out the ones only setting variables such as the CRS initialization.
+func matchedRuleIDs(tx ctypes.Transaction) string {
+	seen := map[int]bool{}
+	var ids []string
+	for _, mr := range tx.MatchedRules() {
+		id := mr.Rule().ID()
+		if len(mr.Message()) == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ",")
+}
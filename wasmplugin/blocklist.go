@@ -0,0 +1,484 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const (
+	defaultBlocklistQueue        = "coraza.blocklist"
+	defaultBlocklistSyncPeriod   = time.Second
+	blocklistSharedDataKeyPrefix = "coraza.blocklist."
+	blocklistShards              = 64
+	blocklistCommandAdd          = "add"
+	blocklistCommandRemove       = "remove"
+)
+
+// blocklistConfiguration configures the shared queue the blocklist entries are pushed to
+// and how often workers synchronize their tree with the shared data.
+type blocklistConfiguration struct {
+	enabled    bool
+	queue      string
+	syncPeriod time.Duration
+}
+
+// activeBlocklist is the blocklist updated by the blocklist action, nil when not configured.
+// Actions are registered globally, hence it is set on plugin start.
+var activeBlocklist *blocklist
+
+// blocklist holds the blocked addresses and networks of a worker. Entries are pushed
+// through a shared queue as lines of the form "add <ip|cidr> [ttl]" or "remove <ip|cidr>",
+// including by the blocklist action. The worker draining the queue stores the entries in
+// the shared data, spread over blocklistShards keys so that a command only rewrites the
+// entries of its shard, and every worker updates its tree with the shards that changed.
+type blocklist struct {
+	queueID uint32
+	tree    *ipTree
+	shards  [blocklistShards]blocklistShard
+	// pending are the commands of the blocklist action, pushed to the queue once the
+	// transaction is done.
+	pending []string
+	now     func() time.Time
+}
+
+// blocklistShard is a shard of the entries as of the last synchronization of a worker.
+type blocklistShard struct {
+	cas uint32
+	// entries map networks to their expiration time (unix seconds, 0 when they never expire).
+	entries map[string]int64
+}
+
+func newBlocklist(queueID uint32) *blocklist {
+	return &blocklist{
+		queueID: queueID,
+		tree:    newIPTree(),
+		now:     time.Now,
+	}
+}
+
+// blocked reports whether ip matches a non expired entry.
+func (b *blocklist) blocked(ip string) bool {
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	if addr == nil {
+		return false
+	}
+	return b.tree.contains(addr, b.now())
+}
+
+// blocklistInterruption returns the interruption rejecting a blocklisted client. As for rate
+// limits, it is only enforced when the rule engine is On, and not for debugged requests.
+func (ctx *httpContext) blocklistInterruption(remoteAddr string) *ctypes.Interruption {
+	ctx.logger.Info().
+		Str("remote_addr", remoteAddr).
+		Msg("Client blocklisted")
+	if ctx.debug {
+		ctx.logger.Info().Msg("Blocklist not enforced for a debugged request")
+		return nil
+	}
+
+	interruption := &ctypes.Interruption{
+		Action: "deny",
+		Status: defaultInterruptionStatusCode,
+	}
+	if !interrupt(ctx.tx, interruption) {
+		ctx.logger.Info().Msg("Blocklist not enforced, the rule engine is DetectionOnly")
+		return nil
+	}
+	return interruption
+}
+
+// add records a command of the blocklist action, see flush.
+func (b *blocklist) add(command string) {
+	b.pending = append(b.pending, command)
+}
+
+// flush pushes the pending commands to the queue in a single message, they are applied once
+// the queue is drained rather than rewriting the shared entries on every hit.
+func (b *blocklist) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	commands := strings.Join(b.pending, "\n")
+	b.pending = b.pending[:0]
+	return proxywasm.EnqueueSharedQueue(b.queueID, []byte(commands))
+}
+
+// drain consumes the pending commands of the queue and applies them.
+func (b *blocklist) drain() error {
+	var commands []string
+	for {
+		data, err := proxywasm.DequeueSharedQueue(b.queueID)
+		if err == types.ErrorStatusEmpty {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		commands = append(commands, strings.Split(string(data), "\n")...)
+	}
+
+	if len(commands) == 0 {
+		return nil
+	}
+
+	return b.apply(commands)
+}
+
+// apply updates the shards of the shared entries affected by commands and synchronizes
+// the tree of this worker, invalid commands are logged and skipped.
+func (b *blocklist) apply(commands []string) error {
+	now := b.now()
+	commandsByShard := map[int][]blocklistCommand{}
+	for _, line := range commands {
+		c, err := parseBlocklistCommand(line, now)
+		if err != nil {
+			proxywasm.LogWarnf("Ignoring blocklist command %q: %v", line, err)
+			continue
+		}
+		if len(c.network) == 0 {
+			continue
+		}
+		shard := blocklistShardOf(c.network)
+		commandsByShard[shard] = append(commandsByShard[shard], c)
+	}
+
+	for shard, commands := range commandsByShard {
+		err := updateSharedData(blocklistShardKey(shard), func(data []byte, found bool) ([]byte, error) {
+			entries := map[string]int64{}
+			if found {
+				entries = decodeBlocklistEntries(data)
+			}
+			for _, c := range commands {
+				c.apply(entries)
+			}
+			return encodeBlocklistEntries(entries, now), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.sync()
+}
+
+// sync updates the tree with the shards changed since the last synchronization.
+func (b *blocklist) sync() error {
+	for i := range b.shards {
+		data, cas, err := proxywasm.GetSharedData(blocklistShardKey(i))
+		if err == types.ErrorStatusNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		shard := &b.shards[i]
+		if cas == shard.cas {
+			continue
+		}
+
+		entries := decodeBlocklistEntries(data)
+		for network := range shard.entries {
+			if _, ok := entries[network]; ok {
+				continue
+			}
+			if _, ipNet, err := net.ParseCIDR(network); err == nil {
+				b.tree.remove(ipNet)
+			}
+		}
+		for network, expiresAt := range entries {
+			if previous, ok := shard.entries[network]; ok && previous == expiresAt {
+				continue
+			}
+			if _, ipNet, err := net.ParseCIDR(network); err == nil {
+				b.tree.insert(ipNet, expiresAt)
+			}
+		}
+		shard.entries = entries
+		shard.cas = cas
+	}
+	return nil
+}
+
+func blocklistShardKey(shard int) string {
+	return blocklistSharedDataKeyPrefix + strconv.Itoa(shard)
+}
+
+func blocklistShardOf(network string) int {
+	h := fnv.New32a()
+	h.Write([]byte(network))
+	return int(h.Sum32() % blocklistShards)
+}
+
+// blocklistCommand is a parsed add or remove command.
+type blocklistCommand struct {
+	remove  bool
+	network string
+	// expiresAt is the expiration time of the added network (unix seconds), 0 when it never expires.
+	expiresAt int64
+}
+
+func (c blocklistCommand) apply(entries map[string]int64) {
+	if c.remove {
+		delete(entries, c.network)
+		return
+	}
+	entries[c.network] = c.expiresAt
+}
+
+// parseBlocklistCommand parses a command, empty lines result in a command without network.
+func parseBlocklistCommand(line string, now time.Time) (blocklistCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return blocklistCommand{}, nil
+	}
+	if len(fields) < 2 {
+		return blocklistCommand{}, errors.New("missing address")
+	}
+
+	network, err := parseBlocklistNetwork(fields[1])
+	if err != nil {
+		return blocklistCommand{}, err
+	}
+
+	switch fields[0] {
+	case blocklistCommandAdd:
+		if len(fields) > 3 {
+			return blocklistCommand{}, errors.New("unexpected arguments")
+		}
+		c := blocklistCommand{network: network}
+		if len(fields) == 3 {
+			ttl, err := time.ParseDuration(fields[2])
+			if err != nil {
+				return blocklistCommand{}, err
+			}
+			if ttl <= 0 {
+				return blocklistCommand{}, errors.New("ttl must be positive")
+			}
+			c.expiresAt = now.Add(ttl).Unix()
+		}
+		return c, nil
+	case blocklistCommandRemove:
+		if len(fields) > 2 {
+			return blocklistCommand{}, errors.New("unexpected arguments")
+		}
+		return blocklistCommand{remove: true, network: network}, nil
+	default:
+		return blocklistCommand{}, fmt.Errorf("unknown command %q, expected %q or %q", fields[0], blocklistCommandAdd, blocklistCommandRemove)
+	}
+}
+
+// parseBlocklistNetwork normalizes an address or a network into its CIDR notation.
+func parseBlocklistNetwork(value string) (string, error) {
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", err
+		}
+		return ipNet.String(), nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// encodeBlocklistEntries serializes the non expired entries one per line, as the network
+// followed by its expiration time. The output is never empty, as expected by the shared data.
+func encodeBlocklistEntries(entries map[string]int64, now time.Time) []byte {
+	networks := make([]string, 0, len(entries))
+	for network, expiresAt := range entries {
+		if expiresAt != 0 && expiresAt <= now.Unix() {
+			continue
+		}
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+
+	var b bytes.Buffer
+	for _, network := range networks {
+		b.WriteString(network)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(entries[network], 10))
+		b.WriteByte('\n')
+	}
+	if b.Len() == 0 {
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// decodeBlocklistEntries parses the stored entries, skipping malformed lines.
+func decodeBlocklistEntries(data []byte) map[string]int64 {
+	entries := map[string]int64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		network, rawExpiresAt, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		expiresAt, err := strconv.ParseInt(rawExpiresAt, 10, 64)
+		if err != nil {
+			continue
+		}
+		entries[network] = expiresAt
+	}
+	return entries
+}
+
+// ipTree is a path compressed binary radix tree of IPv4 and IPv6 networks: nodes only exist
+// where a network ends or where networks diverge, each of them holding the bits of the path
+// from the root. Lookups visit at most one node per network the address belongs to, plus the
+// nodes where networks diverge, rather than one node per bit of the address.
+type ipTree struct {
+	v4 *ipTreeNode
+	v6 *ipTreeNode
+}
+
+type ipTreeNode struct {
+	// ip holds the bits of the path from the root, ones of them being significant.
+	ip       net.IP
+	ones     int
+	children [2]*ipTreeNode
+	// terminal is true when a network ends at this node.
+	terminal bool
+	// expiresAt is the expiration time of the network (unix seconds), 0 when it never expires.
+	expiresAt int64
+}
+
+func newIPTree() *ipTree {
+	return &ipTree{}
+}
+
+func (t *ipTree) root(ip net.IP) (**ipTreeNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+// insert adds a network, replacing the expiration time when it already exists.
+func (t *ipTree) insert(ipNet *net.IPNet, expiresAt int64) {
+	root, ip := t.root(ipNet.IP)
+	ones, _ := ipNet.Mask.Size()
+	*root = insertIPTreeNode(*root, ip, ones, expiresAt)
+}
+
+// remove deletes a network, merging the nodes that no longer split paths.
+func (t *ipTree) remove(ipNet *net.IPNet) {
+	root, ip := t.root(ipNet.IP)
+	ones, _ := ipNet.Mask.Size()
+	*root = removeIPTreeNode(*root, ip, ones)
+}
+
+// contains reports whether ip belongs to any network not expired at now.
+func (t *ipTree) contains(ip net.IP, now time.Time) bool {
+	root, ip := t.root(ip)
+	nowUnix := now.Unix()
+	node := *root
+	for node != nil && commonPrefixLen(node.ip, ip, node.ones) == node.ones {
+		if node.terminal && (node.expiresAt == 0 || node.expiresAt > nowUnix) {
+			return true
+		}
+		if node.ones == len(ip)*8 {
+			return false
+		}
+		node = node.children[ipBit(ip, node.ones)]
+	}
+	return false
+}
+
+func insertIPTreeNode(node *ipTreeNode, ip net.IP, ones int, expiresAt int64) *ipTreeNode {
+	if node == nil {
+		return &ipTreeNode{ip: ip, ones: ones, terminal: true, expiresAt: expiresAt}
+	}
+
+	common := commonPrefixLen(node.ip, ip, minPrefixLen(node.ones, ones))
+	switch {
+	case common == node.ones && common == ones:
+		node.terminal = true
+		node.expiresAt = expiresAt
+		return node
+	case common == node.ones:
+		bit := ipBit(ip, node.ones)
+		node.children[bit] = insertIPTreeNode(node.children[bit], ip, ones, expiresAt)
+		return node
+	case common == ones:
+		parent := &ipTreeNode{ip: ip, ones: ones, terminal: true, expiresAt: expiresAt}
+		parent.children[ipBit(node.ip, ones)] = node
+		return parent
+	default:
+		parent := &ipTreeNode{ip: ip.Mask(net.CIDRMask(common, len(ip)*8)), ones: common}
+		parent.children[ipBit(node.ip, common)] = node
+		parent.children[ipBit(ip, common)] = &ipTreeNode{ip: ip, ones: ones, terminal: true, expiresAt: expiresAt}
+		return parent
+	}
+}
+
+func removeIPTreeNode(node *ipTreeNode, ip net.IP, ones int) *ipTreeNode {
+	if node == nil || ones < node.ones || commonPrefixLen(node.ip, ip, node.ones) < node.ones {
+		return node
+	}
+
+	if ones > node.ones {
+		bit := ipBit(ip, node.ones)
+		node.children[bit] = removeIPTreeNode(node.children[bit], ip, ones)
+	} else {
+		node.terminal = false
+		node.expiresAt = 0
+	}
+
+	if node.terminal {
+		return node
+	}
+	switch {
+	case node.children[0] == nil:
+		return node.children[1]
+	case node.children[1] == nil:
+		return node.children[0]
+	}
+	return node
+}
+
+// commonPrefixLen returns the number of leading bits, up to max, a and b have in common.
+func commonPrefixLen(a, b net.IP, max int) int {
+	for i := 0; i < max; i += 8 {
+		if diff := a[i/8] ^ b[i/8]; diff != 0 {
+			if n := i + bits.LeadingZeros8(diff); n < max {
+				return n
+			}
+			return max
+		}
+	}
+	return max
+}
+
+func minPrefixLen(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func ipBit(ip net.IP, i int) byte {
+	return ip[i/8] >> (7 - uint(i%8)) & 1
+}
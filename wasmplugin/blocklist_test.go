@@ -0,0 +1,203 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func TestIPTree(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+
+	tree := newIPTree()
+	for network, expiresAt := range map[string]int64{
+		"10.0.0.0/8":     0,
+		"192.168.1.1/32": now.Add(time.Minute).Unix(),
+		"192.168.1.2/32": now.Add(-time.Minute).Unix(),
+		"2001:db8::/32":  0,
+	} {
+		_, ipNet, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		tree.insert(ipNet, expiresAt)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{ip: "10.1.2.3", blocked: true},
+		{ip: "11.0.0.1", blocked: false},
+		{ip: "192.168.1.1", blocked: true},
+		{ip: "192.168.1.2", blocked: false},
+		{ip: "192.168.1.3", blocked: false},
+		{ip: "::ffff:10.0.0.1", blocked: true},
+		{ip: "2001:db8::1", blocked: true},
+		{ip: "2001:db9::1", blocked: false},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.ip, func(t *testing.T) {
+			require.Equal(t, tt.blocked, tree.contains(net.ParseIP(tt.ip), now))
+		})
+	}
+
+	t.Run("entry expires", func(t *testing.T) {
+		require.False(t, tree.contains(net.ParseIP("192.168.1.1"), now.Add(time.Hour)))
+	})
+}
+
+func TestIPTreeRemove(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+	networks := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "10.1.2.4/32", "192.168.0.0/16"}
+
+	tree := newIPTree()
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		tree.insert(ipNet, 0)
+	}
+	// Nodes only exist where networks end or diverge, e.g. 10.1.2.3 and 10.1.2.4 share a node.
+	require.Equal(t, len(networks)+2, countIPTreeNodes(tree.v4))
+
+	remove := func(network string) {
+		t.Helper()
+		_, ipNet, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		tree.remove(ipNet)
+	}
+
+	remove("10.0.0.0/8")
+	require.False(t, tree.contains(net.ParseIP("10.2.0.1"), now))
+	require.True(t, tree.contains(net.ParseIP("10.1.0.1"), now))
+
+	remove("10.1.0.0/16")
+	require.False(t, tree.contains(net.ParseIP("10.1.0.1"), now))
+	require.True(t, tree.contains(net.ParseIP("10.1.2.3"), now))
+	require.True(t, tree.contains(net.ParseIP("10.1.2.4"), now))
+
+	// Removing a network not in the tree is a no-op.
+	remove("10.1.2.0/24")
+	require.True(t, tree.contains(net.ParseIP("10.1.2.3"), now))
+
+	remove("10.1.2.3/32")
+	remove("10.1.2.4/32")
+	remove("192.168.0.0/16")
+	require.Nil(t, tree.v4)
+}
+
+func countIPTreeNodes(node *ipTreeNode) int {
+	if node == nil {
+		return 0
+	}
+	return 1 + countIPTreeNodes(node.children[0]) + countIPTreeNodes(node.children[1])
+}
+
+func TestParseBlocklistCommand(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+
+	tests := []struct {
+		command   string
+		expected  map[string]int64
+		expectErr bool
+	}{
+		{command: "", expected: map[string]int64{"10.0.0.1/32": 0}},
+		{command: "add 10.0.0.2", expected: map[string]int64{"10.0.0.1/32": 0, "10.0.0.2/32": 0}},
+		{command: "add 10.0.0.0/8 1m", expected: map[string]int64{"10.0.0.1/32": 0, "10.0.0.0/8": now.Add(time.Minute).Unix()}},
+		{command: "add 10.1.2.3/8", expected: map[string]int64{"10.0.0.1/32": 0, "10.0.0.0/8": 0}},
+		{command: "add 2001:db8::1", expected: map[string]int64{"10.0.0.1/32": 0, "2001:db8::1/128": 0}},
+		{command: "remove 10.0.0.1", expected: map[string]int64{}},
+		{command: "add", expectErr: true},
+		{command: "add not-an-ip", expectErr: true},
+		{command: "add 10.0.0.2 forever", expectErr: true},
+		{command: "add 10.0.0.2 -1m", expectErr: true},
+		{command: "remove 10.0.0.1 1m", expectErr: true},
+		{command: "block 10.0.0.2", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.command, func(t *testing.T) {
+			entries := map[string]int64{"10.0.0.1/32": 0}
+			c, err := parseBlocklistCommand(tt.command, now)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if len(c.network) > 0 {
+				c.apply(entries)
+			}
+			require.Equal(t, tt.expected, entries)
+		})
+	}
+}
+
+func TestBlocklistEntriesEncoding(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+
+	t.Run("expired entries are dropped", func(t *testing.T) {
+		data := encodeBlocklistEntries(map[string]int64{
+			"10.0.0.1/32": 0,
+			"10.0.0.2/32": now.Add(time.Minute).Unix(),
+			"10.0.0.3/32": now.Unix(),
+		}, now)
+		require.Equal(t, map[string]int64{
+			"10.0.0.1/32": 0,
+			"10.0.0.2/32": now.Add(time.Minute).Unix(),
+		}, decodeBlocklistEntries(data))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		data := encodeBlocklistEntries(map[string]int64{}, now)
+		require.NotEmpty(t, data)
+		require.Empty(t, decodeBlocklistEntries(data))
+	})
+}
+
+func TestBlocklistSync(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	queueID, err := proxywasm.RegisterSharedQueue(defaultBlocklistQueue)
+	require.NoError(t, err)
+
+	drainer := newBlocklist(queueID)
+	worker := newBlocklist(queueID)
+
+	require.NoError(t, proxywasm.EnqueueSharedQueue(queueID, []byte("add 10.0.0.1\nadd 192.168.0.0/16 1h")))
+	require.NoError(t, drainer.drain())
+	require.True(t, drainer.blocked("10.0.0.1"))
+	require.True(t, drainer.blocked("192.168.10.1"))
+
+	// Other workers pick up the entries on sync.
+	require.False(t, worker.blocked("10.0.0.1"))
+	require.NoError(t, worker.sync())
+	require.True(t, worker.blocked("10.0.0.1"))
+
+	require.NoError(t, proxywasm.EnqueueSharedQueue(queueID, []byte("remove 10.0.0.1")))
+	require.NoError(t, drainer.drain())
+	require.NoError(t, worker.sync())
+	require.False(t, worker.blocked("10.0.0.1"))
+	require.True(t, worker.blocked("192.168.10.1"))
+
+	// Commands only rewrite the shard of their network.
+	_, cas, err := proxywasm.GetSharedData(blocklistShardKey(blocklistShardOf("192.168.0.0/16")))
+	require.NoError(t, err)
+	drainer.add("add 10.0.0.2")
+	require.NoError(t, drainer.flush())
+	require.NoError(t, drainer.drain())
+	require.True(t, drainer.blocked("10.0.0.2"))
+	require.NotEqual(t, blocklistShardOf("10.0.0.2/32"), blocklistShardOf("192.168.0.0/16"))
+	_, unchangedCas, err := proxywasm.GetSharedData(blocklistShardKey(blocklistShardOf("192.168.0.0/16")))
+	require.NoError(t, err)
+	require.Equal(t, cas, unchangedCas)
+}
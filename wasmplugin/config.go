@@ -5,21 +5,57 @@ package wasmplugin
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
 )
 
 // pluginConfiguration is a type to represent an example configuration for this wasm plugin.
 type pluginConfiguration struct {
-	directivesMap          DirectivesMap
+	directivesMap DirectivesMap
+	// directivesExtends maps the directives extending others to the name of the ones they extend.
+	directivesExtends      map[string]string
 	metricLabels           map[string]string
 	defaultDirectives      string
 	perAuthorityDirectives map[string]string
+	persistence            persistenceConfiguration
+	rateLimits             []rateLimitConfiguration
+	blocklist              blocklistConfiguration
+	directivesSource       directivesSourceConfiguration
+	// files are served along with the embedded rules, keyed by path.
+	files      map[string][]byte
+	crsPlugins []string
+	operators  operators.Config
+	// directivesOptions are the options of the directives set along with them in directives_map.
+	directivesOptions map[string]directivesOptions
+	// geoIPDatabase is the path of the GeoIP database, looked up in the embedded and inlined files.
+	geoIPDatabase string
+}
+
+// persistenceConfiguration configures the collections persisted through initcol.
+type persistenceConfiguration struct {
+	ttl           time.Duration
+	maxRecordSize int
+	// maxRecords is the number of records of each collection.
+	maxRecords int
 }
 
 type DirectivesMap map[string][]string
 
+// directivesOptions configures how the requests evaluated by directives are handled.
+type directivesOptions struct {
+	// annotateUpstream forwards the verdict of the WAF upstream in request headers.
+	annotateUpstream bool
+	responseHeaders  responseHeadersConfiguration
+	debugHeader      debugHeaderConfiguration
+}
+
 func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfiguration, error) {
 	config := pluginConfiguration{}
 
@@ -34,12 +70,44 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 
 	jsonData := gjson.ParseBytes(data)
 	config.directivesMap = make(DirectivesMap)
+	var optionsErr error
 	jsonData.Get("directives_map").ForEach(func(key, value gjson.Result) bool {
 		directiveName := key.String()
 		if _, ok := config.directivesMap[directiveName]; ok {
 			return true
 		}
 
+		// Directives are either a list or an object reusing other directives,
+		// e.g. {"extends": "base", "directives": [...]}, along with their options.
+		if value.IsObject() {
+			if base := value.Get("extends"); base.Exists() {
+				if config.directivesExtends == nil {
+					config.directivesExtends = make(map[string]string)
+				}
+				config.directivesExtends[directiveName] = base.String()
+			}
+			options := directivesOptions{annotateUpstream: value.Get("annotate_upstream").Bool()}
+			responseHeaders, err := parseResponseHeadersConfiguration(value.Get("response_headers"))
+			if err != nil {
+				optionsErr = fmt.Errorf("invalid response headers of directive map %q: %v", directiveName, err)
+				return false
+			}
+			options.responseHeaders = responseHeaders
+			debugHeader, err := parseDebugHeaderConfiguration(value.Get("debug_header"))
+			if err != nil {
+				optionsErr = fmt.Errorf("invalid debug header of directive map %q: %v", directiveName, err)
+				return false
+			}
+			options.debugHeader = debugHeader
+			if options.annotateUpstream || !options.responseHeaders.empty() || options.debugHeader.enabled() {
+				if config.directivesOptions == nil {
+					config.directivesOptions = make(map[string]directivesOptions)
+				}
+				config.directivesOptions[directiveName] = options
+			}
+			value = value.Get("directives")
+		}
+
 		var directive []string
 		value.ForEach(func(_, value gjson.Result) bool {
 			directive = append(directive, value.String())
@@ -50,6 +118,87 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 		return true
 	})
 
+	if optionsErr != nil {
+		return config, optionsErr
+	}
+
+	if err := checkDirectivesInheritance(config.directivesMap, config.directivesExtends); err != nil {
+		return config, err
+	}
+
+	if source := jsonData.Get("directives_source"); source.Exists() {
+		config.directivesSource = directivesSourceConfiguration{
+			enabled:       true,
+			cluster:       source.Get("cluster").String(),
+			authority:     source.Get("authority").String(),
+			path:          defaultDirectivesSourcePath,
+			directives:    defaultDirectivesSourceName,
+			refreshPeriod: defaultDirectivesSourceRefreshPeriod,
+			timeout:       defaultDirectivesSourceTimeout,
+			failClosed:    source.Get("fail_closed").Bool(),
+		}
+		if len(config.directivesSource.authority) == 0 {
+			config.directivesSource.authority = config.directivesSource.cluster
+		}
+		if path := source.Get("path"); path.Exists() {
+			config.directivesSource.path = path.String()
+		}
+		if directives := source.Get("directives"); directives.Exists() {
+			config.directivesSource.directives = directives.String()
+		}
+		if refreshPeriod := source.Get("refresh_period"); refreshPeriod.Exists() {
+			d, err := time.ParseDuration(refreshPeriod.String())
+			if err != nil {
+				return config, fmt.Errorf("invalid directives source refresh period: %v", err)
+			}
+			config.directivesSource.refreshPeriod = d
+		}
+		if timeout := source.Get("timeout"); timeout.Exists() {
+			d, err := time.ParseDuration(timeout.String())
+			if err != nil {
+				return config, fmt.Errorf("invalid directives source timeout: %v", err)
+			}
+			config.directivesSource.timeout = d
+		}
+		if err := config.directivesSource.validate(); err != nil {
+			return config, fmt.Errorf("invalid directives source: %v", err)
+		}
+
+		// Until fetched, the directives only contain the inline ones, if any.
+		if _, ok := config.directivesMap[config.directivesSource.directives]; !ok {
+			config.directivesMap[config.directivesSource.directives] = nil
+		}
+	}
+
+	var filesErr error
+	jsonData.Get("files").ForEach(func(key, value gjson.Result) bool {
+		content, err := parseFileContent(value)
+		if err != nil {
+			filesErr = fmt.Errorf("invalid file %q: %v", key.String(), err)
+			return false
+		}
+		if config.files == nil {
+			config.files = make(map[string][]byte)
+		}
+		config.files[key.String()] = content
+		return true
+	})
+	if filesErr != nil {
+		return config, filesErr
+	}
+
+	for _, plugin := range jsonData.Get("crs_plugins").Array() {
+		config.crsPlugins = append(config.crsPlugins, plugin.String())
+	}
+
+	config.geoIPDatabase = jsonData.Get("geoip.database").String()
+
+	operatorsConfig, err := parseOperatorsConfiguration(jsonData.Get("operators"))
+	if err != nil {
+		return config, err
+	}
+	config.operators = operatorsConfig
+
 	config.metricLabels = make(map[string]string)
 	jsonData.Get("metric_labels").ForEach(func(key, value gjson.Result) bool {
 		config.metricLabels[key.String()] = value.String()
@@ -78,6 +227,69 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 		}
 	}
 
+	persistence := jsonData.Get("persistence")
+	if ttl := persistence.Get("ttl"); ttl.Exists() {
+		d, err := time.ParseDuration(ttl.String())
+		if err != nil {
+			return config, fmt.Errorf("invalid persistence ttl: %v", err)
+		}
+		config.persistence.ttl = d
+	}
+	config.persistence.maxRecordSize = int(persistence.Get("max_record_size").Int())
+	config.persistence.maxRecords = int(persistence.Get("max_records").Int())
+
+	for i, value := range jsonData.Get("rate_limits").Array() {
+		rl := rateLimitConfiguration{
+			name:    value.Get("name").String(),
+			key:     value.Get("key").String(),
+			limit:   int(value.Get("limit").Int()),
+			action:  rateLimitActionDeny,
+			buckets: defaultRateLimitBuckets,
+		}
+		if len(rl.name) == 0 {
+			rl.name = rl.key
+		}
+		if action := value.Get("action"); action.Exists() {
+			rl.action = action.String()
+		}
+		if buckets := value.Get("buckets"); buckets.Exists() {
+			rl.buckets = int(buckets.Int())
+		}
+		window, err := time.ParseDuration(value.Get("window").String())
+		if err != nil {
+			return config, fmt.Errorf("invalid rate limit %d window: %v", i, err)
+		}
+		rl.window = window
+		if err := rl.validate(); err != nil {
+			return config, fmt.Errorf("invalid rate limit %d: %v", i, err)
+		}
+		config.rateLimits = append(config.rateLimits, rl)
+	}
+
+	if blocklist := jsonData.Get("blocklist"); blocklist.Exists() {
+		config.blocklist = blocklistConfiguration{
+			enabled:    true,
+			queue:      defaultBlocklistQueue,
+			syncPeriod: defaultBlocklistSyncPeriod,
+		}
+		if queue := blocklist.Get("queue"); queue.Exists() {
+			config.blocklist.queue = queue.String()
+		}
+		if syncPeriod := blocklist.Get("sync_period"); syncPeriod.Exists() {
+			d, err := time.ParseDuration(syncPeriod.String())
+			if err != nil {
+				return config, fmt.Errorf("invalid blocklist sync period: %v", err)
+			}
+			if d < time.Millisecond {
+				return config, fmt.Errorf("invalid blocklist sync period: %v", d)
+			}
+			config.blocklist.syncPeriod = d
+		}
+		if len(config.blocklist.queue) == 0 {
+			return config, errors.New("empty blocklist queue")
+		}
+	}
+
 	if len(config.directivesMap) == 0 {
 		rules := jsonData.Get("rules")
 
@@ -97,3 +309,93 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 
 	return config, nil
 }
+
+// parseOperatorsConfiguration parses the keys and CIDR lists referenced by the project
+// specific operators, e.g.
+// {"jwt_keys": {"auth": {"alg": "HS256", "key": "..."}}, "cidr_lists": {"internal": ["10.0.0.0/8"]}}.
+// Keys are given like files, either as a string or with their encoding.
+func parseOperatorsConfiguration(value gjson.Result) (operators.Config, error) {
+	config := operators.Config{}
+	var err error
+
+	value.Get("jwt_keys").ForEach(func(name, value gjson.Result) bool {
+		key, parseErr := parseFileContent(value.Get("key"))
+		if parseErr == nil {
+			var jwtKey operators.JWTKey
+			if jwtKey, parseErr = operators.NewJWTKey(value.Get("alg").String(), key); parseErr == nil {
+				if config.JWTKeys == nil {
+					config.JWTKeys = make(map[string]operators.JWTKey)
+				}
+				config.JWTKeys[name.String()] = jwtKey
+				return true
+			}
+		}
+		err = fmt.Errorf("invalid JWT key %q: %v", name.String(), parseErr)
+		return false
+	})
+	if err != nil {
+		return config, err
+	}
+
+	value.Get("cidr_lists").ForEach(func(name, value gjson.Result) bool {
+		var cidrs []string
+		for _, cidr := range value.Array() {
+			cidrs = append(cidrs, cidr.String())
+		}
+		networks, parseErr := operators.ParseCIDRList(cidrs)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid CIDR list %q: %v", name.String(), parseErr)
+			return false
+		}
+		if config.CIDRLists == nil {
+			config.CIDRLists = make(map[string][]*net.IPNet)
+		}
+		config.CIDRLists[name.String()] = networks
+		return true
+	})
+	return config, err
+}
+
+// parseFileContent returns the content of a file, given either as a string or as an
+// object with its content and encoding (e.g. {"content": "...", "encoding": "base64"}).
+func parseFileContent(value gjson.Result) ([]byte, error) {
+	if value.Type == gjson.String {
+		return []byte(value.String()), nil
+	}
+
+	if !value.IsObject() {
+		return nil, errors.New("expected a string or an object")
+	}
+
+	content := value.Get("content").String()
+	switch encoding := value.Get("encoding").String(); encoding {
+	case "":
+		return []byte(content), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(content)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// checkDirectivesInheritance checks that directives only extend known directives, without cycles.
+func checkDirectivesInheritance(directivesMap DirectivesMap, extends map[string]string) error {
+	for name := range extends {
+		visiting := map[string]bool{}
+		for current := name; ; {
+			base, ok := extends[current]
+			if !ok {
+				break
+			}
+			if visiting[current] {
+				return fmt.Errorf("directive map %q has an inheritance cycle", name)
+			}
+			if _, ok := directivesMap[base]; !ok {
+				return fmt.Errorf("directive map %q extends unknown directive map %q", current, base)
+			}
+			visiting[current] = true
+			current = base
+		}
+	}
+	return nil
+}
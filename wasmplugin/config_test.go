@@ -5,20 +5,35 @@ package wasmplugin
 
 import (
 	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/corazawaf/coraza/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
 )
 
-func TestParsePluginConfiguration(t *testing.T) {
-	testCases := []struct {
-		name         string
-		config       string
-		expectErr    error
-		expectConfig pluginConfiguration
-	}{
+func mustJWTKey(tb testing.TB, alg string, key string) operators.JWTKey {
+	tb.Helper()
+	jwtKey, err := operators.NewJWTKey(alg, []byte(key))
+	require.NoError(tb, err)
+	return jwtKey
+}
+
+type parsePluginConfigurationTest struct {
+	name         string
+	config       string
+	expectErr    error
+	expectConfig pluginConfiguration
+}
+
+// parsePluginConfigurationTests are the cases of TestParsePluginConfiguration, also seeding
+// FuzzParsePluginConfiguration.
+func parsePluginConfigurationTests(tb testing.TB) []parsePluginConfigurationTest {
+	return []parsePluginConfigurationTest{
 		{
 			name: "empty config",
 		},
@@ -226,9 +241,437 @@ func TestParsePluginConfiguration(t *testing.T) {
 				perAuthorityDirectives: map[string]string{},
 			},
 		},
+		{
+			name: "persistence",
+			config: `
+			{
+				"persistence": {"ttl": "10m", "max_record_size": 1024, "max_records": 100}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				persistence: persistenceConfiguration{
+					ttl:           10 * time.Minute,
+					maxRecordSize: 1024,
+					maxRecords:    100,
+				},
+			},
+		},
+		{
+			name: "invalid persistence ttl",
+			config: `
+			{
+				"persistence": {"ttl": "forever"}
+			}
+			`,
+			expectErr: errors.New("invalid persistence ttl: time: invalid duration \"forever\""),
+		},
+		{
+			name: "rate limits",
+			config: `
+			{
+				"rate_limits": [
+					{"key": "remote_addr", "limit": 100, "window": "1m"},
+					{"name": "api", "key": "header:x-api-key", "limit": 10, "window": "1s", "action": "log", "buckets": 1024}
+				]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				rateLimits: []rateLimitConfiguration{
+					{name: "remote_addr", key: "remote_addr", limit: 100, window: time.Minute, action: "deny", buckets: 65536},
+					{name: "api", key: "header:x-api-key", limit: 10, window: time.Second, action: "log", buckets: 1024},
+				},
+			},
+		},
+		{
+			name: "invalid rate limit",
+			config: `
+			{
+				"rate_limits": [{"key": "remote_addr", "limit": 0, "window": "1m"}]
+			}
+			`,
+			expectErr: errors.New("invalid rate limit 0: limit must be positive"),
+		},
+		{
+			name: "blocklist defaults",
+			config: `
+			{
+				"blocklist": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				blocklist: blocklistConfiguration{
+					enabled:    true,
+					queue:      "coraza.blocklist",
+					syncPeriod: time.Second,
+				},
+			},
+		},
+		{
+			name: "blocklist",
+			config: `
+			{
+				"blocklist": {"queue": "blocked_ips", "sync_period": "5s"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				blocklist: blocklistConfiguration{
+					enabled:    true,
+					queue:      "blocked_ips",
+					syncPeriod: 5 * time.Second,
+				},
+			},
+		},
+		{
+			name: "invalid blocklist sync period",
+			config: `
+			{
+				"blocklist": {"sync_period": "soon"}
+			}
+			`,
+			expectErr: errors.New("invalid blocklist sync period: time: invalid duration \"soon\""),
+		},
+		{
+			name: "directives source defaults",
+			config: `
+			{
+				"directives_source": {"cluster": "rules"},
+				"default_directives": "default"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": nil},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				directivesSource: directivesSourceConfiguration{
+					enabled:       true,
+					cluster:       "rules",
+					authority:     "rules",
+					path:          "/",
+					directives:    "default",
+					refreshPeriod: time.Minute,
+					timeout:       5 * time.Second,
+				},
+			},
+		},
+		{
+			name: "directives source",
+			config: `
+			{
+				"directives_map": {
+					"custom": ["SecRuleEngine On"]
+				},
+				"directives_source": {
+					"cluster": "rules",
+					"authority": "rules.internal",
+					"path": "/custom.conf",
+					"directives": "custom",
+					"refresh_period": "30s",
+					"timeout": "1s",
+					"fail_closed": true
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"custom": {"SecRuleEngine On"}},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				directivesSource: directivesSourceConfiguration{
+					enabled:       true,
+					cluster:       "rules",
+					authority:     "rules.internal",
+					path:          "/custom.conf",
+					directives:    "custom",
+					refreshPeriod: 30 * time.Second,
+					timeout:       time.Second,
+					failClosed:    true,
+				},
+			},
+		},
+		{
+			name: "invalid directives source",
+			config: `
+			{
+				"directives_source": {"path": "/rules.conf"}
+			}
+			`,
+			expectErr: errors.New("invalid directives source: missing cluster"),
+		},
+		{
+			name: "files",
+			config: `
+			{
+				"files": {
+					"custom/app.conf": "SecRuleEngine On",
+					"custom/bad-ua.data": {"content": "Z3JhYmJlcg==", "encoding": "base64"}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				files: map[string][]byte{
+					"custom/app.conf":    []byte("SecRuleEngine On"),
+					"custom/bad-ua.data": []byte("grabber"),
+				},
+			},
+		},
+		{
+			name: "invalid file encoding",
+			config: `
+			{
+				"files": {
+					"custom/bad-ua.data": {"content": "grabber", "encoding": "hex"}
+				}
+			}
+			`,
+			expectErr: errors.New("invalid file \"custom/bad-ua.data\": unsupported encoding \"hex\""),
+		},
+		{
+			name: "directives inheritance",
+			config: `
+			{
+				"directives_map": {
+					"base": ["SecRuleEngine On", "Include @owasp_crs/*.conf"],
+					"tenant1": {"extends": "base", "directives": ["SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]},
+					"tenant2": {"extends": "tenant1", "directives": ["SecRule REQUEST_URI \"@streq /private\" \"id:102,phase:1,deny\""]},
+					"standalone": {"directives": ["SecRuleEngine Off"]}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"base":       {"SecRuleEngine On", "Include @owasp_crs/*.conf"},
+					"tenant1":    {"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""},
+					"tenant2":    {"SecRule REQUEST_URI \"@streq /private\" \"id:102,phase:1,deny\""},
+					"standalone": {"SecRuleEngine Off"},
+				},
+				directivesExtends:      map[string]string{"tenant1": "base", "tenant2": "tenant1"},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+			},
+		},
+		{
+			name: "directives extending unknown directives",
+			config: `
+			{
+				"directives_map": {
+					"tenant": {"extends": "base", "directives": ["SecRuleEngine On"]}
+				}
+			}
+			`,
+			expectErr: errors.New("directive map \"tenant\" extends unknown directive map \"base\""),
+		},
+		{
+			name: "directives inheritance cycle",
+			config: `
+			{
+				"directives_map": {
+					"tenant": {"extends": "tenant", "directives": ["SecRuleEngine On"]}
+				}
+			}
+			`,
+			expectErr: errors.New("directive map \"tenant\" has an inheritance cycle"),
+		},
+		{
+			name: "crs plugins",
+			config: `
+			{
+				"crs_plugins": ["wordpress-rule-exclusions", "nextcloud-rule-exclusions"]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				crsPlugins:             []string{"wordpress-rule-exclusions", "nextcloud-rule-exclusions"},
+			},
+		},
+		{
+			name: "operators",
+			config: `
+			{
+				"operators": {
+					"jwt_keys": {"api": {"alg": "HS256", "key": {"content": "c2VjcmV0", "encoding": "base64"}}},
+					"cidr_lists": {"internal": ["10.0.0.0/8", "192.168.1.1"]}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				operators: operators.Config{
+					JWTKeys: map[string]operators.JWTKey{"api": mustJWTKey(tb, "HS256", "secret")},
+					CIDRLists: map[string][]*net.IPNet{"internal": {
+						{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+						{IP: net.IP{192, 168, 1, 1}, Mask: net.CIDRMask(32, 32)},
+					}},
+				},
+			},
+		},
+		{
+			name: "annotate upstream",
+			config: `
+			{
+				"directives_map": {
+					"annotated": {"directives": ["SecRuleEngine DetectionOnly"], "annotate_upstream": true},
+					"plain": ["SecRuleEngine DetectionOnly"]
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"annotated": []string{"SecRuleEngine DetectionOnly"},
+					"plain":     []string{"SecRuleEngine DetectionOnly"},
+				},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				directivesOptions:      map[string]directivesOptions{"annotated": {annotateUpstream: true}},
+			},
+		},
+		{
+			name: "response headers",
+			config: `
+			{
+				"directives_map": {
+					"default": {
+						"directives": ["SecRuleEngine On"],
+						"response_headers": {"add": {"X-Content-Type-Options": "nosniff"}, "remove": ["Server"]}
+					}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": []string{"SecRuleEngine On"}},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				directivesOptions: map[string]directivesOptions{"default": {responseHeaders: responseHeadersConfiguration{
+					add:    [][2]string{{"x-content-type-options", "nosniff"}},
+					remove: []string{"server"},
+				}}},
+			},
+		},
+		{
+			name: "debug header",
+			config: `
+			{
+				"directives_map": {
+					"default": {"directives": ["SecRuleEngine On"], "debug_header": {"key": "secret"}},
+					"custom": {
+						"directives": ["SecRuleEngine On"],
+						"debug_header": {"key": {"content": "c2VjcmV0", "encoding": "base64"}, "header": "X-Debug", "max_age": "1m", "rule_id": 1234}
+					}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": []string{"SecRuleEngine On"},
+					"custom":  []string{"SecRuleEngine On"},
+				},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				directivesOptions: map[string]directivesOptions{
+					"default": {debugHeader: debugHeaderConfiguration{name: "x-coraza-debug", key: []byte("secret"), maxAge: 5 * time.Minute, ruleID: 99999990}},
+					"custom":  {debugHeader: debugHeaderConfiguration{name: "x-debug", key: []byte("secret"), maxAge: time.Minute, ruleID: 1234}},
+				},
+			},
+		},
+		{
+			name: "debug header without key",
+			config: `
+			{
+				"directives_map": {
+					"default": {"directives": ["SecRuleEngine On"], "debug_header": {"max_age": "1m"}}
+				}
+			}
+			`,
+			expectErr: errors.New("invalid debug header of directive map \"default\": missing key"),
+		},
+		{
+			name: "invalid debug header max age",
+			config: `
+			{
+				"directives_map": {
+					"default": {"directives": ["SecRuleEngine On"], "debug_header": {"key": "secret", "max_age": "-1m"}}
+				}
+			}
+			`,
+			expectErr: errors.New("invalid debug header of directive map \"default\": invalid max age: -1m0s"),
+		},
+		{
+			name: "invalid debug header rule id",
+			config: `
+			{
+				"directives_map": {
+					"default": {"directives": ["SecRuleEngine On"], "debug_header": {"key": "secret", "rule_id": 0}}
+				}
+			}
+			`,
+			expectErr: errors.New("invalid debug header of directive map \"default\": invalid rule id: 0"),
+		},
+		{
+			name: "invalid response headers",
+			config: `
+			{
+				"directives_map": {
+					"default": {"directives": ["SecRuleEngine On"], "response_headers": {"add": {"X-Frame-Options": true}}}
+				}
+			}
+			`,
+			expectErr: errors.New("invalid response headers of directive map \"default\": invalid header \"X-Frame-Options\" to add"),
+		},
+		{
+			name: "geoip",
+			config: `
+			{
+				"geoip": {"database": "geoip/countries.csv"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				geoIPDatabase:          "geoip/countries.csv",
+			},
+		},
+		{
+			name: "invalid JWT key",
+			config: `
+			{
+				"operators": {"jwt_keys": {"api": {"alg": "none", "key": "secret"}}}
+			}
+			`,
+			expectErr: errors.New("invalid JWT key \"api\": unsupported algorithm \"none\", expected \"HS256\" or \"RS256\""),
+		},
+		{
+			name: "invalid CIDR list",
+			config: `
+			{
+				"operators": {"cidr_lists": {"internal": ["10.0.0.300"]}}
+			}
+			`,
+			expectErr: errors.New("invalid CIDR list \"internal\": invalid address \"10.0.0.300\""),
+		},
 	}
+}
 
-	for _, testCase := range testCases {
+func TestParsePluginConfiguration(t *testing.T) {
+	for _, testCase := range parsePluginConfigurationTests(t) {
 		t.Run(testCase.name, func(t *testing.T) {
 			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
 			assert.Equal(t, testCase.expectErr, err)
@@ -238,11 +681,59 @@ func TestParsePluginConfiguration(t *testing.T) {
 				assert.Equal(t, testCase.expectConfig.metricLabels, cfg.metricLabels)
 				assert.Equal(t, testCase.expectConfig.defaultDirectives, cfg.defaultDirectives)
 				assert.Equal(t, testCase.expectConfig.perAuthorityDirectives, cfg.perAuthorityDirectives)
+				assert.Equal(t, testCase.expectConfig.persistence, cfg.persistence)
+				assert.Equal(t, testCase.expectConfig.rateLimits, cfg.rateLimits)
+				assert.Equal(t, testCase.expectConfig.blocklist, cfg.blocklist)
+				assert.Equal(t, testCase.expectConfig.directivesSource, cfg.directivesSource)
+				assert.Equal(t, testCase.expectConfig.files, cfg.files)
+				assert.Equal(t, testCase.expectConfig.crsPlugins, cfg.crsPlugins)
+				assert.Equal(t, testCase.expectConfig.operators, cfg.operators)
+				assert.Equal(t, testCase.expectConfig.geoIPDatabase, cfg.geoIPDatabase)
+				assert.Equal(t, testCase.expectConfig.directivesOptions, cfg.directivesOptions)
 			}
 		})
 	}
 }
 
+// FuzzParsePluginConfiguration checks that parsing never panics and that configurations parsed
+// without error are consistent, i.e. only reference existing directives.
+func FuzzParsePluginConfiguration(f *testing.F) {
+	for _, testCase := range parsePluginConfigurationTests(f) {
+		f.Add(testCase.config)
+	}
+	f.Add(`{"directives_map": {"a": {"extends": "b"}, "b": {"extends": "a"}}}`)
+	f.Add(`{"directives_map": {"a": {"extends": "a", "response_headers": {"add": {"x": 1}}}}, "default_directives": "a"}`)
+	f.Add(`{"directives_map": {"": []}, "default_directives": "", "per_authority_directives": {"": ""}}`)
+
+	f.Fuzz(func(t *testing.T, data string) {
+		config, err := parsePluginConfiguration([]byte(data), func(string) {})
+		if err != nil {
+			return
+		}
+
+		if len(config.defaultDirectives) > 0 {
+			require.Contains(t, config.directivesMap, config.defaultDirectives)
+		}
+		for authority, name := range config.perAuthorityDirectives {
+			require.Contains(t, config.directivesMap, name, "directives of authority %q", authority)
+		}
+		for name := range config.directivesOptions {
+			require.Contains(t, config.directivesMap, name)
+		}
+		for _, rl := range config.rateLimits {
+			require.NoError(t, rl.validate())
+		}
+		if config.directivesSource.enabled {
+			require.NoError(t, config.directivesSource.validate())
+			require.Contains(t, config.directivesMap, config.directivesSource.directives)
+		}
+		if config.blocklist.enabled {
+			require.NotEmpty(t, config.blocklist.queue)
+			require.GreaterOrEqual(t, config.blocklist.syncPeriod, time.Millisecond)
+		}
+	})
+}
+
 func TestWAFMap(t *testing.T) {
 	w, _ := coraza.NewWAF(coraza.NewWAFConfig())
 
@@ -0,0 +1,99 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+const (
+	crsPluginsDir     = "@crs-plugins"
+	crsRulesDir       = "@owasp_crs/"
+	crsPluginIncludes = "Include " + crsPluginsDir + "/%s-%s.conf"
+)
+
+// expandCRSPlugins loads the given CRS plugins around the CRS rules, following the CRS
+// plugin mechanism: the config and before files of every plugin are included before the
+// first include of the CRS rules (e.g. "Include @owasp_crs/*.conf" or the files of
+// @owasp_crs one by one) and the after files right after the last one. Plugins are looked
+// up in the @crs-plugins directory, where they are embedded at build time or inlined as
+// files. It returns whether any directive included the CRS rules.
+func expandCRSPlugins(rootFS fs.FS, directives []string, plugins []string) ([]string, bool, error) {
+	if len(plugins) == 0 {
+		return directives, false, nil
+	}
+
+	available := map[string]bool{}
+	for _, plugin := range plugins {
+		if len(plugin) == 0 || strings.ContainsAny(plugin, "/\\*?[") {
+			return nil, false, fmt.Errorf("invalid CRS plugin name %q", plugin)
+		}
+
+		found := false
+		for _, kind := range []string{"config", "before", "after"} {
+			_, err := fs.Stat(rootFS, fmt.Sprintf("%s/%s-%s.conf", crsPluginsDir, plugin, kind))
+			available[plugin+"-"+kind] = err == nil
+			found = found || err == nil
+		}
+		if !found {
+			return nil, false, fmt.Errorf("unknown CRS plugin %q", plugin)
+		}
+	}
+
+	includes := func(kind string) []string {
+		var res []string
+		for _, plugin := range plugins {
+			if available[plugin+"-"+kind] {
+				res = append(res, fmt.Sprintf(crsPluginIncludes, plugin, kind))
+			}
+		}
+		return res
+	}
+
+	lines := make([][]string, len(directives))
+	first, last := [2]int{-1, -1}, [2]int{-1, -1}
+	for i, directive := range directives {
+		lines[i] = strings.Split(directive, "\n")
+		for j, line := range lines[i] {
+			if !isCRSRulesInclude(line) {
+				continue
+			}
+			if first[0] == -1 {
+				first = [2]int{i, j}
+			}
+			last = [2]int{i, j}
+		}
+	}
+	if first[0] == -1 {
+		return directives, false, nil
+	}
+
+	before := append(includes("config"), includes("before")...)
+	after := includes("after")
+	if len(after) > 0 {
+		lines[last[0]][last[1]] = strings.Join(append([]string{lines[last[0]][last[1]]}, after...), "\n")
+	}
+	if len(before) > 0 {
+		lines[first[0]][first[1]] = strings.Join(append(before, lines[first[0]][first[1]]), "\n")
+	}
+
+	res := make([]string, 0, len(directives))
+	for _, l := range lines {
+		res = append(res, strings.Join(l, "\n"))
+	}
+	return res, true, nil
+}
+
+// isCRSRulesInclude reports whether line includes files of the CRS rules, whatever its
+// spacing, the case of the directive or the quotes around the path.
+func isCRSRulesInclude(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Include") {
+		return false
+	}
+	path := strings.Trim(fields[1], `"'`)
+	return strings.HasPrefix(path, crsRulesDir)
+}
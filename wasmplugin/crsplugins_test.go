@@ -0,0 +1,112 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandCRSPlugins(t *testing.T) {
+	rootFS := newOverlayFS(root, map[string][]byte{
+		"@crs-plugins/foo-config.conf": []byte("# foo config"),
+		"@crs-plugins/foo-before.conf": []byte("# foo before"),
+		"@crs-plugins/foo-after.conf":  []byte("# foo after"),
+		"@crs-plugins/bar-before.conf": []byte("# bar before"),
+	})
+
+	tests := []struct {
+		name             string
+		directives       []string
+		plugins          []string
+		expectDirectives []string
+		expectExpanded   bool
+		expectErr        error
+	}{
+		{
+			name:             "no plugins",
+			directives:       []string{"Include @owasp_crs/*.conf"},
+			expectDirectives: []string{"Include @owasp_crs/*.conf"},
+		},
+		{
+			name:       "plugins around CRS",
+			directives: []string{"SecRuleEngine On", "Include @crs-setup-conf\nInclude @owasp_crs/*.conf", "SecRule ARGS \"@rx foo\" \"id:1\""},
+			plugins:    []string{"foo", "bar"},
+			expectDirectives: []string{
+				"SecRuleEngine On",
+				"Include @crs-setup-conf\n" +
+					"Include @crs-plugins/foo-config.conf\n" +
+					"Include @crs-plugins/foo-before.conf\n" +
+					"Include @crs-plugins/bar-before.conf\n" +
+					"Include @owasp_crs/*.conf\n" +
+					"Include @crs-plugins/foo-after.conf",
+				"SecRule ARGS \"@rx foo\" \"id:1\"",
+			},
+			expectExpanded: true,
+		},
+		{
+			name:       "include with spaces and quotes",
+			directives: []string{"  include   \"@owasp_crs/*.conf\"  "},
+			plugins:    []string{"foo"},
+			expectDirectives: []string{
+				"Include @crs-plugins/foo-config.conf\n" +
+					"Include @crs-plugins/foo-before.conf\n" +
+					"  include   \"@owasp_crs/*.conf\"  \n" +
+					"Include @crs-plugins/foo-after.conf",
+			},
+			expectExpanded: true,
+		},
+		{
+			name: "individual includes",
+			directives: []string{
+				"Include @owasp_crs/REQUEST-901-INITIALIZATION.conf\nInclude @owasp_crs/REQUEST-911-METHOD-ENFORCEMENT.conf",
+				"Include @owasp_crs/RESPONSE-980-CORRELATION.conf",
+			},
+			plugins: []string{"foo"},
+			expectDirectives: []string{
+				"Include @crs-plugins/foo-config.conf\n" +
+					"Include @crs-plugins/foo-before.conf\n" +
+					"Include @owasp_crs/REQUEST-901-INITIALIZATION.conf\n" +
+					"Include @owasp_crs/REQUEST-911-METHOD-ENFORCEMENT.conf",
+				"Include @owasp_crs/RESPONSE-980-CORRELATION.conf\n" +
+					"Include @crs-plugins/foo-after.conf",
+			},
+			expectExpanded: true,
+		},
+		{
+			name:             "directives without CRS",
+			directives:       []string{"SecRuleEngine On"},
+			plugins:          []string{"foo"},
+			expectDirectives: []string{"SecRuleEngine On"},
+		},
+		{
+			name:       "unknown plugin",
+			directives: []string{"Include @owasp_crs/*.conf"},
+			plugins:    []string{"baz"},
+			expectErr:  errors.New("unknown CRS plugin \"baz\""),
+		},
+		{
+			name:       "invalid plugin name",
+			directives: []string{"Include @owasp_crs/*.conf"},
+			plugins:    []string{"*"},
+			expectErr:  errors.New("invalid CRS plugin name \"*\""),
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			directives, expanded, err := expandCRSPlugins(rootFS, tt.directives, tt.plugins)
+			if tt.expectErr != nil {
+				require.Equal(t, tt.expectErr, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectDirectives, directives)
+			require.Equal(t, tt.expectExpanded, expanded)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/debuglog"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultDebugHeader       = "x-coraza-debug"
+	defaultDebugHeaderMaxAge = 5 * time.Minute
+	// debugHeaderMaxSkew is how far in the future a debug header can be signed, to tolerate
+	// clocks slightly ahead of the proxy one.
+	debugHeaderMaxSkew = 5 * time.Second
+	// debugMatchedRulesHeader lists the IDs of the rules matched by a debugged request, up to the
+	// response headers phase.
+	debugMatchedRulesHeader = "x-coraza-debug-matched-rules"
+	debugLogLevel           = debuglog.LevelTrace
+	// defaultDebugRuleID is the ID of the rule switching debugged transactions to DetectionOnly,
+	// above the ranges reserved to the CRS and to the ModSecurity rules.
+	defaultDebugRuleID = 99999990
+	// debugTXVariable is the TX variable set to 1 by the plugin for debugged transactions.
+	debugTXVariable = "coraza_proxy_wasm_debug"
+)
+
+var (
+	errDebugHeaderFormat    = errors.New("expected <unix timestamp>:<hex HMAC-SHA256 of the timestamp and the request>")
+	errDebugHeaderExpired   = errors.New("expired")
+	errDebugHeaderSignature = errors.New("invalid signature")
+)
+
+// debugHeaderConfiguration configures the signed request header switching a transaction to
+// DetectionOnly with the highest debug log level.
+type debugHeaderConfiguration struct {
+	name   string
+	key    []byte
+	maxAge time.Duration
+	// ruleID is the ID of the rule added to the directives to switch debugged transactions.
+	ruleID int
+}
+
+func (c debugHeaderConfiguration) enabled() bool {
+	return len(c.key) > 0
+}
+
+// parseDebugHeaderConfiguration parses the debug header of directives, e.g.
+// {"key": "...", "header": "x-coraza-debug", "max_age": "5m", "rule_id": 99999990}. The key is given like files,
+// either as a string or with its encoding.
+func parseDebugHeaderConfiguration(value gjson.Result) (debugHeaderConfiguration, error) {
+	c := debugHeaderConfiguration{}
+	if !value.Exists() {
+		return c, nil
+	}
+
+	if !value.Get("key").Exists() {
+		return c, errors.New("missing key")
+	}
+	key, err := parseFileContent(value.Get("key"))
+	if err != nil {
+		return c, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(key) == 0 {
+		return c, errors.New("empty key")
+	}
+	c.key = key
+
+	c.name = defaultDebugHeader
+	if name := value.Get("header"); name.Exists() {
+		c.name = strings.ToLower(name.String())
+		if len(c.name) == 0 {
+			return c, errors.New("empty header")
+		}
+	}
+
+	c.maxAge = defaultDebugHeaderMaxAge
+	if maxAge := value.Get("max_age"); maxAge.Exists() {
+		d, err := time.ParseDuration(maxAge.String())
+		if err != nil {
+			return c, fmt.Errorf("invalid max age: %v", err)
+		}
+		if d <= 0 {
+			return c, fmt.Errorf("invalid max age: %v", d)
+		}
+		c.maxAge = d
+	}
+
+	c.ruleID = defaultDebugRuleID
+	if ruleID := value.Get("rule_id"); ruleID.Exists() {
+		if c.ruleID = int(ruleID.Int()); c.ruleID <= 0 {
+			return c, fmt.Errorf("invalid rule id: %s", ruleID.Raw)
+		}
+	}
+	return c, nil
+}
+
+// rule returns the rule switching the transactions debugged by the plugin to DetectionOnly with
+// the highest debug log level. It runs before the other rules of phase 1, which it is prepended
+// to, and does not run when the rule engine is Off.
+func (c debugHeaderConfiguration) rule() string {
+	return fmt.Sprintf(`SecRule TX:%s "@eq 1" "id:%d,phase:1,pass,nolog,ctl:ruleEngine=DetectionOnly,ctl:debugLogLevel=%d"`,
+		debugTXVariable, c.ruleID, debugLogLevel)
+}
+
+// addDebugRules prepends the debug rule of the directives accepting a debug header to them, and
+// to the directives they extend as each layer evaluates its own rules. Directives only made of
+// extends have no WAF of their own, they are left as is.
+func addDebugRules(directivesMap DirectivesMap, extends map[string]string, options map[string]directivesOptions) {
+	added := map[string]map[string]bool{}
+	for name, opts := range options {
+		if !opts.debugHeader.enabled() {
+			continue
+		}
+		rule := opts.debugHeader.rule()
+		for current := name; ; {
+			base, extending := extends[current]
+			if (!extending || len(directivesMap[current]) > 0) && !added[current][rule] {
+				directivesMap[current] = append([]string{rule}, directivesMap[current]...)
+				if added[current] == nil {
+					added[current] = map[string]bool{}
+				}
+				added[current][rule] = true
+			}
+			if !extending {
+				break
+			}
+			current = base
+		}
+	}
+}
+
+// debugRequest identifies the request a debug header is signed for, so that a leaked header
+// can not be used for other requests.
+type debugRequest struct {
+	method, authority, path string
+}
+
+// signDebugHeader returns the value of the debug header of req at t.
+func signDebugHeader(key []byte, t time.Time, req debugRequest) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + ":" + hex.EncodeToString(debugHeaderMAC(key, ts, req))
+}
+
+// debugHeaderMAC signs the timestamp, the method, the authority and the path, query included,
+// separated by new lines.
+func debugHeaderMAC(key []byte, ts string, req debugRequest) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ts + "\n" + req.method + "\n" + req.authority + "\n" + req.path))
+	return mac.Sum(nil)
+}
+
+// verify checks that value is signed with the key for req, at most maxAge before now or
+// debugHeaderMaxSkew after it.
+func (c debugHeaderConfiguration) verify(value string, req debugRequest, now time.Time) error {
+	ts, signature, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		return errDebugHeaderFormat
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errDebugHeaderFormat
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil {
+		return errDebugHeaderFormat
+	}
+	if !hmac.Equal(mac, debugHeaderMAC(c.key, ts, req)) {
+		return errDebugHeaderSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > c.maxAge || age < -debugHeaderMaxSkew {
+		return errDebugHeaderExpired
+	}
+	return nil
+}
+
+// checkDebugHeader switches the transaction to DetectionOnly with the highest debug log level
+// when the request has a valid debug header, which is not forwarded upstream. Invalid headers
+// are ignored.
+func (ctx *httpContext) checkDebugHeader(authority string) {
+	c := ctx.options.debugHeader
+	value, err := proxywasm.GetHttpRequestHeader(c.name)
+	if err != nil {
+		return
+	}
+	if err := proxywasm.RemoveHttpRequestHeader(c.name); err != nil {
+		ctx.logger.Error().Err(err).Str("header", c.name).Msg("Failed to remove the debug header")
+	}
+
+	req := debugRequest{authority: authority}
+	if req.method, err = proxywasm.GetHttpRequestHeader(":method"); err != nil {
+		ctx.logger.Info().Err(err).Msg("Ignoring debug header, failed to get :method")
+		return
+	}
+	if req.path, err = proxywasm.GetHttpRequestHeader(":path"); err != nil {
+		ctx.logger.Info().Err(err).Msg("Ignoring debug header, failed to get :path")
+		return
+	}
+	if err := c.verify(value, req, time.Now()); err != nil {
+		ctx.logger.Info().Err(err).Msg("Ignoring debug header")
+		return
+	}
+	// The debug rule switches the transaction once phase 1 is evaluated.
+	for _, state := range transactionStates(ctx.tx) {
+		state.Variables().TX().Set(debugTXVariable, []string{"1"})
+	}
+	ctx.debug = true
+	ctx.logger = ctx.logger.WithLevel(debugLogLevel)
+	ctx.logger.Info().Msg("Debug header verified, switching to DetectionOnly")
+}
+
+// addDebugResponseHeader adds the IDs of the rules matched so far to the response of a debugged
+// request.
+func (ctx *httpContext) addDebugResponseHeader() {
+	if err := proxywasm.AddHttpResponseHeader(debugMatchedRulesHeader, matchedRuleIDs(ctx.tx)); err != nil {
+		ctx.logger.Error().Err(err).Str("header", debugMatchedRulesHeader).Msg("Failed to add response header")
+	}
+}
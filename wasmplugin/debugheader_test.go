@@ -0,0 +1,129 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHeaderVerify(t *testing.T) {
+	c := debugHeaderConfiguration{name: defaultDebugHeader, key: []byte("secret"), maxAge: time.Minute}
+	now := time.Unix(1700000000, 0)
+	req := debugRequest{method: "GET", authority: "localhost", path: "/admin?q=1"}
+
+	tests := []struct {
+		name        string
+		value       string
+		expectedErr error
+	}{
+		{name: "valid", value: signDebugHeader(c.key, now, req)},
+		{name: "clock skew", value: signDebugHeader(c.key, now.Add(3*time.Second), req)},
+		{name: "expired", value: signDebugHeader(c.key, now.Add(-2*time.Minute), req), expectedErr: errDebugHeaderExpired},
+		{name: "future", value: signDebugHeader(c.key, now.Add(30*time.Second), req), expectedErr: errDebugHeaderExpired},
+		{name: "other key", value: signDebugHeader([]byte("other"), now, req), expectedErr: errDebugHeaderSignature},
+		{
+			name:        "other method",
+			value:       signDebugHeader(c.key, now, debugRequest{method: "POST", authority: req.authority, path: req.path}),
+			expectedErr: errDebugHeaderSignature,
+		},
+		{
+			name:        "other authority",
+			value:       signDebugHeader(c.key, now, debugRequest{method: req.method, authority: "example.com", path: req.path}),
+			expectedErr: errDebugHeaderSignature,
+		},
+		{
+			name:        "other path",
+			value:       signDebugHeader(c.key, now, debugRequest{method: req.method, authority: req.authority, path: "/admin?q=2"}),
+			expectedErr: errDebugHeaderSignature,
+		},
+		{name: "unsigned", value: "1700000000", expectedErr: errDebugHeaderFormat},
+		{name: "invalid timestamp", value: "now:00", expectedErr: errDebugHeaderFormat},
+		{name: "invalid signature", value: "1700000000:zz", expectedErr: errDebugHeaderFormat},
+		{
+			name:        "replaced timestamp",
+			value:       "1700000001:" + strings.SplitN(signDebugHeader(c.key, now, req), ":", 2)[1],
+			expectedErr: errDebugHeaderSignature,
+		},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectedErr, c.verify(tt.value, req, now))
+		})
+	}
+}
+
+func TestDebugRule(t *testing.T) {
+	c := debugHeaderConfiguration{key: []byte("secret"), ruleID: defaultDebugRuleID}
+	rules := `
+SecRule REQUEST_URI "@beginsWith /admin" "id:101,phase:1,deny,status:403,msg:'admin'"
+`
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(c.rule() + "\nSecRuleEngine On" + rules))
+	require.NoError(t, err)
+
+	debug := func(tx ctypes.Transaction) {
+		for _, state := range transactionStates(tx) {
+			state.Variables().TX().Set(debugTXVariable, []string{"1"})
+		}
+	}
+
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	debug(tx)
+	tx.ProcessURI("/admin", "GET", "HTTP/1.1")
+	require.Nil(t, tx.ProcessRequestHeaders())
+	require.True(t, tx.DebugLogger().Debug().IsEnabled())
+	// The debug rule has no message, only the rule of the directives is reported.
+	require.Equal(t, "101", matchedRuleIDs(tx))
+
+	tx = waf.NewTransaction()
+	defer tx.Close()
+	tx.ProcessURI("/admin", "GET", "HTTP/1.1")
+	require.NotNil(t, tx.ProcessRequestHeaders())
+
+	waf, err = coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(c.rule() + "\nSecRuleEngine Off" + rules))
+	require.NoError(t, err)
+	tx = waf.NewTransaction()
+	defer tx.Close()
+	debug(tx)
+	require.Nil(t, tx.ProcessRequestHeaders())
+	require.True(t, tx.IsRuleEngineOff())
+}
+
+func TestAddDebugRules(t *testing.T) {
+	debugHeader := debugHeaderConfiguration{key: []byte("secret"), ruleID: defaultDebugRuleID}
+	other := debugHeaderConfiguration{key: []byte("secret"), ruleID: 1234}
+	directivesMap := DirectivesMap{
+		"base":    {"SecRuleEngine On"},
+		"tenant1": {"SecRule ARGS \"@rx foo\" \"id:1,deny\""},
+		"tenant2": {"SecRule ARGS \"@rx bar\" \"id:2,deny\""},
+		"alias":   nil,
+		"plain":   {"SecRuleEngine On"},
+		"other":   {"SecRuleEngine On"},
+	}
+	extends := map[string]string{"tenant1": "base", "tenant2": "base", "alias": "tenant1"}
+	options := map[string]directivesOptions{
+		"tenant1": {debugHeader: debugHeader},
+		"tenant2": {debugHeader: debugHeader},
+		"alias":   {debugHeader: debugHeader},
+		"other":   {debugHeader: other},
+	}
+
+	addDebugRules(directivesMap, extends, options)
+	require.Equal(t, DirectivesMap{
+		"base":    {debugHeader.rule(), "SecRuleEngine On"},
+		"tenant1": {debugHeader.rule(), "SecRule ARGS \"@rx foo\" \"id:1,deny\""},
+		"tenant2": {debugHeader.rule(), "SecRule ARGS \"@rx bar\" \"id:2,deny\""},
+		"alias":   nil,
+		"plain":   {"SecRuleEngine On"},
+		"other":   {other.rule(), "SecRuleEngine On"},
+	}, directivesMap)
+}
@@ -0,0 +1,243 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+const (
+	// riskyBodyLimit is the body limit above which buffering bodies may exhaust the wasm memory.
+	riskyBodyLimit = 32 * 1024 * 1024
+
+	// crsSetupRuleID is the ID of the rule of the CRS setup setting tx.crs_setup_version.
+	crsSetupRuleID = 900990
+
+	// summaryTransactionID is the ID of the transaction evaluating phase 1 to summarize a WAF.
+	// Rules matched by it are not logged and the actions of the plugin skip it, so that it has
+	// no side effects.
+	summaryTransactionID = "waf-summary"
+)
+
+var errWAFNotInspectable = errors.New("compiled WAF cannot be inspected")
+
+// wafSummary describes the rules and settings compiled into a WAF.
+type wafSummary struct {
+	engine                 types.RuleEngineStatus
+	rules                  []summarizedRule
+	requestBodyAccess      bool
+	requestBodyLimit       int64
+	requestBodyLimitAction types.BodyLimitAction
+	responseBodyAccess     bool
+	responseBodyLimit      int64
+	// crsSetupVersion is the value of tx.crs_setup_version once phase 1 is evaluated.
+	crsSetupVersion string
+}
+
+type summarizedRule struct {
+	id    int
+	phase int
+}
+
+// summarizeWAF reads the rules and settings of a compiled WAF. Coraza only exposes the body
+// access of transactions, so the others are read from the exported fields of its internal WAF,
+// reachable from a transaction, which TestSummarizeWAFCorazaFields pins. Rules removed by
+// SecRuleRemoveBy* are already gone and chained rules belong to their parent.
+func summarizeWAF(waf coraza.WAF) (wafSummary, error) {
+	tx := waf.NewTransactionWithID(summaryTransactionID)
+	defer tx.Close()
+
+	v := reflect.ValueOf(tx)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	w := v.Elem().FieldByName("WAF")
+	if w.Kind() != reflect.Pointer || w.IsNil() {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	w = w.Elem()
+
+	var s wafSummary
+	var ok bool
+	if s.engine, ok = fieldValue[types.RuleEngineStatus](w, "RuleEngine"); !ok {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	if s.requestBodyLimit, ok = fieldValue[int64](w, "RequestBodyLimit"); !ok {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	if s.requestBodyLimitAction, ok = fieldValue[types.BodyLimitAction](w, "RequestBodyLimitAction"); !ok {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	if s.responseBodyLimit, ok = fieldValue[int64](w, "ResponseBodyLimit"); !ok {
+		return wafSummary{}, errWAFNotInspectable
+	}
+
+	rules := w.FieldByName("Rules").FieldByName("rules")
+	if rules.Kind() != reflect.Slice {
+		return wafSummary{}, errWAFNotInspectable
+	}
+	s.rules = make([]summarizedRule, 0, rules.Len())
+	for i := 0; i < rules.Len(); i++ {
+		id, phase := rules.Index(i).FieldByName("ID_"), rules.Index(i).FieldByName("Phase_")
+		if id.Kind() != reflect.Int || phase.Kind() != reflect.Int {
+			return wafSummary{}, errWAFNotInspectable
+		}
+		s.rules = append(s.rules, summarizedRule{id: int(id.Int()), phase: int(phase.Int())})
+	}
+
+	s.requestBodyAccess = tx.IsRequestBodyAccessible()
+	s.responseBodyAccess = tx.IsResponseBodyAccessible()
+	s.crsSetupVersion = crsSetupVersion(tx)
+	return s, nil
+}
+
+// crsSetupVersion evaluates phase 1 of a request to / on tx and returns the value of
+// tx.crs_setup_version, empty when it is not set, e.g. without the CRS setup or when the
+// rule engine is Off.
+func crsSetupVersion(tx types.Transaction) string {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return ""
+	}
+	tx.ProcessURI("/", "GET", "HTTP/1.1")
+	tx.AddRequestHeader("Host", "localhost")
+	tx.ProcessRequestHeaders()
+	if values := state.Variables().TX().Get("crs_setup_version"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// fieldValue returns the value of the exported field name of the struct v.
+func fieldValue[T any](v reflect.Value, name string) (T, bool) {
+	var zero T
+	f := v.FieldByName(name)
+	if !f.IsValid() || !f.CanInterface() {
+		return zero, false
+	}
+	res, ok := f.Interface().(T)
+	return res, ok
+}
+
+// rulesPerPhase formats the number of rules of each phase, e.g. "1:10 2:25".
+func (s wafSummary) rulesPerPhase() string {
+	var counts [6]int
+	for _, r := range s.rules {
+		if r.phase >= 1 && r.phase <= 5 {
+			counts[r.phase]++
+		}
+	}
+
+	var b strings.Builder
+	for phase := 1; phase <= 5; phase++ {
+		if phase > 1 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%d:%d", phase, counts[phase])
+	}
+	return b.String()
+}
+
+// idRanges formats the rule IDs grouped by thousand, e.g. "101-104,942100-942999".
+func (s wafSummary) idRanges() string {
+	ids := make([]int, 0, len(s.rules))
+	for _, r := range s.rules {
+		if r.id > 0 {
+			ids = append(ids, r.id)
+		}
+	}
+	sort.Ints(ids)
+
+	var ranges []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1]/1000 == ids[i]/1000 {
+			j++
+		}
+		if ids[i] == ids[j] {
+			ranges = append(ranges, strconv.Itoa(ids[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// crsSetup returns whether the rule of the CRS setup is loaded, it sets crsSetupVersion unless
+// the rule engine is Off.
+func (s wafSummary) crsSetup() bool {
+	for _, r := range s.rules {
+		if r.id == crsSetupRuleID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s wafSummary) requestBodyLimitActionName() string {
+	if s.requestBodyLimitAction == types.BodyLimitActionProcessPartial {
+		return "ProcessPartial"
+	}
+	return "Reject"
+}
+
+// warnings lists the risky settings of the WAF.
+func (s wafSummary) warnings() []string {
+	var res []string
+	if len(s.rules) == 0 && s.engine != types.RuleEngineOff {
+		res = append(res, "no rules loaded")
+	}
+	if len(s.rules) > 0 && s.engine == types.RuleEngineOff {
+		res = append(res, "SecRuleEngine Off, rules are not evaluated")
+	}
+	if s.requestBodyAccess && s.requestBodyLimit > riskyBodyLimit {
+		res = append(res, fmt.Sprintf("SecRequestBodyAccess On with a %d bytes SecRequestBodyLimit, buffering large request bodies may exhaust the memory", s.requestBodyLimit))
+	}
+	if s.requestBodyAccess && s.requestBodyLimitAction == types.BodyLimitActionProcessPartial {
+		res = append(res, "SecRequestBodyLimitAction ProcessPartial, request bodies beyond the limit are partially inspected")
+	}
+	if s.responseBodyAccess && s.responseBodyLimit > riskyBodyLimit {
+		res = append(res, fmt.Sprintf("SecResponseBodyAccess On with a %d bytes SecResponseBodyLimit, buffering large response bodies may exhaust the memory", s.responseBodyLimit))
+	}
+	if !s.crsSetup() {
+		for _, r := range s.rules {
+			if r.id >= 900000 && r.id < 1000000 {
+				res = append(res, fmt.Sprintf("CRS rules loaded without rule %d, CRS setup is missing", crsSetupRuleID))
+				break
+			}
+		}
+	}
+	return res
+}
+
+// logWAFSummary logs the summary of a compiled WAF and warns about risky settings.
+func logWAFSummary(name string, waf coraza.WAF) {
+	s, err := summarizeWAF(waf)
+	if err != nil {
+		proxywasm.LogWarnf("Failed to summarize directives %q: %v", name, err)
+		return
+	}
+
+	proxywasm.LogInfof("Directives %q loaded: engine=%s rules=%d rules_per_phase=%q rule_ids=%q "+
+		"request_body_access=%t request_body_limit=%d request_body_limit_action=%s "+
+		"response_body_access=%t response_body_limit=%d crs_setup_version=%q",
+		name, s.engine, len(s.rules), s.rulesPerPhase(), s.idRanges(),
+		s.requestBodyAccess, s.requestBodyLimit, s.requestBodyLimitActionName(),
+		s.responseBodyAccess, s.responseBodyLimit, s.crsSetupVersion)
+
+	for _, w := range s.warnings() {
+		proxywasm.LogWarnf("Directives %q: %s", name, w)
+	}
+}
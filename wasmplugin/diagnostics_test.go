@@ -0,0 +1,190 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func TestSummarizeWAF(t *testing.T) {
+	rootFS := fstest.MapFS{
+		"rules/main.conf": &fstest.MapFile{Data: []byte(`
+SecRule ARGS "@rx foo" "id:101,phase:1,deny"
+SecRule ARGS "@rx bar" \
+    "id:102,phase:request,deny,chain"
+    SecRule ARGS "@rx baz" "t:none"
+`)},
+		"extra/one.conf": &fstest.MapFile{Data: []byte(`SecRule RESPONSE_BODY "@rx qux" "id:2001,phase:4,msg:'a, b',tag:'removed',deny"`)},
+	}
+
+	tests := []struct {
+		name          string
+		directives    []string
+		engine        string
+		rules         int
+		rulesPerPhase string
+		idRanges      string
+		crsSetup      bool
+		crsVersion    string
+		warnings      []string
+	}{
+		{
+			name:          "defaults",
+			directives:    []string{"SecRule ARGS \"@rx foo\" \"id:1,deny\""},
+			engine:        "On",
+			rules:         1,
+			rulesPerPhase: "1:0 2:1 3:0 4:0 5:0",
+			idRanges:      "1",
+		},
+		{
+			name:          "includes and chains",
+			directives:    []string{"SecRuleEngine DetectionOnly", "Include rules/main.conf", "Include extra/*.conf"},
+			engine:        "DetectionOnly",
+			rules:         3,
+			rulesPerPhase: "1:1 2:1 3:0 4:1 5:0",
+			idRanges:      "101-102,2001",
+		},
+		{
+			name:          "removed rules",
+			directives:    []string{"Include rules/main.conf", "Include extra/*.conf", "SecRuleRemoveById 101", "SecRuleRemoveByTag removed"},
+			engine:        "On",
+			rules:         1,
+			rulesPerPhase: "1:0 2:1 3:0 4:0 5:0",
+			idRanges:      "102",
+		},
+		{
+			name:          "no rules",
+			directives:    []string{"SecRuleEngine On"},
+			engine:        "On",
+			rulesPerPhase: "1:0 2:0 3:0 4:0 5:0",
+			warnings:      []string{"no rules loaded"},
+		},
+		{
+			name: "risky settings",
+			directives: []string{
+				"SecRuleEngine Off",
+				"SecRequestBodyAccess On",
+				"SecRequestBodyLimit 67108864",
+				"SecRequestBodyLimitAction ProcessPartial",
+				"SecResponseBodyAccess On",
+				"SecResponseBodyLimit 67108864",
+				"SecAction \"id:900990,phase:1,pass,nolog,setvar:tx.crs_setup_version=400\"",
+				"SecRule ARGS \"@rx foo\" \"id:942100,phase:2,deny\"",
+			},
+			engine:        "Off",
+			rules:         2,
+			rulesPerPhase: "1:1 2:1 3:0 4:0 5:0",
+			idRanges:      "900990,942100",
+			crsSetup:      true,
+			warnings: []string{
+				"SecRuleEngine Off, rules are not evaluated",
+				"SecRequestBodyAccess On with a 67108864 bytes SecRequestBodyLimit, buffering large request bodies may exhaust the memory",
+				"SecRequestBodyLimitAction ProcessPartial, request bodies beyond the limit are partially inspected",
+				"SecResponseBodyAccess On with a 67108864 bytes SecResponseBodyLimit, buffering large response bodies may exhaust the memory",
+			},
+		},
+		{
+			name:          "CRS without setup",
+			directives:    []string{"SecResponseBodyAccess On", "SecResponseBodyLimit 524288", "SecRule ARGS \"@rx foo\" \"id:942100,deny\""},
+			engine:        "On",
+			rules:         1,
+			rulesPerPhase: "1:0 2:1 3:0 4:0 5:0",
+			idRanges:      "942100",
+			warnings:      []string{"CRS rules loaded without rule 900990, CRS setup is missing"},
+		},
+		{
+			name: "CRS setup",
+			directives: []string{
+				"SecRuleEngine DetectionOnly",
+				"SecAction \"id:900990,phase:1,pass,nolog,setvar:tx.crs_setup_version=410\"",
+				"SecRule REQUEST_HEADERS:Host \"@streq localhost\" \"id:942100,phase:1,deny,log,msg:'host'\"",
+			},
+			engine:        "DetectionOnly",
+			rules:         2,
+			rulesPerPhase: "1:2 2:0 3:0 4:0 5:0",
+			idRanges:      "900990,942100",
+			crsSetup:      true,
+			crsVersion:    "410",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := newWAF(rootFS, tt.directives)
+			require.NoError(t, err)
+			s, err := summarizeWAF(waf)
+			require.NoError(t, err)
+			require.Equal(t, tt.engine, s.engine.String())
+			require.Len(t, s.rules, tt.rules)
+			require.Equal(t, tt.rulesPerPhase, s.rulesPerPhase())
+			require.Equal(t, tt.idRanges, s.idRanges())
+			require.Equal(t, tt.crsSetup, s.crsSetup())
+			require.Equal(t, tt.crsVersion, s.crsSetupVersion)
+			require.Equal(t, tt.warnings, s.warnings())
+		})
+	}
+
+	t.Run("embedded CRS", func(t *testing.T) {
+		if embeddedCRSVersion == "" {
+			t.Skip("no CRS embedded")
+		}
+		waf, err := newWAF(root, []string{"Include @recommended-conf", "Include @crs-setup-conf", "Include @owasp_crs/*.conf"})
+		require.NoError(t, err)
+		s, err := summarizeWAF(waf)
+		require.NoError(t, err)
+		require.Equal(t, types.RuleEngineDetectionOnly, s.engine)
+		require.NotEmpty(t, s.rules)
+		require.True(t, s.crsSetup())
+		require.NotEmpty(t, s.crsSetupVersion)
+		require.Empty(t, s.warnings())
+	})
+}
+
+// TestSummarizeWAFCorazaFields fails when the internal fields of Coraza read by summarizeWAF
+// change, e.g. when upgrading Coraza, every field being set to a value other than its default.
+func TestSummarizeWAFCorazaFields(t *testing.T) {
+	waf, err := newWAF(root, []string{
+		"SecRuleEngine DetectionOnly",
+		"SecRequestBodyLimit 1234",
+		"SecRequestBodyLimitAction Reject",
+		"SecResponseBodyLimit 5678",
+		"SecRule ARGS \"@rx foo\" \"id:4321,phase:3,deny\"",
+	})
+	require.NoError(t, err)
+
+	s, err := summarizeWAF(waf)
+	require.NoError(t, err, "Transaction.WAF, WAF.RuleEngine, WAF.RequestBodyLimit, WAF.RequestBodyLimitAction, "+
+		"WAF.ResponseBodyLimit, WAF.Rules.rules, Rule.ID_ or Rule.Phase_ changed in Coraza")
+	require.Equal(t, types.RuleEngineDetectionOnly, s.engine, "WAF.RuleEngine")
+	require.EqualValues(t, 1234, s.requestBodyLimit, "WAF.RequestBodyLimit")
+	require.Equal(t, types.BodyLimitActionReject, s.requestBodyLimitAction, "WAF.RequestBodyLimitAction")
+	require.EqualValues(t, 5678, s.responseBodyLimit, "WAF.ResponseBodyLimit")
+	require.Equal(t, []summarizedRule{{id: 4321, phase: 3}}, s.rules, "WAF.Rules.rules, Rule.ID_ or Rule.Phase_")
+}
+
+func TestSummarizeWAFSideEffects(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	waf, err := newWAF(root, []string{
+		"SecRuleEngine On",
+		"SecAction \"id:1,phase:1,pass,log,severity:NOTICE,msg:'summarized',initcol:global=global,setvar:global.hits=+1\"",
+	})
+	require.NoError(t, err)
+	_, err = summarizeWAF(waf)
+	require.NoError(t, err)
+
+	// The summary transaction is not logged and does not update persistent collections.
+	require.Empty(t, host.GetInfoLogs())
+	values, isNew, err := collections.get("global", "global")
+	require.NoError(t, err)
+	require.True(t, isNew)
+	require.Empty(t, values)
+}
@@ -0,0 +1,209 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+const (
+	defaultDirectivesSourcePath          = "/"
+	defaultDirectivesSourceName          = "default"
+	defaultDirectivesSourceRefreshPeriod = time.Minute
+	defaultDirectivesSourceTimeout       = 5 * time.Second
+	// directivesNotLoadedStatusCode is the status of the requests rejected by fail_closed
+	// until the directives are fetched.
+	directivesNotLoadedStatusCode = 503
+)
+
+// directivesSourceConfiguration configures the HTTP endpoint the directives are fetched from.
+type directivesSourceConfiguration struct {
+	enabled bool
+	cluster string
+	// authority is the :authority of the request, defaults to the cluster name.
+	authority string
+	path      string
+	// directives is the name of the directives the fetched ones are appended to.
+	directives    string
+	refreshPeriod time.Duration
+	timeout       time.Duration
+	// failClosed rejects the requests evaluated by the directives until they are fetched,
+	// rather than evaluating them with the inline directives only.
+	failClosed bool
+}
+
+func (c directivesSourceConfiguration) validate() error {
+	if len(c.cluster) == 0 {
+		return errors.New("missing cluster")
+	}
+	if !strings.HasPrefix(c.path, "/") {
+		return errors.New("path must start with /")
+	}
+	if c.refreshPeriod < time.Millisecond {
+		return errors.New("refresh period must be at least 1ms")
+	}
+	if c.timeout < time.Millisecond {
+		return errors.New("timeout must be at least 1ms")
+	}
+	return nil
+}
+
+// directivesSource fetches directives from an HTTP endpoint on plugin start and refreshes
+// them periodically, using the ETag of the last successful response so that unchanged
+// directives are not compiled again. The compiled WAF replaces the previous one in wafs,
+// which keeps serving whenever the fetch fails or the directives do not compile. Until the
+// first successful fetch, requests are only evaluated by the inline directives, if any, or
+// rejected with failClosed.
+type directivesSource struct {
+	cfg directivesSourceConfiguration
+	// inline are the directives from the plugin configuration, prepended to the fetched ones.
+	inline     []string
+	rootFS     fs.FS
+	crsPlugins []string
+	wafs       wafMap
+	// base is the WAF of the directives extended by the fetched ones, if any.
+	base      coraza.WAF
+	etag      string
+	loaded    bool
+	pending   bool
+	nextFetch time.Time
+	now       func() time.Time
+}
+
+func newDirectivesSource(cfg directivesSourceConfiguration, inline []string, rootFS fs.FS, crsPlugins []string, wafs wafMap) *directivesSource {
+	return &directivesSource{
+		cfg:        cfg,
+		inline:     inline,
+		rootFS:     rootFS,
+		crsPlugins: crsPlugins,
+		wafs:       wafs,
+		now:        time.Now,
+	}
+}
+
+// tick fetches the directives when the refresh period elapsed and no fetch is in flight.
+func (s *directivesSource) tick() {
+	if s.pending || s.now().Before(s.nextFetch) {
+		return
+	}
+	s.warnNotLoaded()
+
+	if err := s.fetch(); err != nil {
+		proxywasm.LogErrorf("Failed to fetch directives from cluster %q: %v", s.cfg.cluster, err)
+	}
+}
+
+// rejects returns whether requests evaluated by directives are rejected as they are not
+// fetched yet.
+func (s *directivesSource) rejects(directives string) bool {
+	return s.cfg.failClosed && !s.loaded && directives == s.cfg.directives
+}
+
+// warnNotLoaded warns that the directives are not fetched yet, until they are.
+func (s *directivesSource) warnNotLoaded() {
+	if s.loaded {
+		return
+	}
+	if s.cfg.failClosed {
+		proxywasm.LogWarnf("Directives %q not fetched from cluster %q yet, rejecting their requests", s.cfg.directives, s.cfg.cluster)
+		return
+	}
+	proxywasm.LogWarnf("Directives %q not fetched from cluster %q yet, their requests are only evaluated by the inline directives", s.cfg.directives, s.cfg.cluster)
+}
+
+func (s *directivesSource) fetch() error {
+	s.nextFetch = s.now().Add(s.cfg.refreshPeriod)
+
+	headers := [][2]string{
+		{":method", "GET"},
+		{":path", s.cfg.path},
+		{":authority", s.cfg.authority},
+		{"accept", "text/plain"},
+	}
+	if len(s.etag) > 0 {
+		headers = append(headers, [2]string{"if-none-match", s.etag})
+	}
+
+	_, err := proxywasm.DispatchHttpCall(s.cfg.cluster, headers, nil, nil,
+		uint32(s.cfg.timeout.Milliseconds()), s.onResponse)
+	if err != nil {
+		return err
+	}
+	s.pending = true
+	return nil
+}
+
+func (s *directivesSource) onResponse(_, bodySize, _ int) {
+	s.pending = false
+	s.nextFetch = s.now().Add(s.cfg.refreshPeriod)
+
+	headers, err := proxywasm.GetHttpCallResponseHeaders()
+	if err != nil {
+		proxywasm.LogErrorf("Failed to fetch directives from cluster %q: %v", s.cfg.cluster, err)
+		return
+	}
+
+	var status, etag string
+	for _, h := range headers {
+		switch strings.ToLower(h[0]) {
+		case ":status":
+			status = h[1]
+		case "etag":
+			etag = h[1]
+		}
+	}
+
+	switch status {
+	case "200":
+	case "304":
+		proxywasm.LogDebugf("Directives from cluster %q not modified", s.cfg.cluster)
+		return
+	default:
+		proxywasm.LogErrorf("Failed to fetch directives from cluster %q: unexpected status %q", s.cfg.cluster, status)
+		return
+	}
+
+	var body []byte
+	if bodySize > 0 {
+		if body, err = proxywasm.GetHttpCallResponseBody(0, bodySize); err != nil {
+			proxywasm.LogErrorf("Failed to read directives from cluster %q: %v", s.cfg.cluster, err)
+			return
+		}
+	}
+
+	fetched, expanded, err := expandCRSPlugins(s.rootFS, []string{string(body)}, s.crsPlugins)
+	if err != nil {
+		proxywasm.LogErrorf("Failed to load CRS plugins for directives from cluster %q: %v", s.cfg.cluster, err)
+		return
+	}
+	if len(s.crsPlugins) > 0 && !expanded {
+		proxywasm.LogWarnf("CRS plugins are only loaded along with includes of %q, not found in directives from cluster %q", crsRulesDir, s.cfg.cluster)
+	}
+
+	directives := append(append([]string{}, s.inline...), fetched...)
+	waf, err := newWAF(s.rootFS, directives)
+	if err != nil {
+		proxywasm.LogErrorf("Failed to parse directives from cluster %q, keeping the previous ones: %v", s.cfg.cluster, err)
+		return
+	}
+	logWAFSummary(s.cfg.directives, waf)
+	if s.base != nil {
+		waf = newLayeredWAF(s.base, waf)
+	}
+
+	// New transactions pick up the new WAF, in flight ones keep using the previous one.
+	if err := s.wafs.put(s.cfg.directives, waf); err != nil {
+		proxywasm.LogErrorf("Failed to register directives from cluster %q: %v", s.cfg.cluster, err)
+		return
+	}
+	s.etag = etag
+	s.loaded = true
+	proxywasm.LogInfof("Loaded directives %q from cluster %q", s.cfg.directives, s.cfg.cluster)
+}
@@ -4,33 +4,66 @@
 package wasmplugin
 
 import (
-	"embed"
+	"bytes"
+	"errors"
 	"fmt"
 	"io/fs"
+	"path"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
-	//go:embed rules
-	crs  embed.FS
 	root fs.FS
+	// embeddedCRSVersion is the version of the embedded CRS, empty when not embedded.
+	embeddedCRSVersion string
 )
 
+// bundleInfoFile describes the embedded rules, it can be included as it only contains comments.
+const bundleInfoFile = "@bundle-info"
+
 func init() {
-	rules, _ := fs.Sub(crs, "rules")
+	rules, _ := fs.Sub(crs, rulesDir)
 	root = &rulesFS{
 		rules,
+		rulesFiles,
 		map[string]string{
-			"@recommended-conf":    "coraza.conf-recommended.conf",
-			"@demo-conf":           "coraza-demo.conf",
-			"@crs-setup-demo-conf": "crs-setup-demo.conf",
-			"@ftw-conf":            "ftw-config.conf",
-			"@crs-setup-conf":      "crs-setup.conf.example",
-		},
-		map[string]string{
-			"@owasp_crs": "crs",
+			"@owasp_crs":   "crs",
+			"@crs-plugins": "crs-plugins",
 		},
 	}
+	embeddedCRSVersion = crsVersion(rules)
+	root = newOverlayFS(root, map[string][]byte{
+		bundleInfoFile: bundleInfo(rulesProfile, embeddedCRSVersion),
+	})
+}
+
+// bundleInfo returns the content of @bundle-info.
+func bundleInfo(profile, crsVersion string) []byte {
+	if len(crsVersion) == 0 {
+		crsVersion = "none"
+	}
+	return []byte(fmt.Sprintf("# profile: %s\n# crs_version: %s\n", profile, crsVersion))
+}
+
+// crsVersion returns the version of the embedded CRS, taken from the ver action of its rules.
+func crsVersion(rules fs.FS) string {
+	const verPrefix = "ver:'OWASP_CRS/"
+	data, err := fs.ReadFile(rules, "crs/REQUEST-901-INITIALIZATION.conf")
+	if err != nil {
+		return ""
+	}
+
+	i := bytes.Index(data, []byte(verPrefix))
+	if i == -1 {
+		return ""
+	}
+	data = data[i+len(verPrefix):]
+	if j := bytes.IndexByte(data, '\''); j != -1 {
+		return string(data[:j])
+	}
+	return ""
 }
 
 type rulesFS struct {
@@ -80,3 +113,111 @@ func (r rulesFS) mapPath(p string) string {
 
 	return p
 }
+
+// overlayFS serves the files inlined in the plugin configuration on top of another
+// filesystem, so that they can be referenced by Include and operators such as @pmFromFile.
+type overlayFS struct {
+	base  fs.FS
+	files map[string][]byte
+}
+
+func newOverlayFS(base fs.FS, files map[string][]byte) fs.FS {
+	o := &overlayFS{
+		base:  base,
+		files: make(map[string][]byte, len(files)),
+	}
+	for name, content := range files {
+		o.files[path.Clean(name)] = content
+	}
+	return o
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if content, ok := o.files[path.Clean(name)]; ok {
+		return &overlayFile{
+			Reader: bytes.NewReader(content),
+			info:   overlayFileInfo{name: path.Base(name), size: int64(len(content))},
+		}, nil
+	}
+	return o.base.Open(name)
+}
+
+func (o *overlayFS) ReadFile(name string) ([]byte, error) {
+	if content, ok := o.files[path.Clean(name)]; ok {
+		return append([]byte(nil), content...), nil
+	}
+	return fs.ReadFile(o.base, name)
+}
+
+// ReadDir merges the inlined files and directories under name with the base ones,
+// the inlined files taking precedence.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := path.Clean(name) + "/"
+	if prefix == "./" {
+		prefix = ""
+	} else if prefix == "//" {
+		prefix = "/"
+	}
+
+	entries := map[string]fs.DirEntry{}
+	for p, content := range o.files {
+		if !strings.HasPrefix(p, prefix) || (prefix == "" && path.IsAbs(p)) {
+			continue
+		}
+		child, rest, isDir := strings.Cut(p[len(prefix):], "/")
+		if isDir && len(rest) > 0 {
+			entries[child] = fs.FileInfoToDirEntry(overlayFileInfo{name: child, dir: true})
+		} else {
+			entries[child] = fs.FileInfoToDirEntry(overlayFileInfo{name: child, size: int64(len(content))})
+		}
+	}
+
+	baseEntries, err := fs.ReadDir(o.base, name)
+	if err != nil && (len(entries) == 0 || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+	for _, e := range baseEntries {
+		if _, ok := entries[e.Name()]; !ok {
+			entries[e.Name()] = e
+		}
+	}
+
+	res := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+type overlayFile struct {
+	*bytes.Reader
+	info overlayFileInfo
+}
+
+func (f *overlayFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *overlayFile) Close() error { return nil }
+
+type overlayFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i overlayFileInfo) Name() string { return i.name }
+
+func (i overlayFileInfo) Size() int64 { return i.size }
+
+func (i overlayFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (i overlayFileInfo) ModTime() time.Time { return time.Time{} }
+
+func (i overlayFileInfo) IsDir() bool { return i.dir }
+
+func (i overlayFileInfo) Sys() any { return nil }
@@ -0,0 +1,23 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build rules_crs_core
+
+package wasmplugin
+
+import "embed"
+
+// The crs-core profile embeds CRS along with its setup and the recommended configuration.
+const (
+	rulesProfile = "crs-core"
+	rulesDir     = "rules"
+)
+
+//go:embed rules/crs rules/crs-setup.conf.example rules/coraza.conf-recommended.conf
+var crs embed.FS
+
+// rulesFiles are the aliases of the embedded files.
+var rulesFiles = map[string]string{
+	"@recommended-conf": "coraza.conf-recommended.conf",
+	"@crs-setup-conf":   "crs-setup.conf.example",
+}
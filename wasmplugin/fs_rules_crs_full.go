@@ -0,0 +1,26 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !rules_none && !rules_crs_core && !rules_custom
+
+package wasmplugin
+
+import "embed"
+
+// The crs-full profile embeds CRS, its plugins and all the example configurations.
+const (
+	rulesProfile = "crs-full"
+	rulesDir     = "rules"
+)
+
+//go:embed rules
+var crs embed.FS
+
+// rulesFiles are the aliases of the embedded files.
+var rulesFiles = map[string]string{
+	"@recommended-conf":    "coraza.conf-recommended.conf",
+	"@demo-conf":           "coraza-demo.conf",
+	"@crs-setup-demo-conf": "crs-setup-demo.conf",
+	"@ftw-conf":            "ftw-config.conf",
+	"@crs-setup-conf":      "crs-setup.conf.example",
+}
@@ -0,0 +1,26 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build rules_custom
+
+package wasmplugin
+
+import "embed"
+
+// The custom profile embeds the directory copied to custom-rules by the build.
+const (
+	rulesProfile = "custom"
+	rulesDir     = "custom-rules"
+)
+
+//go:embed custom-rules
+var crs embed.FS
+
+// rulesFiles are the aliases of the files the custom rules usually provide.
+var rulesFiles = map[string]string{
+	"@recommended-conf":    "coraza.conf-recommended.conf",
+	"@demo-conf":           "coraza-demo.conf",
+	"@crs-setup-demo-conf": "crs-setup-demo.conf",
+	"@ftw-conf":            "ftw-config.conf",
+	"@crs-setup-conf":      "crs-setup.conf.example",
+}
@@ -0,0 +1,19 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build rules_none
+
+package wasmplugin
+
+import "embed"
+
+// The none profile does not embed any rules, directives have to be inlined.
+const (
+	rulesProfile = "none"
+	rulesDir     = "rules"
+)
+
+var crs embed.FS
+
+// rulesFiles is empty as no files are embedded.
+var rulesFiles = map[string]string{}
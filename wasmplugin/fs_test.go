@@ -0,0 +1,103 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayFS(t *testing.T) {
+	overlay := newOverlayFS(root, map[string][]byte{
+		"custom/app.conf":         []byte("SecRuleEngine On"),
+		"custom/data/bad-ua.data": []byte("grabber"),
+		"/etc/coraza/extra.conf":  []byte("SecRuleEngine Off"),
+		"@recommended-conf":       []byte("# overridden"),
+	})
+
+	t.Run("inlined files", func(t *testing.T) {
+		content, err := fs.ReadFile(overlay, "custom/data/bad-ua.data")
+		require.NoError(t, err)
+		require.Equal(t, "grabber", string(content))
+
+		content, err = fs.ReadFile(overlay, "/etc/coraza/extra.conf")
+		require.NoError(t, err)
+		require.Equal(t, "SecRuleEngine Off", string(content))
+
+		f, err := overlay.Open("custom/app.conf")
+		require.NoError(t, err)
+		info, err := f.Stat()
+		require.NoError(t, err)
+		require.Equal(t, "app.conf", info.Name())
+		require.EqualValues(t, 16, info.Size())
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("inlined files take precedence", func(t *testing.T) {
+		content, err := fs.ReadFile(overlay, "@recommended-conf")
+		require.NoError(t, err)
+		require.Equal(t, "# overridden", string(content))
+	})
+
+	t.Run("embedded files", func(t *testing.T) {
+		if len(embeddedCRSVersion) == 0 {
+			t.Skipf("CRS not embedded by the %s profile", rulesProfile)
+		}
+		_, err := fs.ReadFile(overlay, "@crs-setup-conf")
+		require.NoError(t, err)
+
+		_, err = fs.ReadFile(overlay, "custom/missing.conf")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		matches, err := fs.Glob(overlay, "custom/*")
+		require.NoError(t, err)
+		require.Equal(t, []string{"custom/app.conf", "custom/data"}, matches)
+
+		if len(embeddedCRSVersion) == 0 {
+			return
+		}
+		matches, err = fs.Glob(overlay, "@owasp_crs/REQUEST-901-*.conf")
+		require.NoError(t, err)
+		require.Equal(t, []string{"@owasp_crs/REQUEST-901-INITIALIZATION.conf"}, matches)
+	})
+}
+
+func TestBundleInfo(t *testing.T) {
+	content, err := fs.ReadFile(root, "@bundle-info")
+	require.NoError(t, err)
+	crsVersion := embeddedCRSVersion
+	if len(crsVersion) == 0 {
+		crsVersion = "none"
+	}
+	require.Equal(t, "# profile: "+rulesProfile+"\n# crs_version: "+crsVersion+"\n", string(content))
+
+	// The bundle info can be included.
+	_, err = newWAF(root, []string{"Include @bundle-info"})
+	require.NoError(t, err)
+}
+
+func TestRulesFiles(t *testing.T) {
+	// Aliases only point to embedded files.
+	for alias := range rulesFiles {
+		_, err := fs.ReadFile(root, alias)
+		require.NoError(t, err, alias)
+	}
+}
+
+func TestCRSVersion(t *testing.T) {
+	require.Equal(t, "", crsVersion(newOverlayFS(emptyFS{}, nil)))
+	require.Equal(t, "4.0.0", crsVersion(newOverlayFS(emptyFS{}, map[string][]byte{
+		"crs/REQUEST-901-INITIALIZATION.conf": []byte("SecAction \"id:901001,ver:'OWASP_CRS/4.0.0'\""),
+	})))
+}
+
+type emptyFS struct{}
+
+func (emptyFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
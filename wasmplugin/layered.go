@@ -0,0 +1,335 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"io"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/debuglog"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+// layeredWAF evaluates transactions through the WAFs of directives extending others, the base
+// ones first. Coraza can not add rules to a compiled WAF, so the base WAF is shared as is and
+// the directives extending it are compiled on their own.
+type layeredWAF struct {
+	layers []coraza.WAF
+}
+
+// newLayeredWAF returns a WAF evaluating the base WAF and then the extending one.
+func newLayeredWAF(base, extending coraza.WAF) coraza.WAF {
+	l := &layeredWAF{}
+	for _, waf := range []coraza.WAF{base, extending} {
+		if layered, ok := waf.(*layeredWAF); ok {
+			l.layers = append(l.layers, layered.layers...)
+		} else {
+			l.layers = append(l.layers, waf)
+		}
+	}
+	return l
+}
+
+func (w *layeredWAF) NewTransaction() ctypes.Transaction {
+	return w.newTransaction(w.layers[0].NewTransaction())
+}
+
+func (w *layeredWAF) NewTransactionWithID(id string) ctypes.Transaction {
+	return w.newTransaction(w.layers[0].NewTransactionWithID(id))
+}
+
+// newTransaction creates the transactions of the other layers with the ID of the first one.
+func (w *layeredWAF) newTransaction(first ctypes.Transaction) ctypes.Transaction {
+	tx := &layeredTransaction{layers: make([]ctypes.Transaction, 0, len(w.layers))}
+	tx.layers = append(tx.layers, first)
+	for _, waf := range w.layers[1:] {
+		tx.layers = append(tx.layers, waf.NewTransactionWithID(first.ID()))
+	}
+	return tx
+}
+
+// layeredTransaction feeds the request and the response to the transactions of every layer.
+// Rules are evaluated layer after layer, the first interruption stops the evaluation of the
+// phase. Each layer keeps its own settings and variables, e.g. its rule engine and anomaly score.
+type layeredTransaction struct {
+	layers []ctypes.Transaction
+}
+
+var _ ctypes.Transaction = (*layeredTransaction)(nil)
+
+// transactionLayers returns the transactions making up tx, the base ones first.
+func transactionLayers(tx ctypes.Transaction) []ctypes.Transaction {
+	if layered, ok := tx.(*layeredTransaction); ok {
+		return layered.layers
+	}
+	return []ctypes.Transaction{tx}
+}
+
+// transactionStates returns the states of the transactions making up tx, the base ones first.
+func transactionStates(tx ctypes.Transaction) []plugintypes.TransactionState {
+	layers := transactionLayers(tx)
+	states := make([]plugintypes.TransactionState, 0, len(layers))
+	for _, layer := range layers {
+		if state, ok := layer.(plugintypes.TransactionState); ok {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// interrupt interrupts the first layer of tx whose rule engine is On, returning false when
+// none is, as transactions only keep interruptions when their rule engine is On.
+func interrupt(tx ctypes.Transaction, interruption *ctypes.Interruption) bool {
+	for _, layer := range transactionLayers(tx) {
+		state, ok := layer.(plugintypes.TransactionState)
+		if !ok {
+			continue
+		}
+		state.Interrupt(interruption)
+		if layer.IsInterrupted() {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *layeredTransaction) ProcessConnection(client string, cPort int, server string, sPort int) {
+	for _, layer := range tx.layers {
+		layer.ProcessConnection(client, cPort, server, sPort)
+	}
+}
+
+func (tx *layeredTransaction) ProcessURI(uri string, method string, httpVersion string) {
+	for _, layer := range tx.layers {
+		layer.ProcessURI(uri, method, httpVersion)
+	}
+}
+
+func (tx *layeredTransaction) SetServerName(serverName string) {
+	for _, layer := range tx.layers {
+		layer.SetServerName(serverName)
+	}
+}
+
+func (tx *layeredTransaction) AddRequestHeader(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddRequestHeader(key, value)
+	}
+}
+
+func (tx *layeredTransaction) ProcessRequestHeaders() *ctypes.Interruption {
+	for _, layer := range tx.layers {
+		if interruption := layer.ProcessRequestHeaders(); interruption != nil {
+			return interruption
+		}
+	}
+	return nil
+}
+
+// RequestBodyReader returns the request body buffered by the first layer accessing it.
+func (tx *layeredTransaction) RequestBodyReader() (io.Reader, error) {
+	for _, layer := range tx.layers {
+		if layer.IsRequestBodyAccessible() {
+			return layer.RequestBodyReader()
+		}
+	}
+	return tx.layers[0].RequestBodyReader()
+}
+
+func (tx *layeredTransaction) AddGetRequestArgument(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddGetRequestArgument(key, value)
+	}
+}
+
+func (tx *layeredTransaction) AddPostRequestArgument(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddPostRequestArgument(key, value)
+	}
+}
+
+func (tx *layeredTransaction) AddPathRequestArgument(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddPathRequestArgument(key, value)
+	}
+}
+
+func (tx *layeredTransaction) AddResponseArgument(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddResponseArgument(key, value)
+	}
+}
+
+func (tx *layeredTransaction) ProcessRequestBody() (*ctypes.Interruption, error) {
+	for _, layer := range tx.layers {
+		if interruption, err := layer.ProcessRequestBody(); interruption != nil || err != nil {
+			return interruption, err
+		}
+	}
+	return nil, nil
+}
+
+// WriteRequestBody writes b to every layer, returning the least number of bytes written.
+func (tx *layeredTransaction) WriteRequestBody(b []byte) (*ctypes.Interruption, int, error) {
+	written := len(b)
+	for _, layer := range tx.layers {
+		interruption, n, err := layer.WriteRequestBody(b)
+		if interruption != nil || err != nil {
+			return interruption, n, err
+		}
+		if layer.IsRequestBodyAccessible() && n < written {
+			written = n
+		}
+	}
+	return nil, written, nil
+}
+
+func (tx *layeredTransaction) ReadRequestBodyFrom(r io.Reader) (*ctypes.Interruption, int, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tx.WriteRequestBody(b)
+}
+
+func (tx *layeredTransaction) AddResponseHeader(key string, value string) {
+	for _, layer := range tx.layers {
+		layer.AddResponseHeader(key, value)
+	}
+}
+
+func (tx *layeredTransaction) ProcessResponseHeaders(code int, proto string) *ctypes.Interruption {
+	for _, layer := range tx.layers {
+		if interruption := layer.ProcessResponseHeaders(code, proto); interruption != nil {
+			return interruption
+		}
+	}
+	return nil
+}
+
+// ResponseBodyReader returns the response body buffered by the first layer processing it.
+func (tx *layeredTransaction) ResponseBodyReader() (io.Reader, error) {
+	for _, layer := range tx.layers {
+		if layer.IsResponseBodyAccessible() && layer.IsResponseBodyProcessable() {
+			return layer.ResponseBodyReader()
+		}
+	}
+	return tx.layers[0].ResponseBodyReader()
+}
+
+func (tx *layeredTransaction) ProcessResponseBody() (*ctypes.Interruption, error) {
+	for _, layer := range tx.layers {
+		if interruption, err := layer.ProcessResponseBody(); interruption != nil || err != nil {
+			return interruption, err
+		}
+	}
+	return nil, nil
+}
+
+// WriteResponseBody writes b to every layer, returning the least number of bytes written.
+func (tx *layeredTransaction) WriteResponseBody(b []byte) (*ctypes.Interruption, int, error) {
+	written := len(b)
+	for _, layer := range tx.layers {
+		interruption, n, err := layer.WriteResponseBody(b)
+		if interruption != nil || err != nil {
+			return interruption, n, err
+		}
+		if layer.IsResponseBodyAccessible() && layer.IsResponseBodyProcessable() && n < written {
+			written = n
+		}
+	}
+	return nil, written, nil
+}
+
+func (tx *layeredTransaction) ReadResponseBodyFrom(r io.Reader) (*ctypes.Interruption, int, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tx.WriteResponseBody(b)
+}
+
+func (tx *layeredTransaction) ProcessLogging() {
+	for _, layer := range tx.layers {
+		layer.ProcessLogging()
+	}
+}
+
+// IsRuleEngineOff returns true when the rule engine of every layer is Off.
+func (tx *layeredTransaction) IsRuleEngineOff() bool {
+	for _, layer := range tx.layers {
+		if !layer.IsRuleEngineOff() {
+			return false
+		}
+	}
+	return true
+}
+
+func (tx *layeredTransaction) IsRequestBodyAccessible() bool {
+	for _, layer := range tx.layers {
+		if layer.IsRequestBodyAccessible() {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *layeredTransaction) IsResponseBodyAccessible() bool {
+	for _, layer := range tx.layers {
+		if layer.IsResponseBodyAccessible() {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *layeredTransaction) IsResponseBodyProcessable() bool {
+	for _, layer := range tx.layers {
+		if layer.IsResponseBodyAccessible() && layer.IsResponseBodyProcessable() {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *layeredTransaction) IsInterrupted() bool {
+	return tx.Interruption() != nil
+}
+
+func (tx *layeredTransaction) Interruption() *ctypes.Interruption {
+	for _, layer := range tx.layers {
+		if interruption := layer.Interruption(); interruption != nil {
+			return interruption
+		}
+	}
+	return nil
+}
+
+func (tx *layeredTransaction) MatchedRules() []ctypes.MatchedRule {
+	var res []ctypes.MatchedRule
+	for _, layer := range tx.layers {
+		res = append(res, layer.MatchedRules()...)
+	}
+	return res
+}
+
+// DebugLogger returns the logger of the first layer, the layers share the transaction ID.
+func (tx *layeredTransaction) DebugLogger() debuglog.Logger {
+	return tx.layers[0].DebugLogger()
+}
+
+func (tx *layeredTransaction) ID() string {
+	return tx.layers[0].ID()
+}
+
+func (tx *layeredTransaction) Close() error {
+	var res error
+	for _, layer := range tx.layers {
+		if err := layer.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayeredWAF(t *testing.T) {
+	base, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRuleEngine On
+SecRule REQUEST_URI "@beginsWith /admin" "id:101,phase:1,deny,status:403,msg:'admin'"
+SecRule REQUEST_URI "@contains attack" "id:102,phase:1,pass,msg:'attack',setvar:tx.anomaly_score=+5"
+`))
+	require.NoError(t, err)
+	tenant, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRule REQUEST_URI "@beginsWith /private" "id:201,phase:1,deny,status:401,msg:'private'"
+SecRule REQUEST_URI "@contains attack" "id:202,phase:1,pass,msg:'attack',setvar:tx.anomaly_score=+3"
+`))
+	require.NoError(t, err)
+	// Layers of layered WAFs are flattened.
+	require.Len(t, newLayeredWAF(newLayeredWAF(base, tenant), tenant).(*layeredWAF).layers, 3)
+	waf := newLayeredWAF(base, tenant)
+
+	tests := []struct {
+		uri            string
+		expectedStatus int
+		expectedRules  string
+		expectedScore  int
+	}{
+		{uri: "/", expectedRules: ""},
+		{uri: "/admin", expectedStatus: 403, expectedRules: "101"},
+		{uri: "/private", expectedStatus: 401, expectedRules: "201"},
+		{uri: "/?q=attack", expectedRules: "102,202", expectedScore: 8},
+		// The interruption stops the evaluation of the phase.
+		{uri: "/admin?q=attack", expectedStatus: 403, expectedRules: "101"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			tx := waf.NewTransactionWithID("layered")
+			defer tx.Close()
+			for _, layer := range transactionLayers(tx) {
+				require.Equal(t, "layered", layer.ID())
+			}
+
+			tx.ProcessURI(tt.uri, "GET", "HTTP/1.1")
+			interruption := tx.ProcessRequestHeaders()
+			if tt.expectedStatus == 0 {
+				require.Nil(t, interruption)
+				require.False(t, tx.IsInterrupted())
+			} else {
+				require.NotNil(t, interruption)
+				require.Equal(t, tt.expectedStatus, interruption.Status)
+				require.Equal(t, interruption, tx.Interruption())
+			}
+			require.Equal(t, tt.expectedRules, matchedRuleIDs(tx))
+			require.Equal(t, tt.expectedScore, anomalyScore(tx))
+		})
+	}
+}
+
+func TestLayeredWAFRuleEngines(t *testing.T) {
+	base, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRuleEngine DetectionOnly
+SecRule REQUEST_URI "@beginsWith /admin" "id:101,phase:1,deny,status:403,msg:'admin'"
+`))
+	require.NoError(t, err)
+	tenant, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRuleEngine Off
+`))
+	require.NoError(t, err)
+
+	tx := newLayeredWAF(base, tenant).NewTransaction()
+	defer tx.Close()
+	require.False(t, tx.IsRuleEngineOff())
+
+	// Each layer keeps its rule engine: the base one only logs the matched rule.
+	tx.ProcessURI("/admin", "GET", "HTTP/1.1")
+	require.Nil(t, tx.ProcessRequestHeaders())
+	require.Equal(t, "101", matchedRuleIDs(tx))
+
+	// Neither layer keeps interruptions.
+	require.False(t, interrupt(tx, &ctypes.Interruption{Action: "deny", Status: 403}))
+
+	tx = newLayeredWAF(tenant, base).NewTransaction()
+	defer tx.Close()
+	require.False(t, interrupt(tx, &ctypes.Interruption{Action: "deny", Status: 403}))
+
+	on, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives("SecRuleEngine On"))
+	require.NoError(t, err)
+	tx = newLayeredWAF(base, on).NewTransaction()
+	defer tx.Close()
+	require.True(t, interrupt(tx, &ctypes.Interruption{Action: "deny", Status: 403}))
+	require.True(t, tx.IsInterrupted())
+
+	tx = newLayeredWAF(tenant, tenant).NewTransaction()
+	defer tx.Close()
+	require.True(t, tx.IsRuleEngineOff())
+}
+
+func TestLayeredWAFRequestBody(t *testing.T) {
+	base, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRuleEngine On
+SecRequestBodyAccess On
+SecRequestBodyLimit 8
+SecRequestBodyLimitAction ProcessPartial
+SecRule REQUEST_BODY "@contains attack" "id:101,phase:2,deny,status:403,msg:'attack'"
+`))
+	require.NoError(t, err)
+	tenant, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecRequestBodyAccess On
+SecRule REQUEST_BODY "@contains tenant" "id:201,phase:2,deny,status:401,msg:'tenant'"
+`))
+	require.NoError(t, err)
+	waf := newLayeredWAF(base, tenant)
+
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	require.True(t, tx.IsRequestBodyAccessible())
+	tx.ProcessURI("/", "POST", "HTTP/1.1")
+	tx.AddRequestHeader("Content-Type", "application/x-www-form-urlencoded")
+	require.Nil(t, tx.ProcessRequestHeaders())
+	// The least number of bytes written by the layers is reported.
+	_, n, err := tx.WriteRequestBody([]byte("body of the tenant"))
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+	interruption, err := tx.ProcessRequestBody()
+	require.NoError(t, err)
+	require.NotNil(t, interruption)
+	require.Equal(t, "201", matchedRuleIDs(tx))
+}
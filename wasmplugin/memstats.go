@@ -5,6 +5,16 @@
 
 package wasmplugin
 
+import "runtime"
+
 func logMemStats() {
 	// no-op without build tag
 }
+
+// heapBytes returns the size of the heap objects, garbage included: collecting it first is
+// too costly to do at every start.
+func heapBytes() uint64 {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
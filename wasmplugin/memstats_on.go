@@ -22,3 +22,12 @@ func logMemStats() {
 		ms.HeapReleased,
 		ms.TotalAlloc)
 }
+
+// heapBytes returns the size of the objects reachable on the heap, collecting the others first
+// so that the memory allocated while parsing directives and released since isn't accounted.
+func heapBytes() uint64 {
+	runtime.GC()
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
@@ -0,0 +1,167 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const (
+	defaultCollectionTTL           = time.Hour
+	defaultCollectionMaxRecordSize = 4096
+	defaultCollectionMaxRecords    = 16384
+	collectionSharedDataKeyPrefix  = "coraza.persistence."
+)
+
+var errRecordTooLarge = errors.New("persistent record exceeds the maximum size")
+
+// persistentCollections are the collections that can be initialized with initcol and
+// survive the transaction. Coraza does not expose them as variables, hence their
+// values are mirrored into TX prefixed by the collection name (e.g. TX:ip.counter).
+var persistentCollections = map[string]struct{}{
+	"global":   {},
+	"ip":       {},
+	"resource": {},
+	"session":  {},
+	"user":     {},
+}
+
+// collectionStore persists collections across transactions and Envoy worker threads
+// using the proxy-wasm shared data. Shared data does not support deletions, so the records
+// of each collection are kept in at most maxRecords slots of its own: expired records are
+// reset lazily when they are accessed again, and a record evicts the one of another key of
+// the same collection sharing its slot. Rotating keys of a collection, e.g. SESSION, can
+// therefore not evict the records of another one, e.g. IP.
+type collectionStore struct {
+	ttl           time.Duration
+	maxRecordSize int
+	maxRecords    int
+	now           func() time.Time
+}
+
+// collections is the store used by the initcol and setvar actions. Actions are registered
+// globally, hence the store is reconfigured on plugin start.
+var collections = newCollectionStore(persistenceConfiguration{})
+
+func newCollectionStore(cfg persistenceConfiguration) *collectionStore {
+	s := &collectionStore{
+		ttl:           cfg.ttl,
+		maxRecordSize: cfg.maxRecordSize,
+		maxRecords:    cfg.maxRecords,
+		now:           time.Now,
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultCollectionTTL
+	}
+	if s.maxRecordSize <= 0 {
+		s.maxRecordSize = defaultCollectionMaxRecordSize
+	}
+	if s.maxRecords <= 0 {
+		s.maxRecords = defaultCollectionMaxRecords
+	}
+	return s
+}
+
+// get returns the values of the record, isNew is true when the record does not exist or has expired.
+func (s *collectionStore) get(collection, key string) (url.Values, bool, error) {
+	return s.load(collection, key)
+}
+
+// update applies fn to the record and stores it back, retrying when another worker
+// modified the record in between.
+func (s *collectionStore) update(collection, key string, fn func(url.Values)) (url.Values, error) {
+	var values url.Values
+	err := updateSharedData(s.sharedDataKey(collection, key), func(data []byte, found bool) ([]byte, error) {
+		values, _ = s.decode(collection, key, data, found)
+		fn(values)
+
+		data = encodeRecord(s.now().Add(s.ttl), collection+"."+key, values)
+		if len(data) > s.maxRecordSize {
+			return nil, errRecordTooLarge
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (s *collectionStore) load(collection, key string) (url.Values, bool, error) {
+	data, _, err := proxywasm.GetSharedData(s.sharedDataKey(collection, key))
+	if err != nil && err != types.ErrorStatusNotFound {
+		return nil, false, err
+	}
+
+	values, isNew := s.decode(collection, key, data, err == nil)
+	return values, isNew, nil
+}
+
+// decode returns the values of the record of key stored in its slot. Missing, corrupted
+// and expired records, as well as records of other keys, are returned as new empty records,
+// so they get overwritten on update.
+func (s *collectionStore) decode(collection, key string, data []byte, found bool) (url.Values, bool) {
+	if !found {
+		return url.Values{}, true
+	}
+
+	expiresAt, recordKey, values, err := decodeRecord(data)
+	if err != nil || recordKey != collection+"."+key || !s.now().Before(expiresAt) {
+		return url.Values{}, true
+	}
+
+	return values, false
+}
+
+func (s *collectionStore) sharedDataKey(collection, key string) string {
+	return sharedDataSlotKey(collectionSharedDataKeyPrefix+collection+".", key, s.maxRecords)
+}
+
+// encodeRecord serializes a record as its expiration time (unix seconds) and its key,
+// followed by the url encoded values. The output is never empty, as expected by the
+// shared data.
+func encodeRecord(expiresAt time.Time, key string, values url.Values) []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.FormatInt(expiresAt.Unix(), 10))
+	b.WriteByte('\n')
+	b.WriteString(url.QueryEscape(key))
+	b.WriteByte('\n')
+	b.WriteString(values.Encode())
+	return b.Bytes()
+}
+
+func decodeRecord(data []byte) (time.Time, string, url.Values, error) {
+	rawExpiresAt, rest, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return time.Time{}, "", nil, errors.New("malformed persistent record")
+	}
+	rawKey, rawValues, ok := bytes.Cut(rest, []byte{'\n'})
+	if !ok {
+		return time.Time{}, "", nil, errors.New("malformed persistent record")
+	}
+
+	expiresAt, err := strconv.ParseInt(string(rawExpiresAt), 10, 64)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	key, err := url.QueryUnescape(string(rawKey))
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	values, err := url.ParseQuery(string(rawValues))
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	return time.Unix(expiresAt, 0), key, values, nil
+}
@@ -0,0 +1,221 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func newTestCollectionStore(t *testing.T, cfg persistenceConfiguration) (*collectionStore, *time.Time) {
+	t.Helper()
+
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	t.Cleanup(reset)
+
+	now := time.Unix(1680000000, 0)
+	s := newCollectionStore(cfg)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func increment(key string) func(url.Values) {
+	return func(values url.Values) {
+		res, _ := setvarResult(values.Get(key), "+1")
+		values.Set(key, res)
+	}
+}
+
+func TestCollectionStore(t *testing.T) {
+	t.Run("new record", func(t *testing.T) {
+		s, _ := newTestCollectionStore(t, persistenceConfiguration{})
+
+		values, isNew, err := s.get("ip", "127.0.0.1")
+		require.NoError(t, err)
+		require.True(t, isNew)
+		require.Empty(t, values)
+	})
+
+	t.Run("update is persisted", func(t *testing.T) {
+		s, _ := newTestCollectionStore(t, persistenceConfiguration{})
+
+		for i := 0; i < 3; i++ {
+			_, err := s.update("ip", "127.0.0.1", increment("counter"))
+			require.NoError(t, err)
+		}
+
+		values, isNew, err := s.get("ip", "127.0.0.1")
+		require.NoError(t, err)
+		require.False(t, isNew)
+		require.Equal(t, "3", values.Get("counter"))
+
+		// Records are scoped by collection and key.
+		values, isNew, err = s.get("session", "127.0.0.1")
+		require.NoError(t, err)
+		require.True(t, isNew)
+		require.Empty(t, values)
+	})
+
+	t.Run("update retries on cas mismatch", func(t *testing.T) {
+		s, _ := newTestCollectionStore(t, persistenceConfiguration{})
+
+		_, err := s.update("ip", "127.0.0.1", increment("counter"))
+		require.NoError(t, err)
+
+		attempts := 0
+		values, err := s.update("ip", "127.0.0.1", func(values url.Values) {
+			attempts++
+			if attempts == 1 {
+				// Simulates a concurrent update from another worker.
+				_, err := s.update("ip", "127.0.0.1", increment("counter"))
+				require.NoError(t, err)
+			}
+			increment("counter")(values)
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, attempts)
+		require.Equal(t, "3", values.Get("counter"))
+	})
+
+	t.Run("expired record is reset", func(t *testing.T) {
+		s, now := newTestCollectionStore(t, persistenceConfiguration{ttl: time.Minute})
+
+		_, err := s.update("ip", "127.0.0.1", increment("counter"))
+		require.NoError(t, err)
+
+		*now = now.Add(30 * time.Second)
+		values, err := s.update("ip", "127.0.0.1", increment("counter"))
+		require.NoError(t, err)
+		require.Equal(t, "2", values.Get("counter"))
+
+		// Each update extends the expiration.
+		*now = now.Add(time.Minute)
+		values, isNew, err := s.get("ip", "127.0.0.1")
+		require.NoError(t, err)
+		require.True(t, isNew)
+		require.Empty(t, values)
+
+		values, err = s.update("ip", "127.0.0.1", increment("counter"))
+		require.NoError(t, err)
+		require.Equal(t, "1", values.Get("counter"))
+	})
+
+	t.Run("record size cap", func(t *testing.T) {
+		s, _ := newTestCollectionStore(t, persistenceConfiguration{maxRecordSize: 64})
+
+		_, err := s.update("ip", "127.0.0.1", func(values url.Values) {
+			values.Set("payload", strings.Repeat("a", 64))
+		})
+		require.ErrorIs(t, err, errRecordTooLarge)
+
+		_, isNew, err := s.get("ip", "127.0.0.1")
+		require.NoError(t, err)
+		require.True(t, isNew)
+	})
+
+	t.Run("corrupted record is reset", func(t *testing.T) {
+		s, _ := newTestCollectionStore(t, persistenceConfiguration{})
+
+		require.NoError(t, proxywasm.SetSharedData(s.sharedDataKey("ip", "127.0.0.1"), []byte("garbage"), 0))
+
+		values, err := s.update("ip", "127.0.0.1", increment("counter"))
+		require.NoError(t, err)
+		require.Equal(t, "1", values.Get("counter"))
+	})
+}
+
+func TestCollectionStoreSlots(t *testing.T) {
+	s, now := newTestCollectionStore(t, persistenceConfiguration{ttl: time.Hour, maxRecords: 1})
+
+	_, err := s.update("ip", "127.0.0.1", increment("counter"))
+	require.NoError(t, err)
+
+	// Records sharing a slot evict each other rather than mixing their values.
+	values, isNew, err := s.get("ip", "127.0.0.2")
+	require.NoError(t, err)
+	require.True(t, isNew)
+	require.Empty(t, values)
+
+	values, err = s.update("ip", "127.0.0.2", increment("counter"))
+	require.NoError(t, err)
+	require.Equal(t, "1", values.Get("counter"))
+
+	_, isNew, err = s.get("ip", "127.0.0.1")
+	require.NoError(t, err)
+	require.True(t, isNew)
+
+	// Whatever the number of keys, records are kept in maxRecords slots per collection, so
+	// rotating the keys of a collection does not evict the records of another one.
+	for i := 0; i < 100; i++ {
+		*now = now.Add(time.Second)
+		_, err := s.update("session", strconv.Itoa(i), increment("counter"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, s.sharedDataKey("session", "0"), s.sharedDataKey("session", "99"))
+	require.NotEqual(t, s.sharedDataKey("ip", "127.0.0.2"), s.sharedDataKey("session", "99"))
+
+	values, isNew, err = s.get("ip", "127.0.0.2")
+	require.NoError(t, err)
+	require.False(t, isNew)
+	require.Equal(t, "1", values.Get("counter"))
+}
+
+func TestSetvarTxCollection(t *testing.T) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecAction "id:1,phase:1,pass,nolog,setvar:tx.unset=-5,setvar:tx.score=+5,setvar:tx.score=-2,setvar:tx.name=-1"
+SecAction "id:2,phase:1,pass,nolog,setvar:tx.name=panda,setvar:tx.name=-1,setvar:tx.empty="
+`))
+	require.NoError(t, err)
+
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	tx.ProcessRequestHeaders()
+
+	// TX keeps the semantics of the Coraza setvar, e.g. decrementing unset variables is ignored.
+	col := tx.(plugintypes.TransactionState).Variables().TX()
+	require.Empty(t, col.Get("unset"))
+	require.Equal(t, []string{"3"}, col.Get("score"))
+	require.Equal(t, []string{"panda"}, col.Get("name"))
+	require.Equal(t, []string{""}, col.Get("empty"))
+}
+
+func TestSetvarResult(t *testing.T) {
+	tests := []struct {
+		current   string
+		value     string
+		expected  string
+		expectErr bool
+	}{
+		{current: "", value: "", expected: ""},
+		{current: "", value: "abc", expected: "abc"},
+		{current: "", value: "+5", expected: "5"},
+		{current: "3", value: "+", expected: "3"},
+		{current: "3", value: "-5", expected: "-2"},
+		{current: "abc", value: "+1", expectErr: true},
+		{current: "1", value: "+abc", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.current+" "+tt.value, func(t *testing.T) {
+			res, err := setvarResult(tt.current, tt.value)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, res)
+		})
+	}
+}
@@ -8,16 +8,21 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/corazawaf/coraza/v3"
 	"github.com/corazawaf/coraza/v3/debuglog"
 	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/operators"
 )
 
 type vmContext struct {
@@ -83,9 +88,13 @@ type corazaPlugin struct {
 	// Embed the default plugin context here,
 	// so that we don't need to reimplement all the methods.
 	types.DefaultPluginContext
-	perAuthorityWAFs wafMap
-	metricLabelsKV   []string
-	metrics          *wafMetrics
+	perAuthorityWAFs  wafMap
+	metricLabelsKV    []string
+	metrics           *wafMetrics
+	rateLimits        []rateLimitConfiguration
+	blocklist         *blocklist
+	directivesSource  *directivesSource
+	directivesOptions map[string]directivesOptions
 }
 
 func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
@@ -100,26 +109,67 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 		return types.OnPluginStartStatusFailed
 	}
 
-	perAuthorityWAFs := newWAFMap(len(config.directivesMap))
+	proxywasm.LogInfof("Embedded rules profile %q, CRS version %q", rulesProfile, embeddedCRSVersion)
+
+	collections = newCollectionStore(config.persistence)
+
+	rootFS := root
+	if len(config.files) > 0 {
+		rootFS = newOverlayFS(root, config.files)
+	}
+
+	if len(config.geoIPDatabase) > 0 {
+		db, err := loadGeoDatabase(rootFS, config.geoIPDatabase)
+		if err != nil {
+			proxywasm.LogCriticalf("Failed to load GeoIP database %q: %v", config.geoIPDatabase, err)
+			return types.OnPluginStartStatusFailed
+		}
+		proxywasm.LogInfof("GeoIP database %q loaded, %d networks", config.geoIPDatabase, db.Networks())
+		config.operators.GeoDatabase = db
+	}
+	// Operators read their configuration when directives are parsed.
+	operators.Configure(config.operators)
+
+	addDebugRules(config.directivesMap, config.directivesExtends, config.directivesOptions)
+
+	crsIncluded := false
 	for name, directives := range config.directivesMap {
-		// First we initialize our waf and our seclang parser
-		conf := coraza.NewWAFConfig().
-			WithErrorCallback(logError).
-			WithDebugLogger(debuglog.DefaultWithPrinterFactory(logPrinterFactory)).
-			// TODO(anuraaga): Make this configurable in plugin configuration.
-			// WithRequestBodyLimit(1024 * 1024 * 1024).
-			// WithRequestBodyInMemoryLimit(1024 * 1024 * 1024).
-			// Limit equal to MemoryLimit: TinyGo compilation will prevent
-			// buffering request body to files anyways.
-			WithRootFS(root)
-
-		waf, err := coraza.NewWAF(conf.WithDirectives(strings.Join(directives, "\n")))
+		expandedDirectives, expanded, err := expandCRSPlugins(rootFS, directives, config.crsPlugins)
+		if err != nil {
+			proxywasm.LogCriticalf("Failed to load CRS plugins: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+		config.directivesMap[name] = expandedDirectives
+		crsIncluded = crsIncluded || expanded
+	}
+	if len(config.crsPlugins) > 0 && !crsIncluded {
+		proxywasm.LogWarnf("CRS plugins are only loaded along with includes of %q, not found in any directives", crsRulesDir)
+	}
+
+	names := make([]string, 0, len(config.directivesMap))
+	for name := range config.directivesMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cache := newWAFCache(rootFS)
+	compiled := make(map[string]coraza.WAF, len(names))
+	for _, name := range names {
+		directives := config.directivesMap[name]
+		if _, ok := config.directivesExtends[name]; ok && len(directives) == 0 {
+			continue
+		}
+		waf, err := cache.get(name, directives)
 		if err != nil {
 			proxywasm.LogCriticalf("Failed to parse directives: %v", err)
 			return types.OnPluginStartStatusFailed
 		}
+		compiled[name] = waf
+	}
 
-		err = perAuthorityWAFs.put(name, waf)
+	perAuthorityWAFs := newWAFMap(len(config.directivesMap))
+	for _, name := range names {
+		err = perAuthorityWAFs.put(name, extendedWAF(name, compiled, config.directivesExtends))
 		if err != nil {
 			proxywasm.LogCriticalf("Failed to register authority WAF: %v", err)
 			return types.OnPluginStartStatusFailed
@@ -138,16 +188,136 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 		ctx.metricLabelsKV = append(ctx.metricLabelsKV, k, v)
 	}
 	ctx.metrics = NewWAFMetrics()
+	ctx.rateLimits = config.rateLimits
+	ctx.directivesOptions = config.directivesOptions
+
+	activeBlocklist = nil
+	if config.blocklist.enabled {
+		queueID, err := proxywasm.RegisterSharedQueue(config.blocklist.queue)
+		if err != nil {
+			proxywasm.LogCriticalf("Failed to register the blocklist queue: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+
+		ctx.blocklist = newBlocklist(queueID)
+		if err := ctx.blocklist.sync(); err != nil {
+			proxywasm.LogWarnf("Failed to synchronize the blocklist: %v", err)
+		}
+		activeBlocklist = ctx.blocklist
+	}
+
+	if config.directivesSource.enabled {
+		ctx.directivesSource = newDirectivesSource(config.directivesSource,
+			config.directivesMap[config.directivesSource.directives], rootFS, config.crsPlugins, perAuthorityWAFs)
+		if base, ok := config.directivesExtends[config.directivesSource.directives]; ok {
+			ctx.directivesSource.base = extendedWAF(base, compiled, config.directivesExtends)
+		}
+		ctx.directivesSource.warnNotLoaded()
+		if err := ctx.directivesSource.fetch(); err != nil {
+			proxywasm.LogErrorf("Failed to fetch directives from cluster %q: %v", config.directivesSource.cluster, err)
+		}
+	}
+
+	if period := tickPeriod(config); period > 0 {
+		if err := proxywasm.SetTickPeriodMilliSeconds(uint32(period.Milliseconds())); err != nil {
+			proxywasm.LogCriticalf("Failed to set the tick period: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+	}
 
 	return types.OnPluginStartStatusOK
 }
 
+// tickPeriod returns the shortest period among the features relying on OnTick, 0 if none.
+func tickPeriod(config pluginConfiguration) time.Duration {
+	var period time.Duration
+	for _, p := range []time.Duration{
+		config.blocklist.syncPeriod,
+		config.directivesSource.refreshPeriod,
+	} {
+		if p > 0 && (period == 0 || p < period) {
+			period = p
+		}
+	}
+	return period
+}
+
+// OnQueueReady drains the blocklist queue, the entries are stored in the shared data
+// and picked up by the other workers on their next tick.
+func (ctx *corazaPlugin) OnQueueReady(queueID uint32) {
+	if ctx.blocklist == nil || queueID != ctx.blocklist.queueID {
+		return
+	}
+
+	if err := ctx.blocklist.drain(); err != nil {
+		proxywasm.LogErrorf("Failed to update the blocklist: %v", err)
+	}
+}
+
+func (ctx *corazaPlugin) OnTick() {
+	if ctx.blocklist != nil {
+		if err := ctx.blocklist.sync(); err != nil {
+			proxywasm.LogErrorf("Failed to synchronize the blocklist: %v", err)
+		}
+	}
+
+	if ctx.directivesSource != nil {
+		ctx.directivesSource.tick()
+	}
+}
+
+// loadGeoDatabase parses the GeoIP database at path, either embedded or inlined.
+func loadGeoDatabase(rootFS fs.FS, path string) (*operators.GeoDatabase, error) {
+	data, err := fs.ReadFile(rootFS, path)
+	if err != nil {
+		return nil, err
+	}
+	return operators.ParseGeoDatabase(data)
+}
+
+// extendedWAF returns the WAF of the directives name, layered on top of the WAFs of the directives
+// it extends, recursively. Directives only extending others, without their own, share their WAF.
+func extendedWAF(name string, compiled map[string]coraza.WAF, extends map[string]string) coraza.WAF {
+	waf, ok := compiled[name]
+	base, extending := extends[name]
+	switch {
+	case !extending:
+		return waf
+	case !ok:
+		proxywasm.LogInfof("Directives %q only extend %q, sharing its WAF", name, base)
+		return extendedWAF(base, compiled, extends)
+	default:
+		proxywasm.LogInfof("Directives %q extend %q, evaluated after its shared WAF", name, base)
+		return newLayeredWAF(extendedWAF(base, compiled, extends), waf)
+	}
+}
+
+// newWAF compiles the given directives into a WAF, resolving the files they reference from rootFS.
+func newWAF(rootFS fs.FS, directives []string) (coraza.WAF, error) {
+	// First we initialize our waf and our seclang parser
+	conf := coraza.NewWAFConfig().
+		WithErrorCallback(logError).
+		WithDebugLogger(debuglog.DefaultWithPrinterFactory(logPrinterFactory)).
+		// TODO(anuraaga): Make this configurable in plugin configuration.
+		// WithRequestBodyLimit(1024 * 1024 * 1024).
+		// WithRequestBodyInMemoryLimit(1024 * 1024 * 1024).
+		// Limit equal to MemoryLimit: TinyGo compilation will prevent
+		// buffering request body to files anyways.
+		WithRootFS(rootFS)
+
+	return coraza.NewWAF(conf.WithDirectives(strings.Join(directives, "\n")))
+}
+
 func (ctx *corazaPlugin) NewHttpContext(contextID uint32) types.HttpContext {
 	return &httpContext{
-		contextID:        contextID,
-		metrics:          ctx.metrics,
-		metricLabelsKV:   ctx.metricLabelsKV,
-		perAuthorityWAFs: ctx.perAuthorityWAFs,
+		contextID:         contextID,
+		metrics:           ctx.metrics,
+		metricLabelsKV:    ctx.metricLabelsKV,
+		perAuthorityWAFs:  ctx.perAuthorityWAFs,
+		rateLimits:        ctx.rateLimits,
+		blocklist:         ctx.blocklist,
+		directivesSource:  ctx.directivesSource,
+		directivesOptions: ctx.directivesOptions,
 	}
 }
 
@@ -195,6 +365,15 @@ type httpContext struct {
 	interruptedAt         interruptionPhase
 	logger                debuglog.Logger
 	metricLabelsKV        []string
+	rateLimits            []rateLimitConfiguration
+	blocklist             *blocklist
+	directivesSource      *directivesSource
+	// directivesOptions are the options of every directives, options the ones evaluating
+	// this request.
+	directivesOptions map[string]directivesOptions
+	options           directivesOptions
+	// debug is true when the request has a valid debug header.
+	debug bool
 }
 
 func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
@@ -217,8 +396,27 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 			ctx.tx.AddRequestHeader("Host", authority)
 			ctx.tx.SetServerName(parseServerName(ctx.logger, authority))
 
+			directives := authority
 			if !isDefault {
 				ctx.metricLabelsKV = append(ctx.metricLabelsKV, "authority", authority)
+			} else {
+				directives = ctx.perAuthorityWAFs.defaultKey
+			}
+			ctx.options = ctx.directivesOptions[directives]
+			if ctx.directivesSource != nil && ctx.directivesSource.rejects(directives) {
+				ctx.logger.Info().
+					Str("directives", directives).
+					Msg("Directives not fetched yet, rejecting the request")
+				return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, &ctypes.Interruption{
+					Action: "deny",
+					Status: directivesNotLoadedStatusCode,
+				})
+			}
+			if ctx.options.annotateUpstream {
+				stripUpstreamAnnotations()
+			}
+			if ctx.options.debugHeader.enabled() {
+				ctx.checkDebugHeader(authority)
 			}
 		} else {
 			proxywasm.LogWarnf("Failed to resolve WAF for authority %q: %v", authority, resolveWAFErr)
@@ -244,6 +442,13 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 
 	tx.ProcessConnection(srcIP, srcPort, dstIP, dstPort)
 
+	// Blocklisted clients are rejected before any further processing.
+	if ctx.blocklist != nil && ctx.blocklist.blocked(srcIP) {
+		if interruption := ctx.blocklistInterruption(srcIP); interruption != nil {
+			return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, interruption)
+		}
+	}
+
 	// Note the pseudo-header :path includes the query.
 	// See https://httpwg.org/specs/rfc9113.html#rfc.section.8.3.1
 	uri, err := proxywasm.GetHttpRequestHeader(":path")
@@ -283,11 +488,37 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		tx.AddRequestHeader(h[0], h[1])
 	}
 
+	// Rate limits are enforced before evaluating rules, so abusive clients are rejected cheaply.
+	if interruption := ctx.enforceRateLimits(srcIP, hs); interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, interruption)
+	}
+
 	interruption := tx.ProcessRequestHeaders()
 	if interruption != nil {
 		return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, interruption)
 	}
 
+	if ctx.options.annotateUpstream {
+		if !endOfStream {
+			// Headers are held until the request body is processed, so that the annotations
+			// account for the request body rules.
+			return types.ActionPause
+		}
+
+		// Without a body, the request body rules are evaluated right away instead of along
+		// with the response.
+		ctx.processedRequestBody = true
+		interruption, err := tx.ProcessRequestBody()
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to process request body")
+			return types.ActionContinue
+		}
+		if interruption != nil {
+			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+		}
+		ctx.annotateUpstreamRequest()
+	}
+
 	return types.ActionContinue
 }
 
@@ -330,6 +561,9 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
 		}
 
+		if ctx.options.annotateUpstream {
+			ctx.annotateUpstreamRequest()
+		}
 		return types.ActionContinue
 	}
 
@@ -379,12 +613,70 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
 		}
 
+		if ctx.options.annotateUpstream {
+			ctx.annotateUpstreamRequest()
+		}
 		return types.ActionContinue
 	}
 
 	return types.ActionPause
 }
 
+func (ctx *httpContext) OnHttpRequestTrailers(numTrailers int) types.Action {
+	defer logTime("OnHttpRequestTrailers", currentTime())
+
+	if ctx.interruptedAt.isInterrupted() {
+		ctx.logger.Error().
+			Str("interruption_handled_phase", ctx.interruptedAt.String()).
+			Msg("Interruption already handled")
+		return types.ActionPause
+	}
+
+	if ctx.tx == nil {
+		return types.ActionContinue
+	}
+
+	tx := ctx.tx
+
+	if tx.IsRuleEngineOff() {
+		return types.ActionContinue
+	}
+
+	// Trailers (e.g. gRPC over HTTP/2) are exposed to rules as request headers.
+	hs, err := proxywasm.GetHttpRequestTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get request trailers")
+	} else {
+		for _, h := range hs {
+			tx.AddRequestHeader(h[0], h[1])
+		}
+	}
+
+	if ctx.processedRequestBody {
+		return types.ActionContinue
+	}
+
+	// When the request ends with a trailers frame, OnHttpRequestBody never sees endOfStream,
+	// hence the request body has to be processed here.
+	ctx.processedRequestBody = true
+	ctx.bodyReadIndex = 0 // cleaning for further usage
+	interruption, err := tx.ProcessRequestBody()
+	if err != nil {
+		ctx.logger.Error().
+			Err(err).
+			Msg("Failed to process request body")
+		return types.ActionContinue
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+	}
+
+	if ctx.options.annotateUpstream {
+		ctx.annotateUpstreamRequest()
+	}
+	return types.ActionContinue
+}
+
 func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
 	defer logTime("OnHttpResponseHeaders", currentTime())
 
@@ -407,6 +699,7 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 	tx := ctx.tx
 
 	if tx.IsRuleEngineOff() {
+		ctx.mutateResponseHeaders()
 		return types.ActionContinue
 	}
 
@@ -454,6 +747,12 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 		return ctx.handleInterruption(interruptionPhaseHttpResponseHeaders, interruption)
 	}
 
+	// Headers are mutated once evaluated, so that rules see the upstream ones.
+	ctx.mutateResponseHeaders()
+	if ctx.debug {
+		ctx.addDebugResponseHeader()
+	}
+
 	return types.ActionContinue
 }
 
@@ -550,6 +849,57 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 	return types.ActionPause
 }
 
+func (ctx *httpContext) OnHttpResponseTrailers(numTrailers int) types.Action {
+	defer logTime("OnHttpResponseTrailers", currentTime())
+
+	if ctx.interruptedAt.isInterrupted() {
+		ctx.logger.Debug().
+			Str("interruption_handled_phase", ctx.interruptedAt.String()).
+			Msg("Interruption already handled")
+		return types.ActionContinue
+	}
+
+	if ctx.tx == nil {
+		return types.ActionContinue
+	}
+
+	tx := ctx.tx
+
+	if tx.IsRuleEngineOff() {
+		return types.ActionContinue
+	}
+
+	// Trailers (e.g. grpc-status) are exposed to rules as response headers.
+	hs, err := proxywasm.GetHttpResponseTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get response trailers")
+	} else {
+		for _, h := range hs {
+			tx.AddResponseHeader(h[0], h[1])
+		}
+	}
+
+	if ctx.processedResponseBody {
+		return types.ActionContinue
+	}
+
+	// When the response ends with a trailers frame, OnHttpResponseBody never sees endOfStream.
+	// The body buffered so far is still held by the proxy, so it can be replaced in case of interruption.
+	ctx.processedResponseBody = true
+	interruption, err := tx.ProcessResponseBody()
+	if err != nil {
+		ctx.logger.Error().
+			Err(err).
+			Msg("Failed to process response body")
+		return types.ActionContinue
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+	}
+
+	return types.ActionContinue
+}
+
 func (ctx *httpContext) OnHttpStreamDone() {
 	defer logTime("OnHttpStreamDone", currentTime())
 	tx := ctx.tx
@@ -576,6 +926,11 @@ func (ctx *httpContext) OnHttpStreamDone() {
 		ctx.tx.ProcessLogging()
 
 		_ = ctx.tx.Close()
+		if ctx.blocklist != nil {
+			if err := ctx.blocklist.flush(); err != nil {
+				ctx.logger.Error().Err(err).Msg("Failed to push blocklist entries")
+			}
+		}
 		ctx.logger.Info().Msg("Finished")
 		logMemStats()
 	}
@@ -615,6 +970,9 @@ func (ctx *httpContext) handleInterruption(phase interruptionPhase, interruption
 }
 
 func logError(error ctypes.MatchedRule) {
+	if error.TransactionID() == summaryTransactionID {
+		return
+	}
 	msg := error.ErrorLog(0)
 	switch error.Rule().Severity() {
 	case ctypes.RuleSeverityEmergency:
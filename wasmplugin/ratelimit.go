@@ -0,0 +1,204 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	rateLimitKeyRemoteAddr       = "remote_addr"
+	rateLimitKeyHeaderPrefix     = "header:"
+	rateLimitActionDeny          = "deny"
+	rateLimitActionLog           = "log"
+	rateLimitSharedDataKeyPrefix = "coraza.ratelimit."
+	rateLimitStatusCode          = 429
+	defaultRateLimitBuckets      = 65536
+)
+
+// rateLimitConfiguration configures a token bucket of limit tokens refilled over window
+// for each value of key (the client address or a request header). Values are hashed into
+// at most buckets buckets, so that clients can't grow the shared data by rotating them.
+type rateLimitConfiguration struct {
+	name    string
+	key     string
+	limit   int
+	window  time.Duration
+	action  string
+	buckets int
+}
+
+func (c rateLimitConfiguration) validate() error {
+	if c.key != rateLimitKeyRemoteAddr &&
+		(!strings.HasPrefix(c.key, rateLimitKeyHeaderPrefix) || len(c.key) == len(rateLimitKeyHeaderPrefix)) {
+		return fmt.Errorf("invalid key %q, expected %q or %q", c.key, rateLimitKeyRemoteAddr, rateLimitKeyHeaderPrefix+"<name>")
+	}
+	if c.limit <= 0 {
+		return errors.New("limit must be positive")
+	}
+	if c.window <= 0 {
+		return errors.New("window must be positive")
+	}
+	if c.buckets <= 0 {
+		return errors.New("buckets must be positive")
+	}
+	if c.action != rateLimitActionDeny && c.action != rateLimitActionLog {
+		return fmt.Errorf("invalid action %q, expected %q or %q", c.action, rateLimitActionDeny, rateLimitActionLog)
+	}
+	return nil
+}
+
+// keyValue resolves the value identifying the client, empty if not present in the request.
+func (c rateLimitConfiguration) keyValue(remoteAddr string, headers [][2]string) string {
+	if c.key == rateLimitKeyRemoteAddr {
+		return remoteAddr
+	}
+
+	name := c.key[len(rateLimitKeyHeaderPrefix):]
+	for _, h := range headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// rateLimitResult is the outcome of consuming a token from a bucket.
+type rateLimitResult struct {
+	exceeded  bool
+	remaining int
+}
+
+// consumeRateLimitToken takes a token from the bucket of value, the bucket lives in the
+// shared data so that it is enforced across Envoy worker threads. Values hashed to the same
+// bucket share it, and buckets left idle for a window are full again, as if they were new.
+func consumeRateLimitToken(c rateLimitConfiguration, value string, now time.Time) (rateLimitResult, error) {
+	var res rateLimitResult
+	key := sharedDataSlotKey(rateLimitSharedDataKeyPrefix+c.name+".", value, c.buckets)
+	err := updateSharedData(key, func(data []byte, found bool) ([]byte, error) {
+		tokens := float64(c.limit)
+		if found {
+			if storedTokens, last, err := decodeTokenBucket(data); err == nil {
+				refill := float64(now.Sub(last)) / float64(c.window) * float64(c.limit)
+				tokens = math.Min(float64(c.limit), storedTokens+math.Max(refill, 0))
+			}
+		}
+
+		res.exceeded = tokens < 1
+		if !res.exceeded {
+			tokens--
+		}
+		res.remaining = int(tokens)
+
+		return encodeTokenBucket(tokens, now), nil
+	})
+	return res, err
+}
+
+// encodeTokenBucket serializes a bucket as its tokens and the last refill (unix nanoseconds).
+func encodeTokenBucket(tokens float64, last time.Time) []byte {
+	return []byte(strconv.FormatFloat(tokens, 'f', -1, 64) + " " + strconv.FormatInt(last.UnixNano(), 10))
+}
+
+func decodeTokenBucket(data []byte) (float64, time.Time, error) {
+	rawTokens, rawLast, ok := strings.Cut(string(data), " ")
+	if !ok {
+		return 0, time.Time{}, errors.New("malformed token bucket")
+	}
+
+	tokens, err := strconv.ParseFloat(rawTokens, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	last, err := strconv.ParseInt(rawLast, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return tokens, time.Unix(0, last), nil
+}
+
+// enforceRateLimits consumes a token from each configured rate limit before rules are evaluated.
+// The outcome is exposed to rules as TX:rate_limit_exceeded and TX:rate_limit_remaining, an
+// interruption is returned when a limit with the deny action is exceeded, unless the rule
+// engine is DetectionOnly.
+func (ctx *httpContext) enforceRateLimits(remoteAddr string, headers [][2]string) *ctypes.Interruption {
+	if len(ctx.rateLimits) == 0 {
+		return nil
+	}
+
+	var interruption *ctypes.Interruption
+	exceeded := false
+	remaining := -1
+	now := time.Now()
+	for _, rl := range ctx.rateLimits {
+		value := rl.keyValue(remoteAddr, headers)
+		if len(value) == 0 {
+			continue
+		}
+
+		res, err := consumeRateLimitToken(rl, value, now)
+		if err != nil {
+			ctx.logger.Error().
+				Err(err).
+				Str("rate_limit", rl.name).
+				Msg("Failed to consume rate limit token")
+			continue
+		}
+
+		if remaining == -1 || res.remaining < remaining {
+			remaining = res.remaining
+		}
+
+		if !res.exceeded {
+			continue
+		}
+
+		exceeded = true
+		ctx.logger.Warn().
+			Str("rate_limit", rl.name).
+			Str("rate_limit_key", value).
+			Str("action", rl.action).
+			Msg("Rate limit exceeded")
+		if rl.action == rateLimitActionDeny && interruption == nil {
+			interruption = &ctypes.Interruption{
+				Action: rateLimitActionDeny,
+				Status: rateLimitStatusCode,
+			}
+		}
+	}
+
+	for _, state := range transactionStates(ctx.tx) {
+		col := state.Variables().TX()
+		if exceeded {
+			col.Set("rate_limit_exceeded", []string{"1"})
+		} else {
+			col.Set("rate_limit_exceeded", []string{"0"})
+		}
+		if remaining != -1 {
+			col.Set("rate_limit_remaining", []string{strconv.Itoa(remaining)})
+		}
+	}
+
+	if interruption == nil {
+		return nil
+	}
+	if ctx.debug {
+		ctx.logger.Info().Msg("Rate limit not enforced for a debugged request")
+		return nil
+	}
+	if !interrupt(ctx.tx, interruption) {
+		ctx.logger.Info().Msg("Rate limit not enforced, the rule engine is DetectionOnly")
+		return nil
+	}
+	return interruption
+}
@@ -0,0 +1,120 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func TestConsumeRateLimitToken(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	rl := rateLimitConfiguration{
+		name:    "remote_addr",
+		key:     "remote_addr",
+		limit:   2,
+		window:  time.Minute,
+		action:  rateLimitActionDeny,
+		buckets: defaultRateLimitBuckets,
+	}
+	now := time.Unix(1680000000, 0)
+
+	consume := func(value string) rateLimitResult {
+		t.Helper()
+		res, err := consumeRateLimitToken(rl, value, now)
+		require.NoError(t, err)
+		return res
+	}
+
+	require.Equal(t, rateLimitResult{remaining: 1}, consume("10.0.0.1"))
+	require.Equal(t, rateLimitResult{remaining: 0}, consume("10.0.0.1"))
+	require.Equal(t, rateLimitResult{exceeded: true, remaining: 0}, consume("10.0.0.1"))
+
+	// Buckets are kept per client.
+	require.Equal(t, rateLimitResult{remaining: 1}, consume("10.0.0.2"))
+
+	// Half of the window refills half of the tokens.
+	now = now.Add(30 * time.Second)
+	require.Equal(t, rateLimitResult{remaining: 0}, consume("10.0.0.1"))
+	require.Equal(t, rateLimitResult{exceeded: true, remaining: 0}, consume("10.0.0.1"))
+
+	// Tokens never exceed the limit.
+	now = now.Add(time.Hour)
+	require.Equal(t, rateLimitResult{remaining: 1}, consume("10.0.0.1"))
+}
+
+func TestConsumeRateLimitTokenBuckets(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	rl := rateLimitConfiguration{
+		name:    "api",
+		key:     "header:x-api-key",
+		limit:   2,
+		window:  time.Minute,
+		action:  rateLimitActionDeny,
+		buckets: 1,
+	}
+	now := time.Unix(1680000000, 0)
+
+	// Rotating values doesn't create new buckets, values of the same bucket share its tokens.
+	for i, expected := range []rateLimitResult{{remaining: 1}, {remaining: 0}, {exceeded: true}} {
+		res, err := consumeRateLimitToken(rl, strings.Repeat("k", 1024*(i+1)), now)
+		require.NoError(t, err)
+		require.Equal(t, expected, res)
+	}
+
+	// Keys are bounded whatever the length of the value.
+	require.Equal(t, rateLimitSharedDataKeyPrefix+"api.0", sharedDataSlotKey(rateLimitSharedDataKeyPrefix+"api.", strings.Repeat("k", 1024), rl.buckets))
+}
+
+func TestRateLimitKeyValue(t *testing.T) {
+	headers := [][2]string{
+		{":path", "/"},
+		{"X-API-Key", "secret"},
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "remote_addr", expected: "10.0.0.1"},
+		{key: "header:x-api-key", expected: "secret"},
+		{key: "header:authorization", expected: ""},
+	}
+
+	for _, tc := range tests {
+		tt := tc
+		t.Run(tt.key, func(t *testing.T) {
+			rl := rateLimitConfiguration{key: tt.key}
+			require.Equal(t, tt.expected, rl.keyValue("10.0.0.1", headers))
+		})
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	valid := rateLimitConfiguration{key: "header:x-api-key", limit: 1, window: time.Second, action: rateLimitActionLog, buckets: 1}
+	require.NoError(t, valid.validate())
+
+	for name, rl := range map[string]rateLimitConfiguration{
+		"unknown key":    {key: "cookie:session", limit: 1, window: time.Second, action: rateLimitActionDeny},
+		"empty header":   {key: "header:", limit: 1, window: time.Second, action: rateLimitActionDeny},
+		"zero limit":     {key: "remote_addr", window: time.Second, action: rateLimitActionDeny},
+		"zero window":    {key: "remote_addr", limit: 1, action: rateLimitActionDeny},
+		"unknown action": {key: "remote_addr", limit: 1, window: time.Second, action: "drop", buckets: 1},
+		"zero buckets":   {key: "remote_addr", limit: 1, window: time.Second, action: rateLimitActionDeny},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, rl.validate())
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	responseHeaderAddPrefix    = "resp_header_add_"
+	responseHeaderRemovePrefix = "resp_header_remove_"
+)
+
+// responseHeadersConfiguration lists the headers added to and removed from every response.
+type responseHeadersConfiguration struct {
+	add    [][2]string
+	remove []string
+}
+
+func (c responseHeadersConfiguration) empty() bool {
+	return len(c.add) == 0 && len(c.remove) == 0
+}
+
+// parseResponseHeadersConfiguration parses the response headers of directives, e.g.
+// {"add": {"x-content-type-options": "nosniff"}, "remove": ["server"]}.
+func parseResponseHeadersConfiguration(value gjson.Result) (responseHeadersConfiguration, error) {
+	c := responseHeadersConfiguration{}
+	var err error
+	value.Get("add").ForEach(func(name, value gjson.Result) bool {
+		if len(name.String()) == 0 || value.Type != gjson.String {
+			err = fmt.Errorf("invalid header %q to add", name.String())
+			return false
+		}
+		c.add = append(c.add, [2]string{strings.ToLower(name.String()), value.String()})
+		return true
+	})
+	if err != nil {
+		return c, err
+	}
+	// Headers are added in a deterministic order.
+	sort.Slice(c.add, func(i, j int) bool { return c.add[i][0] < c.add[j][0] })
+
+	for _, name := range value.Get("remove").Array() {
+		if len(name.String()) == 0 {
+			return c, errors.New("empty header to remove")
+		}
+		c.remove = append(c.remove, strings.ToLower(name.String()))
+	}
+	return c, nil
+}
+
+// ruleResponseHeaders returns the response headers added and removed by rules through TX
+// variables: tx.resp_header_add_<name> adds the header with the variable value and
+// tx.resp_header_remove_<name> removes it. Underscores of names are replaced by dashes,
+// e.g. tx.resp_header_remove_x_powered_by removes X-Powered-By.
+func ruleResponseHeaders(tx plugintypes.TransactionState) responseHeadersConfiguration {
+	c := responseHeadersConfiguration{}
+	for _, md := range tx.Variables().TX().FindAll() {
+		key := strings.ToLower(md.Key())
+		switch {
+		case strings.HasPrefix(key, responseHeaderAddPrefix) && len(key) > len(responseHeaderAddPrefix):
+			c.add = append(c.add, [2]string{responseHeaderName(key[len(responseHeaderAddPrefix):]), md.Value()})
+		case strings.HasPrefix(key, responseHeaderRemovePrefix) && len(key) > len(responseHeaderRemovePrefix):
+			c.remove = append(c.remove, responseHeaderName(key[len(responseHeaderRemovePrefix):]))
+		}
+	}
+	sort.Slice(c.add, func(i, j int) bool { return c.add[i][0] < c.add[j][0] })
+	sort.Strings(c.remove)
+	return c
+}
+
+func responseHeaderName(variable string) string {
+	return strings.ReplaceAll(variable, "_", "-")
+}
+
+// mutateResponseHeaders applies the response headers of the directives and then the ones of
+// the rules, so that rules can override the directives ones. For each of them, headers are
+// removed before adding the others, so that removing and adding a header replaces it.
+func (ctx *httpContext) mutateResponseHeaders() {
+	mutations := []responseHeadersConfiguration{ctx.options.responseHeaders}
+	for _, state := range transactionStates(ctx.tx) {
+		mutations = append(mutations, ruleResponseHeaders(state))
+	}
+
+	for _, m := range mutations {
+		for _, name := range m.remove {
+			if err := proxywasm.RemoveHttpResponseHeader(name); err != nil {
+				ctx.logger.Error().Err(err).Str("header", name).Msg("Failed to remove response header")
+			}
+		}
+		for _, h := range m.add {
+			if err := proxywasm.AddHttpResponseHeader(h[0], h[1]); err != nil {
+				ctx.logger.Error().Err(err).Str("header", h[0]).Msg("Failed to add response header")
+			}
+		}
+	}
+}
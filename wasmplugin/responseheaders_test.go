@@ -0,0 +1,52 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestParseResponseHeadersConfiguration(t *testing.T) {
+	c, err := parseResponseHeadersConfiguration(gjson.Parse(`{
+		"add": {"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=31536000"},
+		"remove": ["Server", "X-Powered-By"]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, responseHeadersConfiguration{
+		add:    [][2]string{{"strict-transport-security", "max-age=31536000"}, {"x-frame-options", "DENY"}},
+		remove: []string{"server", "x-powered-by"},
+	}, c)
+
+	c, err = parseResponseHeadersConfiguration(gjson.Parse(``))
+	require.NoError(t, err)
+	require.True(t, c.empty())
+
+	_, err = parseResponseHeadersConfiguration(gjson.Parse(`{"add": {"x-frame-options": 1}}`))
+	require.Error(t, err)
+
+	_, err = parseResponseHeadersConfiguration(gjson.Parse(`{"remove": [""]}`))
+	require.Error(t, err)
+}
+
+func TestRuleResponseHeaders(t *testing.T) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`
+SecAction "id:1,phase:1,pass,nolog,setvar:'tx.resp_header_add_content_security_policy=default-src https:',setvar:tx.resp_header_remove_x_powered_by=1,setvar:tx.resp_header_remove_server=1"
+SecAction "id:2,phase:1,pass,nolog,setvar:tx.resp_header_add_=1,setvar:tx.other=1"
+`))
+	require.NoError(t, err)
+
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	require.Nil(t, tx.ProcessRequestHeaders())
+
+	require.Equal(t, responseHeadersConfiguration{
+		add:    [][2]string{{"content-security-policy", "default-src https:"}},
+		remove: []string{"server", "x-powered-by"},
+	}, ruleResponseHeaders(tx.(plugintypes.TransactionState)))
+}
@@ -0,0 +1,53 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const sharedDataMaxCASRetries = 8
+
+// updateSharedData applies fn to the value stored under key and stores the result back.
+// Shared data is shared across Envoy worker threads, hence the update is retried when
+// another worker modified the value in between (CAS mismatch). The value returned by fn
+// must not be empty.
+func updateSharedData(key string, fn func(data []byte, found bool) ([]byte, error)) error {
+	for i := 0; i < sharedDataMaxCASRetries; i++ {
+		data, cas, err := proxywasm.GetSharedData(key)
+		if err != nil && err != types.ErrorStatusNotFound {
+			return err
+		}
+
+		data, err = fn(data, err == nil)
+		if err != nil {
+			return err
+		}
+
+		err = proxywasm.SetSharedData(key, data, cas)
+		if err == nil {
+			return nil
+		}
+		if err != types.ErrorStatusCasMismatch {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to update %q after %d attempts", key, sharedDataMaxCASRetries)
+}
+
+// sharedDataSlotKey returns the key of the slot, among slots, holding the record of key. The
+// shared data does not support deletions, hence records are spread over a fixed number of
+// slots reused once they expire, rather than over keys taken from requests that would grow
+// without bound.
+func sharedDataSlotKey(prefix string, key string, slots int) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return prefix + strconv.FormatUint(h.Sum64()%uint64(slots), 16)
+}
@@ -0,0 +1,79 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// wafCache compiles directives into WAFs, sharing a single WAF among the directives
+// that are identical once normalized.
+type wafCache struct {
+	rootFS fs.FS
+	wafs   map[string]cachedWAF
+}
+
+type cachedWAF struct {
+	// name is the name of the directives the WAF was compiled for.
+	name string
+	waf  coraza.WAF
+}
+
+func newWAFCache(rootFS fs.FS) *wafCache {
+	return &wafCache{
+		rootFS: rootFS,
+		wafs:   map[string]cachedWAF{},
+	}
+}
+
+// get returns the WAF for the directives, compiling them unless identical ones were already
+// compiled. The time taken by compilation and the growth of the heap are logged.
+func (c *wafCache) get(name string, directives []string) (coraza.WAF, error) {
+	key := directivesHash(directives)
+	if cached, ok := c.wafs[key]; ok {
+		proxywasm.LogInfof("Directives %q are identical to %q, sharing their WAF", name, cached.name)
+		return cached.waf, nil
+	}
+
+	start := time.Now()
+	heap := heapBytes()
+	waf, err := newWAF(c.rootFS, directives)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	// A collection during the compilation can release more than small WAFs retain.
+	growth := int64(heapBytes()) - int64(heap)
+	if growth < 0 {
+		growth = 0
+	}
+	proxywasm.LogInfof("Directives %q parsed in %s, heap grew by %d bytes", name, elapsed, growth)
+	logWAFSummary(name, waf)
+
+	c.wafs[key] = cachedWAF{name: name, waf: waf}
+	return waf, nil
+}
+
+// directivesHash identifies directives regardless of indentation, blank lines and comments.
+func directivesHash(directives []string) string {
+	h := sha256.New()
+	for _, directive := range directives {
+		for _, line := range strings.Split(directive, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			h.Write([]byte(line))
+			h.Write([]byte{'\n'})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
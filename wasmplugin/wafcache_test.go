@@ -0,0 +1,95 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func TestDirectivesHash(t *testing.T) {
+	base := directivesHash([]string{"SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:1,deny\""})
+
+	require.Equal(t, base, directivesHash([]string{"  SecRuleEngine On\n\n# comment", "SecRule ARGS \"@rx foo\" \"id:1,deny\"  "}))
+	require.Equal(t, base, directivesHash([]string{"SecRuleEngine On\nSecRule ARGS \"@rx foo\" \"id:1,deny\""}))
+	require.NotEqual(t, base, directivesHash([]string{"SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:2,deny\""}))
+	require.NotEqual(t, base, directivesHash([]string{"SecRule ARGS \"@rx foo\" \"id:1,deny\"", "SecRuleEngine On"}))
+}
+
+func TestWAFCache(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	cache := newWAFCache(root)
+
+	waf1, err := cache.get("rs1", []string{"SecRuleEngine On"})
+	require.NoError(t, err)
+
+	waf2, err := cache.get("rs2", []string{"# same rules", "SecRuleEngine On"})
+	require.NoError(t, err)
+	require.Equal(t, waf1, waf2)
+
+	waf3, err := cache.get("rs3", []string{"SecRuleEngine DetectionOnly"})
+	require.NoError(t, err)
+	require.NotEqual(t, waf1, waf3)
+
+	_, err = cache.get("rs4", []string{"SecRule INVALID"})
+	require.Error(t, err)
+}
+
+func TestWAFCacheLiveHeap(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().WithVMContext(NewVMContext())
+	_, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	var rules strings.Builder
+	for i := 1; i <= 500; i++ {
+		fmt.Fprintf(&rules, "SecRule ARGS \"@rx attack%d\" \"id:%d,phase:2,deny,t:lowercase,t:urlDecodeUni\"\n", i, i)
+	}
+
+	liveHeapBytes := func() int64 {
+		// Pooled objects survive a single collection.
+		runtime.GC()
+		runtime.GC()
+		ms := runtime.MemStats{}
+		runtime.ReadMemStats(&ms)
+		return int64(ms.HeapAlloc)
+	}
+
+	cache := newWAFCache(root)
+	var wafs []coraza.WAF
+	retained := func(get func() coraza.WAF) int64 {
+		t.Helper()
+		before := liveHeapBytes()
+		// Keeps the WAFs reachable, as the plugin does.
+		wafs = append(wafs, get())
+		return liveHeapBytes() - before
+	}
+	compile := func(name string, directives []string) func() coraza.WAF {
+		return func() coraza.WAF {
+			waf, err := cache.get(name, directives)
+			require.NoError(t, err)
+			return waf
+		}
+	}
+
+	compiled := retained(compile("rs1", []string{rules.String()}))
+	shared := retained(compile("rs2", []string{"# same rules", rules.String()}))
+	require.Greater(t, compiled, int64(0))
+	require.Less(t, shared, compiled/10)
+
+	// Extending directives are compiled on their own and layered on the shared base WAF.
+	extended := retained(func() coraza.WAF {
+		return newLayeredWAF(wafs[0], compile("rs3", []string{"SecRule ARGS \"@rx tenant\" \"id:1000,deny\""})())
+	})
+	require.Less(t, extended, compiled/10)
+	require.Len(t, wafs, 3)
+}